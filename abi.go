@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The guest ABI is what a wasm module must export to run on the wasm runners,
+// whatever it was built with: Rust, TinyGo, AssemblyScript or C. Load one
+// with -wasm path.wasm.
+//
+// The host allocates a buffer of bufSize bytes with `allocate` once, and
+// passes every record through it:
+//
+//   - memory: the linear memory the buffer lives in.
+//   - allocate(size i32) -> ptr i32: allocates size bytes owned by the host.
+//   - deallocate(ptr i32, size i32): frees memory from allocate, or returned
+//     by the guest.
+//   - A transform, such as noop_wasm or regex_wasm, takes (ptr i32, len i32,
+//     capacity i32) of the input in the buffer of capacity bytes, writes its
+//     output over it and returns the output's length as an i32. An output
+//     longer than capacity is not written, its length tells the host so.
+//
+// The other exports are optional and enable more scenarios, see guestExports.
+// Guests may import WASI and the functions of hostModule.
+// Exports that return an i64 pack two i32: ptr or flag in the high bits,
+// length in the low bits.
+type guestSignature struct {
+	params, results string
+}
+
+func (sig guestSignature) String() string {
+	return fmt.Sprintf("(%s) -> (%s)", sig.params, sig.results)
+}
+
+// newGuestSignature describes a function type by its value type names, such
+// as "i32".
+func newGuestSignature(params, results []string) guestSignature {
+	return guestSignature{strings.Join(params, ", "), strings.Join(results, ", ")}
+}
+
+var (
+	bufferTransform       = guestSignature{"i32, i32, i32", "i32"}
+	packedBufferTransform = guestSignature{"i32, i32, i32", "i64"}
+	packedTransform       = guestSignature{"i32, i32", "i64"}
+)
+
+// guestExports are the functions of the guest ABI.
+var guestExports = map[string]struct {
+	signature guestSignature
+	required  bool
+}{
+	"allocate":   {guestSignature{"i32", "i32"}, true},
+	"deallocate": {guestSignature{"i32, i32", ""}, true},
+
+	"noop_wasm":  {bufferTransform, false},
+	"regex_wasm": {bufferTransform, false},
+	// configure_wasm(ptr, pattern_len, replacement_len, count, capacity)
+	// sets the regex from the pattern and replacement written back to back
+	// at ptr. It returns 0, or the length of an error message at ptr.
+	"configure_wasm": {guestSignature{"i32, i32, i32, i32, i32", "i32"}, false},
+
+	// compile_vrl_wasm returns 0, or the ptr and length of the JSON
+	// diagnostics, which the host deallocates.
+	"compile_vrl_wasm": {packedTransform, false},
+	// The VRL transforms set the high bits when the output is a runtime error
+	// as JSON.
+	"vrl_wasm":        {packedBufferTransform, false},
+	"vrl_event_wasm":  {packedBufferTransform, false},
+	"vrl_target_wasm": {packedBufferTransform, false},
+	// enrich_wasm appends the value of the record's key, which it looks up
+	// with the functions of hostModule.
+	"enrich_wasm": {bufferTransform, false},
+	// ring_drain_wasm(ring, transform) runs a ringTransform on the records
+	// of the input ring and writes the results to the output ring, until
+	// either runs out. It returns how many records it took, see ring.go.
+	"ring_drain_wasm": {guestSignature{"i32, i32", "i32"}, false},
+	// The dynamic allocation transforms take input the host allocated with
+	// allocate, and return the ptr and length of their output, which the host
+	// deallocates. vrl_wasm_dynamic_allocation sets dynamicErrorFlag in the
+	// length when the output is a runtime error as JSON.
+	"noop_wasm_dynamic_allocation":  {packedTransform, false},
+	"regex_wasm_dynamic_allocation": {packedTransform, false},
+	"vrl_wasm_dynamic_allocation":   {packedTransform, false},
+}
+
+// dynamicErrorFlag is the top bit of the length returned by a dynamic
+// allocation transform.
+const dynamicErrorFlag = 1 << 31
+
+// validateGuestExports checks that a module exports its memory, the required
+// functions and at least one transform, and that every function of the guest
+// ABI has its signature. Other exports are ignored.
+func validateGuestExports(functions map[string]guestSignature, memory bool) error {
+	var problems []string
+	if !memory {
+		problems = append(problems, `no exported memory named "memory"`)
+	}
+
+	transforms := 0
+	for name, export := range guestExports {
+		sig, ok := functions[name]
+		switch {
+		case !ok && export.required:
+			problems = append(problems, fmt.Sprintf("missing export %s%s", name, export.signature))
+		case ok && sig != export.signature:
+			problems = append(problems, fmt.Sprintf("export %s%s, want %s", name, sig, export.signature))
+		case ok && !export.required && name != "configure_wasm" && name != "compile_vrl_wasm":
+			transforms++
+		}
+	}
+	if transforms == 0 {
+		problems = append(problems, "exports none of the transforms")
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("wasm module does not implement the guest ABI:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// errMissingExport is returned when a scenario needs a transform the guest
+// doesn't export.
+func errMissingExport(runtime, name string) error {
+	return fmt.Errorf("%s: the wasm module does not export %s", runtime, name)
+}
+
+// BufferOverflowError is returned when the input or the output of a
+// transform doesn't fit the buffer. The guest wrote nothing, the instance can
+// be used again.
+type BufferOverflowError struct {
+	Runtime  string // "wazero" or "wasmtime"
+	Function string
+	Size     int
+	// Input is set when the input was too big, which isn't passed to the
+	// guest at all.
+	Input bool
+}
+
+func (e *BufferOverflowError) Error() string {
+	what := "output"
+	if e.Input {
+		what = "input"
+	}
+	return fmt.Sprintf("%s: the %s of %s is %d bytes, the buffer only holds %d",
+		e.Runtime, what, e.Function, e.Size, bufSize)
+}
+
+// GuestTrapError is returned when the guest traps during a call, for example
+// when it grows its memory past MemoryLimits.MaxPages. The runner has already
+// replaced the instance that trapped.
+type GuestTrapError struct {
+	Runtime  string // "wazero" or "wasmtime"
+	Function string
+	Err      error
+}
+
+func (e *GuestTrapError) Error() string {
+	return fmt.Sprintf("%s: %s trapped: %v", e.Runtime, e.Function, e.Err)
+}
+
+func (e *GuestTrapError) Unwrap() error {
+	return e.Err
+}
+
+// loadWasmFile replaces the embedded module with the one at filename.
+func loadWasmFile(filename string) error {
+	wasmBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	compiledWasmBytes = wasmBytes
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateGuestExports(t *testing.T) {
+	valid := map[string]guestSignature{
+		"allocate":   {"i32", "i32"},
+		"deallocate": {"i32, i32", ""},
+		"noop_wasm":  {"i32, i32, i32", "i32"},
+		"_start":     {"", ""}, // not part of the ABI
+	}
+	if err := validateGuestExports(valid, true); err != nil {
+		t.Errorf("got %v for a module with allocate, deallocate and a transform", err)
+	}
+
+	invalid := map[string]guestSignature{
+		"allocate": {"i32", "i32"},
+		"vrl_wasm": {"i32, i32", "i32"},
+	}
+	err := validateGuestExports(invalid, false)
+	if err == nil {
+		t.Fatal("got no error for an invalid module")
+	}
+	for _, want := range []string{
+		`no exported memory named "memory"`,
+		"missing export deallocate(i32, i32) -> ()",
+		"export vrl_wasm(i32, i32) -> (i32), want (i32, i32, i32) -> (i64)",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+
+	onlyConfigure := map[string]guestSignature{
+		"allocate":       {"i32", "i32"},
+		"deallocate":     {"i32, i32", ""},
+		"configure_wasm": {"i32, i32, i32, i32, i32", "i32"},
+	}
+	if err := validateGuestExports(onlyConfigure, true); err == nil || !strings.Contains(err.Error(), "none of the transforms") {
+		t.Errorf("got %v, want an error for a module without transforms", err)
+	}
+}
+
+func TestBufferOverflow(t *testing.T) {
+	defer func(cfg RegexConfig) {
+		if err := setRegexConfig(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}(regexConfig)
+	// Every output is four times as long as the input.
+	if err := setRegexConfig(RegexConfig{Pattern: "a", Replacement: "aaaa"}); err != nil {
+		t.Fatal(err)
+	}
+
+	wazeroRunner := NewWazeroRunner(context.Background(), compiledWasmBytes)
+	defer wazeroRunner.Close()
+	wasmtimeRunner := NewWasmtimeRunner(compiledWasmBytes)
+	defer wasmtimeRunner.Close()
+
+	for name, run := range map[string]VrlFunc{
+		"Rust (WASM Wazero) regex":   wazeroRunner.runRegex,
+		"Rust (WASM Wazero) VRL":     wazeroRunner.runVrl,
+		"Rust (WASM Wasmtime) regex": wasmtimeRunner.runRegex,
+		"Rust (WASM Wasmtime) VRL":   wasmtimeRunner.runVrl,
+	} {
+		_, err := run(strings.Repeat("a", bufSize))
+		var overflowErr *BufferOverflowError
+		if !errors.As(err, &overflowErr) || overflowErr.Size != 4*bufSize {
+			t.Errorf("%s: got %v, want a *BufferOverflowError of %d bytes", name, err, 4*bufSize)
+		}
+		// The instance is still usable.
+		if got, err := run("abc"); err != nil || got != "aaaabc" {
+			t.Errorf("%s: got %q, %v after an overflow, want %q", name, got, err, "aaaabc")
+		}
+	}
+}
+
+func TestBufferOverflowInput(t *testing.T) {
+	wazeroRunner := NewWazeroRunner(context.Background(), compiledWasmBytes)
+	defer wazeroRunner.Close()
+	wasmtimeRunner := NewWasmtimeRunner(compiledWasmBytes)
+	defer wasmtimeRunner.Close()
+
+	for name, run := range map[string]VrlFunc{
+		"Rust (WASM Wazero) noop":    wazeroRunner.runNoop,
+		"Rust (WASM Wazero) regex":   wazeroRunner.runRegex,
+		"Rust (WASM Wazero) VRL":     wazeroRunner.runVrl,
+		"Rust (WASM Wasmtime) noop":  wasmtimeRunner.runNoop,
+		"Rust (WASM Wasmtime) regex": wasmtimeRunner.runRegex,
+		"Rust (WASM Wasmtime) VRL":   wasmtimeRunner.runVrl,
+	} {
+		_, err := run(strings.Repeat("a", bufSize+1))
+		var overflowErr *BufferOverflowError
+		if !errors.As(err, &overflowErr) || !overflowErr.Input || overflowErr.Size != bufSize+1 {
+			t.Errorf("%s: got %v, want a *BufferOverflowError for an input of %d bytes", name, err, bufSize+1)
+		}
+		if got, err := run("abc"); err != nil || got != "abc" {
+			t.Errorf("%s: got %q, %v after an overflow, want %q", name, got, err, "abc")
+		}
+	}
+}
@@ -4,7 +4,13 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
+	"regexp"
+	"runtime"
 	"strings"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/bloblang"
 )
 
 const (
@@ -21,34 +27,380 @@ type Scenario struct {
 	result      string
 }
 
-func generateBenchmarkTable() string {
-	wazeroCtx := context.Background()
-	wazeroRunner := NewWazeroRunner(wazeroCtx, compiledWasmBytes)
-	defer wazeroRunner.Close()
+// StringsInStringsOut processes many records at once, and returns the
+// outputs in order.
+type StringsInStringsOut func(in []string) []string
 
-	wasmtimeRunner := NewWasmtimeRunner(compiledWasmBytes)
+// BatchScenario is a Scenario that streams records in batches of
+// ringBatchSize, for the wasm ring buffers, the Rust worker pool, the
+// sidecar and the gRPC service.
+type BatchScenario struct {
+	environment string
+	description string
+	runner      StringsInStringsOut
+	result      string
+}
 
-	// Step 1, generate the scenarios that we want to run
-	// - processStringRs, processStringGo, useVrl
+// ringBatchSize is how many records the BatchScenarios stream at a time.
+const ringBatchSize = 256
+
+// benchmarkEngines holds one instance of every engine the scenarios run on.
+// The wasm runners are not safe for concurrent use, so parallel callers need
+// one benchmarkEngines each.
+type benchmarkEngines struct {
+	wazero   *WazeroRunner
+	wasmtime *WasmtimeRunner
+	bloblang *bloblang.Executor
+	// rustWorkers has one thread per CPU, as it gets whole batches. It is
+	// created by workerPool on first use, which sets closeWorkers. A pool
+	// shared by several benchmarkEngines is set directly and closed by its
+	// owner.
+	rustWorkers  *RustWorkerPool
+	closeWorkers bool
+	// sidecar and grpc are created by rustSidecar and grpcClient on first
+	// use, so that only their scenarios need helloRustBinary and a socket.
+	sidecar *RustSidecar
+	// grpc calls grpcServer over 127.0.0.1.
+	grpcServer *TransformServer
+	grpc       *TransformClient
+
+	// How long creating the wasm runners took, see RunnerOptions.CacheDir.
+	wazeroStartup, wasmtimeStartup time.Duration
+}
+
+func newBenchmarkEngines() *benchmarkEngines {
+	e := &benchmarkEngines{}
+
+	start := time.Now()
+	e.wazero = NewWazeroRunner(context.Background(), compiledWasmBytes)
+	e.wazeroStartup = time.Since(start)
+
+	start = time.Now()
+	e.wasmtime = NewWasmtimeRunner(compiledWasmBytes)
+	e.wasmtimeStartup = time.Since(start)
+
+	if bloblangConfig.supportsRegexConfig() {
+		e.bloblang = setupBloblang()
+	}
+	return e
+}
+
+func (e *benchmarkEngines) Close() {
+	e.wazero.Close()
+	e.wasmtime.Close()
+	if e.closeWorkers {
+		e.rustWorkers.Close()
+	}
+	if e.sidecar != nil {
+		e.sidecar.Close()
+	}
+	if e.grpc != nil {
+		e.grpc.Close()
+		e.grpcServer.Stop()
+	}
+}
+
+// workerPool returns the Rust worker pool, which is only started for the
+// scenarios that use it.
+func (e *benchmarkEngines) workerPool() *RustWorkerPool {
+	if e.rustWorkers == nil {
+		e.rustWorkers = NewRustWorkerPool(runtime.NumCPU())
+		e.closeWorkers = true
+	}
+	return e.rustWorkers
+}
+
+// rustSidecar returns the sidecar, which is only spawned for the scenarios
+// that use it.
+func (e *benchmarkEngines) rustSidecar() *RustSidecar {
+	if e.sidecar == nil {
+		e.sidecar = NewRustSidecar()
+	}
+	return e.sidecar
+}
+
+// grpcClient returns the client of the gRPC service, which is only served
+// for the scenarios that use it.
+func (e *benchmarkEngines) grpcClient() *TransformClient {
+	if e.grpc == nil {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Panicln(err)
+		}
+		e.grpcServer = NewTransformServer("go", 1, nil)
+		go e.grpcServer.Serve(listener)
+		if e.grpc, err = DialTransformService(listener.Addr().String()); err != nil {
+			log.Panicln(err)
+		}
+	}
+	return e.grpc
+}
+
+// lazyRun is mustRun for a function that get returns on the first call, so
+// that its engine is only started when the scenario runs.
+func lazyRun(get func() VrlFunc) StringInStringOut {
+	var run StringInStringOut
+	return func(s string) string {
+		if run == nil {
+			run = mustRun(get())
+		}
+		return run(s)
+	}
+}
+
+// benchmarkScenarios returns every engine/scenario combination we compare.
+func benchmarkScenarios(e *benchmarkEngines) []*Scenario {
 	scenarios := []*Scenario{
 		// String Copy
 		{"Go", "String Copy", simpleStringGo, ""},
 		{"Rust (FFI)", "String Copy", noopStringRs, ""},
-		{"Rust (WASM Wazero)", "String Copy", func(s string) string { return wazeroRunner.runNoop(s) }, ""},
-		{"Rust (WASM Wasmtime)", "String Copy", func(s string) string { return wasmtimeRunner.runNoop(s) }, ""},
+		{"Rust (FFI Worker Pool)", "String Copy", lazyRun(func() VrlFunc { return e.workerPool().runNoop }), ""},
+		{"Rust (Sidecar)", "String Copy", lazyRun(func() VrlFunc { return e.rustSidecar().runNoop }), ""},
+		{"Go (gRPC Loopback)", "String Copy", lazyRun(func() VrlFunc { return e.grpcClient().runner("noopgo") }), ""},
+		{"Rust (WASM Wazero)", "String Copy", mustRun(e.wazero.runNoop), ""},
+		{"Rust (WASM Wasmtime)", "String Copy", mustRun(e.wasmtime.runNoop), ""},
+		{"Rust (WASM Wazero)", "String Copy (Dynamic Allocation)", mustRun(e.wazero.runNoopDynamicAllocation), ""},
+		{"Rust (WASM Wasmtime)", "String Copy (Dynamic Allocation)", mustRun(e.wasmtime.runNoopDynamicAllocation), ""},
 
 		// Regex
 		{"Go", "Regex Replace", processStringGo, ""},
 		{"Rust (FFI)", "Regex Replace", processStringRs, ""},
-		{"Rust (WASM Wazero)", "Regex Replace", func(s string) string { return wazeroRunner.runRegex(s) }, ""},
-		{"Rust (WASM Wasmtime)", "Regex Replace", func(s string) string { return wasmtimeRunner.runRegex(s) }, ""},
+		{"Rust (FFI Worker Pool)", "Regex Replace", lazyRun(func() VrlFunc { return e.workerPool().runRegex }), ""},
+		{"Rust (Sidecar)", "Regex Replace", lazyRun(func() VrlFunc { return e.rustSidecar().runRegex }), ""},
+		{"Go (gRPC Loopback)", "Regex Replace", lazyRun(func() VrlFunc { return e.grpcClient().runner("go") }), ""},
+		{"Rust (FFI, gRPC Loopback)", "Regex Replace", lazyRun(func() VrlFunc { return e.grpcClient().runner("rust") }), ""},
+		{"Rust (WASM Wazero)", "Regex Replace", mustRun(e.wazero.runRegex), ""},
+		{"Rust (WASM Wasmtime)", "Regex Replace", mustRun(e.wasmtime.runRegex), ""},
+		{"Rust (WASM Wazero)", "Regex Replace (Dynamic Allocation)", mustRun(e.wazero.runRegexDynamicAllocation), ""},
+		{"Rust (WASM Wasmtime)", "Regex Replace (Dynamic Allocation)", mustRun(e.wasmtime.runRegexDynamicAllocation), ""},
 
 		// VRL
-		{"Rust (FFI)", "VRL Replace", processStringVrl, ""},
-		{"Rust (WASM Wazero)", "VRL Replace", func(s string) string { return wazeroRunner.runVrl(s) }, ""},
-		{"Rust (WASM Wasmtime)", "VRL Replace", func(s string) string { return wasmtimeRunner.runVrl(s) }, ""},
+		{"Rust (FFI)", "VRL Replace", mustRun(processStringVrl), ""},
+		{"Rust (FFI Worker Pool)", "VRL Replace", lazyRun(func() VrlFunc { return e.workerPool().runVrl }), ""},
+		{"Rust (Sidecar)", "VRL Replace", lazyRun(func() VrlFunc { return e.rustSidecar().runVrl }), ""},
+		{"Rust (FFI, gRPC Loopback)", "VRL Replace", lazyRun(func() VrlFunc { return e.grpcClient().runner("vrl") }), ""},
+		{"Rust (WASM Wasmtime, gRPC Loopback)", "VRL Replace", lazyRun(func() VrlFunc { return e.grpcClient().runner("wasmtime") }), ""},
+		{"Rust (WASM Wazero)", "VRL Replace", mustRun(e.wazero.runVrl), ""},
+		{"Rust (WASM Wasmtime)", "VRL Replace", mustRun(e.wasmtime.runVrl), ""},
+		{"Rust (WASM Wazero)", "VRL Replace (Dynamic Allocation)", mustRun(e.wazero.runVrlDynamicAllocation), ""},
+		{"Rust (WASM Wasmtime)", "VRL Replace (Dynamic Allocation)", mustRun(e.wasmtime.runVrlDynamicAllocation), ""},
+
+		// VRL on a JSON event, replacing .message
+		{"Rust (FFI)", "VRL Event Replace", vrlEventRunner(mustRun(processEventVrl)), ""},
+		{"Rust (WASM Wazero)", "VRL Event Replace", vrlEventRunner(mustRun(e.wazero.runVrlEvent)), ""},
+		{"Rust (WASM Wasmtime)", "VRL Event Replace", vrlEventRunner(mustRun(e.wasmtime.runVrlEvent)), ""},
+
+		// Enrichment from a Go-side table through host function calls
+		{"Go", "Host Call Enrich", enrichGo, ""},
+		{"Rust (WASM Wazero)", "Host Call Enrich", mustRun(e.wazero.runEnrich), ""},
+		{"Rust (WASM Wasmtime)", "Host Call Enrich", mustRun(e.wasmtime.runEnrich), ""},
 	}
 
+	if e.bloblang != nil {
+		scenarios = append(scenarios, &Scenario{"Go (Bloblang)", "Regex Replace", func(s string) string { return processStringBloblang(e.bloblang, s) }, ""})
+	}
+
+	return withoutMissingExports(scenarios, e.wazero.hasExport)
+}
+
+// ringScenarios returns the BatchScenarios of the wasm runners, or none when
+// the guest doesn't export ring_drain_wasm.
+func ringScenarios(environment string, runner wasmRunner) []*BatchScenario {
+	if !runner.hasExport("ring_drain_wasm") {
+		log.Printf("Skipping the %q ring buffer scenarios, the wasm module does not export ring_drain_wasm", environment)
+		return nil
+	}
+	return []*BatchScenario{
+		{environment, "String Copy (Ring Buffer)", mustRunRing(runner, ringNoop), ""},
+		{environment, "Regex Replace (Ring Buffer)", mustRunRing(runner, ringRegex), ""},
+		{environment, "VRL Replace (Ring Buffer)", mustRunRing(runner, ringVrl), ""},
+	}
+}
+
+// mustRunRing adapts runner's ring buffers to the BatchScenarios, like
+// mustRun.
+func mustRunRing(runner wasmRunner, transform ringTransform) StringsInStringsOut {
+	return func(records []string) []string {
+		outputs := make([]string, 0, len(records))
+		err := runner.runRing(records, transform, func(output string, err error) {
+			if err != nil {
+				log.Panicln(err)
+			}
+			outputs = append(outputs, output)
+		})
+		if err != nil {
+			log.Panicln(err)
+		}
+		return outputs
+	}
+}
+
+// batchRunner is the runBatch method of RustWorkerPool and RustSidecar.
+type batchRunner func(records []string, transform ringTransform, emit func(string, error))
+
+// batchScenarios returns the BatchScenarios of environment, which transforms
+// whole batches with run.
+func batchScenarios(environment string, run batchRunner) []*BatchScenario {
+	withTransform := func(transform ringTransform) StringsInStringsOut {
+		return mustRunBatch(func(records []string, emit func(string, error)) {
+			run(records, transform, emit)
+		})
+	}
+	return []*BatchScenario{
+		{environment, "String Copy (Batch)", withTransform(ringNoop), ""},
+		{environment, "Regex Replace (Batch)", withTransform(ringRegex), ""},
+		{environment, "VRL Replace (Batch)", withTransform(ringVrl), ""},
+	}
+}
+
+// mustRunBatch adapts a function emitting the outputs of records in order to
+// the BatchScenarios, like mustRun.
+func mustRunBatch(run func(records []string, emit func(string, error))) StringsInStringsOut {
+	return func(records []string) []string {
+		outputs := make([]string, 0, len(records))
+		run(records, func(output string, err error) {
+			if err != nil {
+				log.Panicln(err)
+			}
+			outputs = append(outputs, output)
+		})
+		return outputs
+	}
+}
+
+// workerPoolScenarios returns the BatchScenarios of the Rust worker pool of
+// e, which run the records of a batch in parallel.
+func workerPoolScenarios(e *benchmarkEngines) []*BatchScenario {
+	return batchScenarios("Rust (FFI Worker Pool)", func(records []string, transform ringTransform, emit func(string, error)) {
+		e.workerPool().runBatch(records, transform, emit)
+	})
+}
+
+// sidecarScenarios returns the BatchScenarios of the sidecar of e, which
+// sends every batch as a single request.
+func sidecarScenarios(e *benchmarkEngines) []*BatchScenario {
+	return batchScenarios("Rust (Sidecar)", func(records []string, transform ringTransform, emit func(string, error)) {
+		e.rustSidecar().runBatch(records, transform, emit)
+	})
+}
+
+// grpcScenarios returns the BatchScenarios of the gRPC service of e, which
+// gets every batch as a single TransformBatch call or on one Transform
+// stream.
+func grpcScenarios(e *benchmarkEngines) []*BatchScenario {
+	var scenarios []*BatchScenario
+	for _, s := range []struct{ environment, description, engine string }{
+		{"Go (gRPC Loopback)", "Regex Replace", "go"},
+		{"Rust (FFI, gRPC Loopback)", "Regex Replace", "rust"},
+		{"Rust (FFI, gRPC Loopback)", "VRL Replace", "vrl"},
+	} {
+		engine := s.engine
+		scenarios = append(scenarios,
+			&BatchScenario{s.environment, s.description + " (Batch)", mustRunBatch(func(records []string, emit func(string, error)) {
+				e.grpcClient().runBatch(engine, "", records, emit)
+			}), ""},
+			&BatchScenario{s.environment, s.description + " (Stream)", mustRunBatch(func(records []string, emit func(string, error)) {
+				e.grpcClient().runStream(engine, "", records, emit)
+			}), ""})
+	}
+	return scenarios
+}
+
+// scenarioExports are the guest exports the wasm scenarios call, by
+// description.
+var scenarioExports = map[string]string{
+	"String Copy":                        "noop_wasm",
+	"String Copy (Dynamic Allocation)":   "noop_wasm_dynamic_allocation",
+	"Regex Replace":                      "regex_wasm",
+	"Regex Replace (Dynamic Allocation)": "regex_wasm_dynamic_allocation",
+	"VRL Replace":                        "vrl_wasm",
+	"VRL Replace (Dynamic Allocation)":   "vrl_wasm_dynamic_allocation",
+	"VRL Event Replace":                  "vrl_event_wasm",
+	"Host Call Enrich":                   "enrich_wasm",
+}
+
+// withoutMissingExports drops the wasm scenarios that call an export the
+// module doesn't have, so modules loaded with -wasm only need the transforms
+// they implement.
+func withoutMissingExports(scenarios []*Scenario, hasExport func(name string) bool) []*Scenario {
+	var kept []*Scenario
+	for _, scenario := range scenarios {
+		export, ok := scenarioExports[scenario.description]
+		if ok && strings.HasPrefix(scenario.environment, "Rust (WASM") && !hasExport(export) {
+			log.Printf("Skipping %q %q, the wasm module does not export %s", scenario.environment, scenario.description, export)
+			continue
+		}
+		kept = append(kept, scenario)
+	}
+	return kept
+}
+
+// filterScenarios keeps the scenarios whose "environment scenario" name
+// matches the filter. A nil filter keeps everything.
+func filterScenarios(scenarios []*Scenario, filter *regexp.Regexp) []*Scenario {
+	if filter == nil {
+		return scenarios
+	}
+
+	var filtered []*Scenario
+	for _, scenario := range scenarios {
+		if filter.MatchString(scenario.environment + " " + scenario.description) {
+			filtered = append(filtered, scenario)
+		}
+	}
+	return filtered
+}
+
+// filterBatchScenarios is filterScenarios for BatchScenarios.
+func filterBatchScenarios(scenarios []*BatchScenario, filter *regexp.Regexp) []*BatchScenario {
+	if filter == nil {
+		return scenarios
+	}
+
+	var filtered []*BatchScenario
+	for _, scenario := range scenarios {
+		if filter.MatchString(scenario.environment + " " + scenario.description) {
+			filtered = append(filtered, scenario)
+		}
+	}
+	return filtered
+}
+
+// startupResult formats the time it took to create a wasm runner.
+func startupResult(d time.Duration) string {
+	cache := "no cache"
+	if runnerOptions.CacheDir != "" {
+		cache = "cache " + runnerOptions.CacheDir
+	}
+	return fmt.Sprintf("%s (%s)", d.Round(time.Millisecond), cache)
+}
+
+// generateBenchmarkTable runs the scenarios matching filter. With matrix, the
+// wasm scenarios also run once for every setting of runtimeMatrix.
+func generateBenchmarkTable(filter *regexp.Regexp, matrix bool) string {
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	// Step 1, generate the scenarios that we want to run
+	// - processStringRs, processStringGo, useVrl
+	all := benchmarkScenarios(engines)
+	allBatches := append(ringScenarios("Rust (WASM Wazero)", engines.wazero),
+		ringScenarios("Rust (WASM Wasmtime)", engines.wasmtime)...)
+	allBatches = append(allBatches, workerPoolScenarios(engines)...)
+	allBatches = append(allBatches, sidecarScenarios(engines)...)
+	allBatches = append(allBatches, grpcScenarios(engines)...)
+	var variants []runtimeVariant
+	if matrix {
+		variants = newRuntimeVariants()
+		for _, v := range variants {
+			defer v.runner.Close()
+			all = append(all, v.scenarios()...)
+			allBatches = append(allBatches, ringScenarios(v.environment, v.runner)...)
+		}
+	}
+	scenarios := filterScenarios(all, filter)
+	batchScenarios := filterBatchScenarios(allBatches, filter)
+
 	// Step 2, run each one for N amount of logs and grab average throughput
 	// from throughput recorder
 
@@ -65,6 +417,24 @@ func generateBenchmarkTable() string {
 		log.Printf("Scenario %q %q finished with result: %s", scenario.environment, scenario.description, scenario.result)
 	}
 
+	batch := make([]string, ringBatchSize)
+	for i := range batch {
+		batch[i] = BenchmarkInput
+	}
+	for _, scenario := range batchScenarios {
+		throughputRecorder := throughputRecorder{}
+		outputFn := getBlackholeWriter(&throughputRecorder)
+
+		for i := 0; i < BenchmarkRuns; i += len(batch) {
+			for _, output := range scenario.runner(batch) {
+				outputFn(output)
+			}
+		}
+
+		scenario.result = throughputRecorder.AvgThroughput()
+		log.Printf("Scenario %q %q finished with result: %s", scenario.environment, scenario.description, scenario.result)
+	}
+
 	// Step 3, construct markdown table with this data
 	var b strings.Builder
 	fmt.Fprintf(&b, "| Execution Environment | Scenario | Result |\n")
@@ -72,6 +442,14 @@ func generateBenchmarkTable() string {
 	for _, scenario := range scenarios {
 		fmt.Fprintf(&b, "| %s | %s | %s |\n", scenario.environment, scenario.description, scenario.result)
 	}
+	for _, scenario := range batchScenarios {
+		fmt.Fprintf(&b, "| %s | %s | %s |\n", scenario.environment, scenario.description, scenario.result)
+	}
+	fmt.Fprintf(&b, "| Rust (WASM Wazero) | Startup | %s |\n", startupResult(engines.wazeroStartup))
+	fmt.Fprintf(&b, "| Rust (WASM Wasmtime) | Startup | %s |\n", startupResult(engines.wasmtimeStartup))
+	for _, v := range variants {
+		fmt.Fprintf(&b, "| %s | Startup | %s |\n", v.environment, startupResult(v.startup))
+	}
 
 	return b.String()
 }
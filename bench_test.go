@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"runtime"
+	"testing"
+
+	"go.uber.org/atomic"
+)
+
+// Run `./build.sh` first!
+//
+// Compare runs with benchstat:
+//
+//	go test -run '^$' -bench Scenarios -count 10 > old.txt
+//	go test -run '^$' -bench Scenarios -count 10 > new.txt
+//	benchstat old.txt new.txt
+
+func BenchmarkScenarios(b *testing.B) {
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	for _, scenario := range benchmarkScenarios(engines) {
+		scenario := scenario
+		b.Run(scenario.environment+"/"+scenario.description, func(b *testing.B) {
+			b.SetBytes(int64(len(BenchmarkInput)))
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				scenario.runner(BenchmarkInput)
+			}
+		})
+	}
+}
+
+func BenchmarkScenariosParallel(b *testing.B) {
+	// RunParallel starts GOMAXPROCS goroutines, and each of them needs its
+	// own wasm instances. The Rust worker pool is safe for concurrent use and
+	// already has a thread per CPU, so they share one.
+	workers := NewRustWorkerPool(runtime.NumCPU())
+	defer workers.Close()
+	pool := make([][]*Scenario, runtime.GOMAXPROCS(0))
+	for i := range pool {
+		engines := newBenchmarkEngines()
+		defer engines.Close()
+		engines.rustWorkers = workers
+		pool[i] = benchmarkScenarios(engines)
+	}
+
+	for i, scenario := range pool[0] {
+		i := i
+		b.Run(scenario.environment+"/"+scenario.description, func(b *testing.B) {
+			b.SetBytes(int64(len(BenchmarkInput)))
+			b.ReportAllocs()
+
+			var next atomic.Int32
+			b.RunParallel(func(pb *testing.PB) {
+				runner := pool[next.Inc()-1][i].runner
+				for pb.Next() {
+					runner(BenchmarkInput)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkRing streams records through the wasm ring buffers, the Rust
+// worker pool, the sidecar and the gRPC service, in batches of ringBatchSize.
+// Its ns/op is per record, like BenchmarkScenarios.
+func BenchmarkRing(b *testing.B) {
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	batch := make([]string, ringBatchSize)
+	for i := range batch {
+		batch[i] = BenchmarkInput
+	}
+	scenarios := append(ringScenarios("Rust (WASM Wazero)", engines.wazero),
+		ringScenarios("Rust (WASM Wasmtime)", engines.wasmtime)...)
+	scenarios = append(scenarios, workerPoolScenarios(engines)...)
+	scenarios = append(scenarios, sidecarScenarios(engines)...)
+	scenarios = append(scenarios, grpcScenarios(engines)...)
+	for _, scenario := range scenarios {
+		scenario := scenario
+		b.Run(scenario.environment+"/"+scenario.description, func(b *testing.B) {
+			b.SetBytes(int64(len(BenchmarkInput)))
+			b.ReportAllocs()
+			for n := 0; n < b.N; n += len(batch) {
+				if remaining := b.N - n; remaining < len(batch) {
+					scenario.runner(batch[:remaining])
+				} else {
+					scenario.runner(batch)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkStartup measures creating the wasm runners, which compile the
+// module, or load it from a RunnerOptions.CacheDir in a temporary directory.
+func BenchmarkStartup(b *testing.B) {
+	defer func(dir string) { runnerOptions.CacheDir = dir }(runnerOptions.CacheDir)
+
+	for _, cacheDir := range []string{"", b.TempDir()} {
+		runnerOptions.CacheDir = cacheDir
+		cache := "uncached"
+		if cacheDir != "" {
+			cache = "cached"
+		}
+		b.Run("Rust (WASM Wazero)/"+cache, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				NewWazeroRunner(context.Background(), compiledWasmBytes).Close()
+			}
+		})
+		b.Run("Rust (WASM Wasmtime)/"+cache, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				NewWasmtimeRunner(compiledWasmBytes).Close()
+			}
+		})
+	}
+}
+
+// BenchmarkRuntimeMatrix runs the wasm scenarios with every setting of
+// runtimeMatrix, see -runtime-matrix.
+func BenchmarkRuntimeMatrix(b *testing.B) {
+	for _, v := range newRuntimeVariants() {
+		defer v.runner.Close()
+		for _, scenario := range v.scenarios() {
+			scenario := scenario
+			b.Run(scenario.environment+"/"+scenario.description, func(b *testing.B) {
+				b.SetBytes(int64(len(BenchmarkInput)))
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					scenario.runner(BenchmarkInput)
+				}
+			})
+		}
+	}
+}
+
+func TestFilterScenarios(t *testing.T) {
+	scenarios := []*Scenario{
+		{"Rust (WASM Wazero)", "VRL Replace", nil, ""},
+		{"Rust (WASM Wasmtime)", "VRL Replace", nil, ""},
+		{"Rust (WASM Wazero)", "Regex Replace", nil, ""},
+	}
+	if got := filterScenarios(scenarios, nil); len(got) != len(scenarios) {
+		t.Errorf("got %d scenarios without a filter, want all %d", len(got), len(scenarios))
+	}
+	got := filterScenarios(scenarios, regexp.MustCompile(`Wazero.*VRL`))
+	if len(got) != 1 || got[0] != scenarios[0] {
+		t.Errorf("got %d scenarios, want only the first", len(got))
+	}
+}
@@ -1,17 +1,110 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/benthosdev/benthos/v4/public/bloblang"
 )
 
-func setupBloblang() *bloblang.Executor {
-	env := bloblang.NewEnvironment().WithoutFunctions("env", "file")
+// BloblangConfig controls the mapping the Bloblang engine runs.
+type BloblangConfig struct {
+	// Mapping is the Bloblang source. When empty, a mapping is generated from
+	// regexConfig.
+	Mapping string
+	// AllowFunctions removes every function not listed, when not empty.
+	AllowFunctions []string
+	// DenyFunctions removes the listed functions.
+	DenyFunctions []string
+}
 
-	mapping := `
-root = this.re_replace_all("\\b\\w{4}\\b", "gogo")
-`
+var bloblangConfig = BloblangConfig{
+	DenyFunctions: []string{"env", "file"},
+}
+
+// supportsRegexConfig reports whether cfg can run with the current
+// regexConfig. Generated mappings can only replace every match.
+func (cfg BloblangConfig) supportsRegexConfig() bool {
+	return cfg.Mapping != "" || regexConfig.Count <= 0
+}
+
+func bloblangEnvironment(cfg BloblangConfig) *bloblang.Environment {
+	env := bloblang.NewEnvironment()
+
+	if len(cfg.AllowFunctions) > 0 {
+		allowed := map[string]bool{}
+		for _, name := range cfg.AllowFunctions {
+			allowed[name] = true
+		}
+		var removed []string
+		env.WalkFunctions(func(name string, _ *bloblang.FunctionView) {
+			if !allowed[name] {
+				removed = append(removed, name)
+			}
+		})
+		env = env.WithoutFunctions(removed...)
+	}
+
+	return env.WithoutFunctions(cfg.DenyFunctions...)
+}
+
+func newBloblangExecutor(cfg BloblangConfig) (*bloblang.Executor, error) {
+	mapping := cfg.Mapping
+	if mapping == "" {
+		if !cfg.supportsRegexConfig() {
+			return nil, fmt.Errorf("bloblang cannot limit replacements to %d", regexConfig.Count)
+		}
+		// Bloblang string literals use Go quoting rules.
+		mapping = fmt.Sprintf(`
+root = this.re_replace_all(%s, %s)
+`, strconv.Quote(regexConfig.Pattern), strconv.Quote(regexConfig.Replacement))
+	}
+
+	return bloblangEnvironment(cfg).Parse(mapping)
+}
+
+// setBloblangConfig checks that cfg parses and makes it the configuration
+// used by setupBloblang. Parse errors include the line and column, prefixed
+// with filename.
+func setBloblangConfig(cfg BloblangConfig, filename string) error {
+	// Without -bloblang a generated mapping that can't honour -replace-count
+	// is simply left out of the benchmarks, so there is nothing to check.
+	if !cfg.supportsRegexConfig() {
+		bloblangConfig = cfg
+		return nil
+	}
+
+	if _, err := newBloblangExecutor(cfg); err != nil {
+		return bloblangFileError(filename, err)
+	}
+
+	bloblangConfig = cfg
+	return nil
+}
 
-	exe, err := env.Parse(mapping)
+// bloblangFileError prefixes err with filename, and the line and column for
+// parse errors.
+func bloblangFileError(filename string, err error) error {
+	var pErr *bloblang.ParseError
+	if errors.As(err, &pErr) {
+		// Keep the source excerpt that follows the first line of the
+		// multiline message, which repeats the position we print.
+		excerpt := pErr.ErrorMultiline()
+		if i := strings.Index(excerpt, "\n"); i >= 0 {
+			excerpt = excerpt[i:]
+		} else {
+			excerpt = ""
+		}
+		return fmt.Errorf("%s:%d:%d: %s%s", filename, pErr.Line, pErr.Column, strings.TrimSpace(pErr.Error()), excerpt)
+	}
+	return fmt.Errorf("%s: %w", filename, err)
+}
+
+func setupBloblang() *bloblang.Executor {
+	exe, err := newBloblangExecutor(bloblangConfig)
 	if err != nil {
 		panic(err)
 	}
@@ -19,11 +112,55 @@ root = this.re_replace_all("\\b\\w{4}\\b", "gogo")
 	return exe
 }
 
+// processStringBloblang is the Bloblang benchmark scenario, it panics when the
+// mapping fails. The pipeline uses queryBloblang, which returns the error.
 func processStringBloblang(exe *bloblang.Executor, text string) string {
 	res, err := exe.Query(text)
 	if err != nil {
 		panic(err)
 	}
 
-	return res.(string)
+	return bloblangResultString(res)
+}
+
+// queryBloblang runs exe on text, parsed as JSON when jsonDoc is set, and
+// returns the result like bloblangResultString.
+func queryBloblang(exe *bloblang.Executor, text string, jsonDoc bool) (string, error) {
+	var doc any = text
+	if jsonDoc {
+		var err error
+		if doc, err = decodeBloblangJson(text); err != nil {
+			return "", err
+		}
+	}
+
+	res, err := exe.Query(doc)
+	if err != nil {
+		return "", err
+	}
+	return bloblangResultString(res), nil
+}
+
+// decodeBloblangJson parses text the way Bloblang expects documents, with
+// numbers kept as json.Number.
+func decodeBloblangJson(text string) (any, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+
+	var doc any
+	err := decoder.Decode(&doc)
+	return doc, err
+}
+
+// bloblangResultString returns strings as-is and anything else as JSON.
+func bloblangResultString(res any) string {
+	if s, ok := res.(string); ok {
+		return s
+	}
+
+	out, err := json.Marshal(res)
+	if err != nil {
+		panic(err)
+	}
+	return string(out)
 }
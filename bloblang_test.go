@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBloblangParseError(t *testing.T) {
+	mapping := "root = this\nroot.foo = )\n"
+	err := setBloblangConfig(BloblangConfig{Mapping: mapping}, "test.blobl")
+	if err == nil {
+		t.Fatal("expected a parse error")
+	}
+	if !strings.HasPrefix(err.Error(), "test.blobl:2:12: expected query") {
+		t.Errorf("error %q does not start with the file name, line and column", err)
+	}
+}
+
+func TestBloblangJson(t *testing.T) {
+	exe, err := newBloblangExecutor(BloblangConfig{
+		Mapping: `root.message = this.message.uppercase()
+root.count = this.count + 1`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := queryBloblang(exe, `{"message":"abcd","count":41}`+"\n", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"count":42,"message":"ABCD"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestBloblangAllowFunctions(t *testing.T) {
+	cfg := BloblangConfig{
+		Mapping:        `root = now()`,
+		AllowFunctions: []string{"uuid_v4"},
+	}
+	if _, err := newBloblangExecutor(cfg); err == nil {
+		t.Error("expected now() to be removed by the allow list")
+	}
+
+	cfg.AllowFunctions = append(cfg.AllowFunctions, "now")
+	if _, err := newBloblangExecutor(cfg); err != nil {
+		t.Error(err)
+	}
+}
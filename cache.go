@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/tetratelabs/wazero"
+)
+
+// defaultWasmCacheDir is the directory -wasm-cache suggests.
+func defaultWasmCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "cgotest-wasm")
+}
+
+// moduleVersion returns the version of the Go module at path this binary was
+// built with.
+func moduleVersion(path string) string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == path {
+				return dep.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
+// newWazeroCache opens the compilation cache for options, or returns nil
+// when it is disabled. wazero keys its entries by module hash, its own version
+// and whether the code checks for timeouts, but a cache keeps the core
+// features of the first runtime that used it. Every set of options gets a
+// directory of its own.
+func newWazeroCache(options WazeroOptions) wazero.CompilationCache {
+	if options.CacheDir == "" || options.Interpreter {
+		return nil
+	}
+
+	dir := filepath.Join(options.CacheDir, "wazero", cacheName(options.String()))
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		log.Printf("Not caching compiled wasm: %v", err)
+		return nil
+	}
+	return cache
+}
+
+// newWasmtimeModule compiles wasmBytes, or loads the module compiled by an
+// earlier run. Entries are keyed by module hash, wasmtime-go version and the
+// engine options.
+func newWasmtimeModule(engine *wasmtime.Engine, wasmBytes []byte, options WasmtimeOptions) (*wasmtime.Module, error) {
+	if options.CacheDir == "" {
+		return wasmtime.NewModule(engine, wasmBytes)
+	}
+
+	name := fmt.Sprintf("%s-%x-%s", moduleVersion("github.com/bytecodealliance/wasmtime-go"),
+		sha256.Sum256(wasmBytes), cacheName(options.String()))
+	path := filepath.Join(options.CacheDir, "wasmtime", name)
+
+	if encoded, err := os.ReadFile(path); err == nil {
+		module, err := wasmtime.NewModuleDeserialize(engine, encoded)
+		if err == nil {
+			return module, nil
+		}
+		log.Printf("Compiling wasm again, the cached module is unusable: %v", err)
+	}
+
+	module, err := wasmtime.NewModule(engine, wasmBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCacheFile(module, path); err != nil {
+		log.Printf("Not caching compiled wasm: %v", err)
+	}
+	return module, nil
+}
+
+// cacheName turns the description of runtime options into a file name.
+func cacheName(options string) string {
+	return strings.NewReplacer(", ", "-", " ", "-").Replace(options)
+}
+
+// writeCacheFile serializes module to path. It writes a temporary file
+// first, so concurrent runs never read a partial module.
+func writeCacheFile(module *wasmtime.Module, path string) error {
+	encoded, err := module.Serialize()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
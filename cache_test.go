@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWasmCache(t *testing.T) {
+	options := RunnerOptions{CacheDir: t.TempDir()}
+
+	// The first runners fill the cache, the second ones load from it.
+	for i := 0; i < 2; i++ {
+		wazeroRunner := newWazeroRunner(context.Background(), compiledWasmBytes, WazeroOptions{RunnerOptions: options})
+		wasmtimeRunner := newWasmtimeRunner(compiledWasmBytes, WasmtimeOptions{RunnerOptions: options})
+
+		for name, run := range map[string]VrlFunc{
+			"Rust (WASM Wazero)":   wazeroRunner.runNoop,
+			"Rust (WASM Wasmtime)": wasmtimeRunner.runNoop,
+		} {
+			if got, err := run("hello"); err != nil || got != "hello" {
+				t.Errorf("%s: run %d: got %q, %v", name, i+1, got, err)
+			}
+		}
+		wazeroRunner.Close()
+		wasmtimeRunner.Close()
+	}
+
+	for _, runtime := range []string{"wazero", "wasmtime"} {
+		entries, err := os.ReadDir(filepath.Join(options.CacheDir, runtime))
+		if err != nil || len(entries) == 0 {
+			t.Errorf("%s: no cached modules: %v", runtime, err)
+		}
+	}
+}
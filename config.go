@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"gopkg.in/yaml.v3"
+)
+
+// engineFlags are the boolean flags that pick an engine. Go is used when
+// none is set.
+var engineFlags = []string{
+	"rust", "vrl", "nooprust", "noopgo",
+	"noopwazero", "wazero", "regexwazero",
+	"noopwasmtime", "wasmtime", "regexwasmtime",
+	"noopsidecar", "sidecar", "regexsidecar",
+	"bloblang",
+}
+
+// selectedEngine returns the name of the engine flag set in fs, or "go".
+func selectedEngine(fs *flag.FlagSet) string {
+	for _, name := range engineFlags {
+		if f := fs.Lookup(name); f != nil && f.Value.String() == "true" {
+			return name
+		}
+	}
+	return "go"
+}
+
+// PipelineConfig is the file given with -config. Every setting maps to a
+// flag, and flags given on the command line take precedence. Relative paths
+// are resolved from the directory of the config file.
+type PipelineConfig struct {
+	Source SourceConfig `yaml:"source"`
+	// Engine is "go" or the name of one of the engineFlags.
+	Engine    string        `yaml:"engine"`
+	Program   ProgramConfig `yaml:"program"`
+	Workers   int           `yaml:"workers"`
+	BatchSize int           `yaml:"batch_size"`
+	// CallTimeout bounds every wasm call, see -call-timeout.
+	CallTimeout time.Duration `yaml:"call_timeout"`
+	Memory      MemoryConfig  `yaml:"memory"`
+	Wasi        WasiYaml      `yaml:"wasi"`
+	Sink        SinkConfig    `yaml:"sink"`
+	Metrics     MetricsConfig `yaml:"metrics"`
+	Grpc        GrpcConfig    `yaml:"grpc"`
+
+	dir string
+}
+
+type SourceConfig struct {
+	// Type is "stdin", "uds", "tcp" or "file".
+	Type string `yaml:"type"`
+	// Address is the socket path for uds and host:port for tcp.
+	Address string `yaml:"address"`
+	Path    string `yaml:"path"`
+}
+
+type ProgramConfig struct {
+	// Wasm replaces the embedded wasm module, see -wasm.
+	Wasm string `yaml:"wasm"`
+	// WasmDynamicAllocation passes records in memory from the guest's
+	// allocator, see -wasm-dynamic-allocation.
+	WasmDynamicAllocation bool `yaml:"wasm_dynamic_allocation"`
+	// WasmRing streams batches through ring buffers, see -wasm-ring.
+	WasmRing bool `yaml:"wasm_ring"`
+	// FfiWorkers runs the Rust engines on a worker pool, see -ffi-workers.
+	FfiWorkers int `yaml:"ffi_workers"`
+	// SidecarBinary is what the sidecar engines run, see -sidecar-binary.
+	SidecarBinary string `yaml:"sidecar_binary"`
+	// EnrichmentTable is what guests look keys up in, see hostModule.
+	EnrichmentTable string `yaml:"enrichment_table"`
+
+	Pattern      string  `yaml:"pattern"`
+	Replacement  *string `yaml:"replacement"`
+	ReplaceCount int     `yaml:"replace_count"`
+
+	Vrl         string `yaml:"vrl"`
+	VrlEvents   bool   `yaml:"vrl_events"`
+	Ndjson      bool   `yaml:"ndjson"`
+	VrlMetadata string `yaml:"vrl_metadata"`
+	VrlSecrets  string `yaml:"vrl_secrets"`
+
+	Bloblang               string   `yaml:"bloblang"`
+	BloblangJson           bool     `yaml:"bloblang_json"`
+	BloblangAllowFunctions []string `yaml:"bloblang_allow_functions"`
+	BloblangDenyFunctions  []string `yaml:"bloblang_deny_functions"`
+
+	Programs     string `yaml:"programs"`
+	ReloadCorpus string `yaml:"reload_corpus"`
+}
+
+type SinkConfig struct {
+	// Type is "blackhole", "stdout" or "file".
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+}
+
+// MemoryConfig bounds the memory of wasm instances, see MemoryLimits.
+type MemoryConfig struct {
+	MaxPages     uint32 `yaml:"max_pages"`
+	RecycleCalls int    `yaml:"recycle_calls"`
+	// RecycleGrowth is a size such as 64MiB.
+	RecycleGrowth string `yaml:"recycle_growth"`
+}
+
+// WasiYaml is the WASI environment of wasm guests, see WasiConfig.
+type WasiYaml struct {
+	Env map[string]string `yaml:"env"`
+	Dir string            `yaml:"dir"`
+}
+
+type MetricsConfig struct {
+	// Interval between throughput reports, 0 disables them.
+	Interval *time.Duration `yaml:"interval"`
+}
+
+// GrpcConfig serves or calls the gRPC Transform service, see grpc.go.
+type GrpcConfig struct {
+	// Serve is the host:port to serve on, see -grpc-serve.
+	Serve string `yaml:"serve"`
+	// Client is the host:port of the service to send records to, see
+	// -grpc-client.
+	Client  string `yaml:"client"`
+	Program string `yaml:"program"`
+}
+
+// loadPipelineConfig reads and validates a config file. Unknown keys are
+// errors, so typos don't go unnoticed.
+func loadPipelineConfig(filename string) (*PipelineConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &PipelineConfig{dir: filepath.Dir(filename)}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	if problems := cfg.validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("%s:\n  %s", filename, strings.Join(problems, "\n  "))
+	}
+	return cfg, nil
+}
+
+// validate returns a description of every invalid setting, prefixed with its
+// key.
+func (cfg *PipelineConfig) validate() []string {
+	var problems []string
+	invalid := func(key, format string, a ...any) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, a...))
+	}
+	oneOf := func(key, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		invalid(key, "got %q, want one of %s", value, strings.Join(allowed, ", "))
+	}
+
+	if cfg.Source.Type != "" {
+		oneOf("source.type", cfg.Source.Type, "stdin", "uds", "tcp", "file")
+	}
+	switch cfg.Source.Type {
+	case "tcp":
+		if cfg.Source.Address == "" {
+			invalid("source.address", "required for a tcp source")
+		}
+	case "file":
+		if cfg.Source.Path == "" {
+			invalid("source.path", "required for a file source")
+		}
+	}
+
+	if cfg.Engine != "" {
+		oneOf("engine", cfg.Engine, append([]string{"go"}, engineFlags...)...)
+	}
+	if cfg.Program.ReplaceCount < 0 {
+		invalid("program.replace_count", "must not be negative, got %d", cfg.Program.ReplaceCount)
+	}
+
+	if cfg.Workers < 0 {
+		invalid("workers", "must be at least 1, got %d", cfg.Workers)
+	}
+	if cfg.BatchSize < 0 {
+		invalid("batch_size", "must be at least 1, got %d", cfg.BatchSize)
+	}
+
+	if cfg.CallTimeout < 0 {
+		invalid("call_timeout", "must not be negative, got %s", cfg.CallTimeout)
+	}
+
+	if cfg.Memory.MaxPages > 65536 {
+		invalid("memory.max_pages", "must be at most 65536, got %d", cfg.Memory.MaxPages)
+	}
+	if cfg.Memory.RecycleCalls < 0 {
+		invalid("memory.recycle_calls", "must not be negative, got %d", cfg.Memory.RecycleCalls)
+	}
+	if cfg.Memory.RecycleGrowth != "" {
+		if _, err := humanize.ParseBytes(cfg.Memory.RecycleGrowth); err != nil {
+			invalid("memory.recycle_growth", "%v", err)
+		}
+	}
+
+	for key, value := range cfg.Wasi.Env {
+		if key == "" || strings.ContainsAny(key, "=,") || strings.Contains(value, ",") {
+			invalid("wasi.env", "%q=%q: keys can't be empty or hold = or commas, values can't hold commas", key, value)
+		}
+	}
+
+	if cfg.Sink.Type != "" {
+		oneOf("sink.type", cfg.Sink.Type, "blackhole", "stdout", "file")
+	}
+	if cfg.Sink.Type == "file" && cfg.Sink.Path == "" {
+		invalid("sink.path", "required for a file sink")
+	}
+	if cfg.Metrics.Interval != nil && *cfg.Metrics.Interval < 0 {
+		invalid("metrics.interval", "must not be negative, got %s", *cfg.Metrics.Interval)
+	}
+	if cfg.Grpc.Serve != "" && cfg.Grpc.Client != "" {
+		invalid("grpc", "can't both serve and be a client")
+	}
+	if cfg.Grpc.Program != "" && cfg.Grpc.Client == "" {
+		invalid("grpc.program", "needs grpc.client")
+	}
+
+	return problems
+}
+
+// path resolves p relative to the config file.
+func (cfg *PipelineConfig) path(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(cfg.dir, p)
+}
+
+// flagValues returns the flag settings equivalent to cfg.
+func (cfg *PipelineConfig) flagValues() map[string]string {
+	values := map[string]string{}
+	set := func(name, value string) {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	setBool := func(name string, value bool) {
+		if value {
+			values[name] = "true"
+		}
+	}
+
+	switch cfg.Source.Type {
+	case "uds":
+		values["uds"] = "true"
+		set("uds-path", cfg.Source.Address)
+	case "tcp":
+		set("tcp", cfg.Source.Address)
+	case "file":
+		set("input", cfg.path(cfg.Source.Path))
+	}
+
+	if cfg.Engine != "" && cfg.Engine != "go" {
+		values[cfg.Engine] = "true"
+	}
+
+	p := cfg.Program
+	set("wasm", cfg.path(p.Wasm))
+	setBool("wasm-dynamic-allocation", p.WasmDynamicAllocation)
+	setBool("wasm-ring", p.WasmRing)
+	if p.FfiWorkers > 0 {
+		values["ffi-workers"] = strconv.Itoa(p.FfiWorkers)
+	}
+	set("sidecar-binary", cfg.path(p.SidecarBinary))
+	set("enrichment-table", cfg.path(p.EnrichmentTable))
+	set("pattern", p.Pattern)
+	if p.Replacement != nil {
+		values["replacement"] = *p.Replacement
+	}
+	if p.ReplaceCount > 0 {
+		values["replace-count"] = strconv.Itoa(p.ReplaceCount)
+	}
+	set("vrl-program", cfg.path(p.Vrl))
+	setBool("vrl-events", p.VrlEvents)
+	setBool("ndjson", p.Ndjson)
+	set("vrl-metadata", cfg.path(p.VrlMetadata))
+	set("vrl-secrets", cfg.path(p.VrlSecrets))
+	set("bloblang-mapping", cfg.path(p.Bloblang))
+	setBool("bloblang-json", p.BloblangJson)
+	if p.BloblangAllowFunctions != nil {
+		values["bloblang-allow-functions"] = strings.Join(p.BloblangAllowFunctions, ",")
+	}
+	if p.BloblangDenyFunctions != nil {
+		values["bloblang-deny-functions"] = strings.Join(p.BloblangDenyFunctions, ",")
+	}
+	set("programs", cfg.path(p.Programs))
+	set("reload-corpus", cfg.path(p.ReloadCorpus))
+
+	if cfg.Workers > 0 {
+		values["workers"] = strconv.Itoa(cfg.Workers)
+	}
+	if cfg.BatchSize > 0 {
+		values["batch-size"] = strconv.Itoa(cfg.BatchSize)
+	}
+	if cfg.CallTimeout > 0 {
+		values["call-timeout"] = cfg.CallTimeout.String()
+	}
+	if cfg.Memory.MaxPages > 0 {
+		values["max-memory-pages"] = strconv.Itoa(int(cfg.Memory.MaxPages))
+	}
+	if cfg.Memory.RecycleCalls > 0 {
+		values["recycle-calls"] = strconv.Itoa(cfg.Memory.RecycleCalls)
+	}
+	set("recycle-growth", cfg.Memory.RecycleGrowth)
+	if len(cfg.Wasi.Env) > 0 {
+		var env []string
+		for key, value := range cfg.Wasi.Env {
+			env = append(env, key+"="+value)
+		}
+		sort.Strings(env)
+		values["wasi-env"] = strings.Join(env, ",")
+	}
+	set("wasi-dir", cfg.path(cfg.Wasi.Dir))
+
+	switch cfg.Sink.Type {
+	case "stdout":
+		values["stdout"] = "true"
+	case "file":
+		set("output", cfg.path(cfg.Sink.Path))
+	}
+	if cfg.Metrics.Interval != nil {
+		values["metrics-interval"] = cfg.Metrics.Interval.String()
+	}
+	set("grpc-serve", cfg.Grpc.Serve)
+	set("grpc-client", cfg.Grpc.Client)
+	set("grpc-program", cfg.Grpc.Program)
+
+	return values
+}
+
+// exclusiveFlags are groups of flags that select one of several options.
+// Setting any flag of a group on the command line replaces the config file's
+// choice for the whole group.
+var exclusiveFlags = [][]string{
+	engineFlags,
+	{"uds", "tcp", "input"},
+	{"stdout", "output"},
+}
+
+// applyPipelineConfig sets the flags of fs from cfg, except for the ones
+// given on the command line, see exclusiveFlags.
+func applyPipelineConfig(fs *flag.FlagSet, cfg *PipelineConfig) error {
+	skip := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		skip[f.Name] = true
+	})
+	for _, group := range exclusiveFlags {
+		overridden := false
+		for _, name := range group {
+			overridden = overridden || skip[name]
+		}
+		for _, name := range group {
+			skip[name] = skip[name] || overridden
+		}
+	}
+
+	for name, value := range cfg.flagValues() {
+		if skip[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("-%s: %w", name, err)
+		}
+	}
+	return nil
+}
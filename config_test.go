@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "pipeline.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestPipelineConfig(t *testing.T) {
+	filename := writeConfig(t, `
+source:
+  type: tcp
+  address: localhost:9000
+engine: wazero
+program:
+  vrl: programs/redact.vrl
+  replacement: ""
+workers: 4
+batch_size: 64
+sink:
+  type: stdout
+metrics:
+  interval: 5s
+`)
+	cfg, err := loadPipelineConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	wazero := fs.Bool("wazero", false, "")
+	wasmtime := fs.Bool("wasmtime", false, "")
+	tcp := fs.String("tcp", "", "")
+	vrl := fs.String("vrl-program", "", "")
+	replacement := fs.String("replacement", "xxxx", "")
+	workers := fs.Int("workers", 1, "")
+	batchSize := fs.Int("batch-size", 1, "")
+	stdout := fs.Bool("stdout", false, "")
+	fs.String("output", "", "")
+	metrics := fs.Duration("metrics-interval", 0, "")
+
+	// Flags on the command line win, and an engine flag replaces the
+	// config's engine.
+	if err := fs.Parse([]string{"-workers", "2", "-wasmtime"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyPipelineConfig(fs, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if *wazero || !*wasmtime {
+		t.Errorf("got -wazero=%v -wasmtime=%v, want only -wasmtime", *wazero, *wasmtime)
+	}
+	if *workers != 2 || *batchSize != 64 {
+		t.Errorf("got -workers=%d -batch-size=%d, want 2 and 64", *workers, *batchSize)
+	}
+	if want := filepath.Join(filepath.Dir(filename), "programs/redact.vrl"); *vrl != want {
+		t.Errorf("got -vrl-program=%s, want %s", *vrl, want)
+	}
+	if *tcp != "localhost:9000" || *replacement != "" || !*stdout || metrics.String() != "5s" {
+		t.Errorf("got -tcp=%s -replacement=%q -stdout=%v -metrics-interval=%s", *tcp, *replacement, *stdout, metrics)
+	}
+}
+
+func TestPipelineConfigValidation(t *testing.T) {
+	filename := writeConfig(t, `
+source:
+  type: kafka
+engine: python
+workers: -1
+memory:
+  recycle_growth: lots
+sink:
+  type: file
+`)
+	_, err := loadPipelineConfig(filename)
+	if err == nil {
+		t.Fatal("got no error for an invalid config")
+	}
+	for _, key := range []string{"source.type", "engine", "workers", "memory.recycle_growth", "sink.path"} {
+		if !strings.Contains(err.Error(), key+":") {
+			t.Errorf("error does not mention %s:\n%v", key, err)
+		}
+	}
+
+	filename = writeConfig(t, "enigne: rust\n")
+	if _, err := loadPipelineConfig(filename); err == nil || !strings.Contains(err.Error(), "enigne") {
+		t.Errorf("got %v, want an error for the unknown key", err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+// Run `./build.sh` first!
+
+type conformanceCase struct {
+	name     string
+	input    string
+	replaced string // expected output of the "Regex Replace" and "VRL Replace" scenarios
+}
+
+var conformanceCases = []conformanceCase{
+	{"empty", "", ""},
+	{"single word", "abcd", "xxxx"},
+	{"every match", "abcd efgh ijkl", "xxxx xxxx xxxx"},
+	{"wrong lengths", "abc abcde", "abc abcde"},
+	{"digits and underscores", "ab_1 12345 a2c4", "xxxx 12345 xxxx"},
+	{"punctuation boundaries", "(abcd),efgh.", "(xxxx),xxxx."},
+	{"quotes and backslashes", `"quo" back\slash`, `"quo" xxxx\slash`},
+	{"non-ascii is not a word character", "naïve wörd abcd", "naïve wörd xxxx"},
+	{"log line", "Oct 17 14:33:33 | XSS | ERROR | sed quia odio", "Oct 17 14:33:33 | XSS | ERROR | sed xxxx xxxx"},
+}
+
+// expectedOutput returns what every engine should produce for the scenario.
+func (c conformanceCase) expectedOutput(description string) string {
+	if strings.HasPrefix(description, "String Copy") {
+		return c.input
+	}
+	if description == "Host Call Enrich" {
+		return enrichGo(c.input)
+	}
+	return c.replaced
+}
+
+func TestConformance(t *testing.T) {
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	for _, scenario := range benchmarkScenarios(engines) {
+		scenario := scenario
+		t.Run(scenario.environment+"/"+scenario.description, func(t *testing.T) {
+			for _, c := range conformanceCases {
+				if got, want := scenario.runner(c.input), c.expectedOutput(scenario.description); got != want {
+					t.Errorf("%s: got %q, want %q", c.name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConformanceRegexConfig(t *testing.T) {
+	cfg := RegexConfig{Pattern: `(\w+)@example\.com`, Replacement: "$1@redacted", Count: 1}
+	if err := setRegexConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := setRegexConfig(defaultRegexConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	input := "from alice@example.com to bob@example.com"
+	want := "from alice@redacted to bob@example.com"
+	for _, scenario := range benchmarkScenarios(engines) {
+		if strings.HasPrefix(scenario.description, "String Copy") || scenario.description == "Host Call Enrich" {
+			continue
+		}
+		if got := scenario.runner(input); got != want {
+			t.Errorf("%s %s: got %q, want %q", scenario.environment, scenario.description, got, want)
+		}
+	}
+}
+
+// TestConformanceEnrichLongValue looks up values longer than the guest's
+// first lookup buffer of 256 bytes, which it looks up again.
+func TestConformanceEnrichLongValue(t *testing.T) {
+	defer func(table map[string]string) { enrichmentTable = table }(enrichmentTable)
+	enrichmentTable = map[string]string{
+		"LONG":  strings.Repeat("v", 1000),
+		"WIDE":  strings.Repeat("é", 200),
+		"SHORT": "s",
+	}
+
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	for _, scenario := range benchmarkScenarios(engines) {
+		if scenario.description != "Host Call Enrich" {
+			continue
+		}
+		for _, key := range []string{"LONG", "WIDE", "SHORT", "MISSING"} {
+			input := "Oct 17 | " + key + " | x"
+			if got, want := scenario.runner(input), enrichGo(input); got != want {
+				t.Errorf("%s %s: got %d bytes, want %d", scenario.environment, key, len(got), len(want))
+			}
+		}
+	}
+}
+
+// TestConformanceDynamicAllocation passes records much bigger than the
+// fixed buffer, which makes the guest grow its memory during the calls.
+func TestConformanceDynamicAllocation(t *testing.T) {
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	input := strings.Repeat(BenchmarkInput+" ", 4096)
+	for _, scenario := range benchmarkScenarios(engines) {
+		if !strings.HasSuffix(scenario.description, "(Dynamic Allocation)") {
+			continue
+		}
+		want := processStringGo(input)
+		if strings.HasPrefix(scenario.description, "String Copy") {
+			want = input
+		}
+		for i := 0; i < 3; i++ {
+			if got := scenario.runner(input); got != want {
+				t.Errorf("%s %s: got %d bytes, want %d", scenario.environment, scenario.description, len(got), len(want))
+			}
+		}
+	}
+}
+
+// TestConformanceRing streams every case at once through the wasm ring
+// buffers, many times over so the rings wrap around.
+func TestConformanceRing(t *testing.T) {
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	var records []conformanceCase
+	for i := 0; i < 200; i++ {
+		records = append(records, conformanceCases...)
+	}
+	inputs := make([]string, len(records))
+	for i, c := range records {
+		inputs[i] = c.input
+	}
+
+	scenarios := append(ringScenarios("Rust (WASM Wazero)", engines.wazero),
+		ringScenarios("Rust (WASM Wasmtime)", engines.wasmtime)...)
+	for _, scenario := range scenarios {
+		outputs := scenario.runner(inputs)
+		if len(outputs) != len(records) {
+			t.Fatalf("%s %s: got %d outputs, want %d", scenario.environment, scenario.description, len(outputs), len(records))
+		}
+		for i, c := range records {
+			if got, want := outputs[i], c.expectedOutput(scenario.description); got != want {
+				t.Errorf("%s %s %s: got %q, want %q", scenario.environment, scenario.description, c.name, got, want)
+				break
+			}
+		}
+	}
+}
+
+// TestConformanceWorkerPool streams every case through the Rust worker pool
+// from several goroutines at once, with more records in flight than it has
+// jobs.
+func TestConformanceWorkerPool(t *testing.T) {
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	var records []conformanceCase
+	for i := 0; i < 100; i++ {
+		records = append(records, conformanceCases...)
+	}
+	inputs := make([]string, len(records))
+	for i, c := range records {
+		inputs[i] = c.input
+	}
+
+	// Start the pool before the goroutines share it.
+	engines.workerPool()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, scenario := range workerPoolScenarios(engines) {
+				outputs := scenario.runner(inputs)
+				for i, c := range records {
+					if got, want := outputs[i], c.expectedOutput(scenario.description); got != want {
+						t.Errorf("%s %s %s: got %q, want %q", scenario.environment, scenario.description, c.name, got, want)
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var errs []error
+	engines.workerPool().runBatch([]string{"abcd", strings.Repeat("a", rustWorkerRecordCapacity+1), "abcd"}, ringRegex, func(output string, err error) {
+		errs = append(errs, err)
+	})
+	if len(errs) != 3 || errs[0] != nil || errs[1] != errWorkerRecordTooBig || errs[2] != nil {
+		t.Errorf("got errors %v, want only the second record to be too big", errs)
+	}
+}
+
+// TestWorkerPoolPanic submits a transform the workers don't know, which
+// panics. The job fails and its worker goes on with the next one.
+func TestWorkerPoolPanic(t *testing.T) {
+	pool := NewRustWorkerPool(1)
+	defer pool.Close()
+
+	if _, err := pool.run("abcd", ringVrl+1); err != errWorkerPanicked {
+		t.Errorf("got %v, want %v", err, errWorkerPanicked)
+	}
+	if got, err := pool.runRegex("abcd"); err != nil || got != "xxxx" {
+		t.Errorf("got %q, %v after a panic, want %q", got, err, "xxxx")
+	}
+}
+
+// FuzzConformance checks that every engine agrees with Go on arbitrary input.
+func FuzzConformance(f *testing.F) {
+	for _, c := range conformanceCases {
+		f.Add(c.input)
+	}
+	f.Add(BenchmarkInput)
+
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+	scenarios := benchmarkScenarios(engines)
+
+	f.Fuzz(func(t *testing.T, input string) {
+		// C strings end at the first NUL and the wasm runners use a fixed
+		// size buffer, so neither can be compared on such input.
+		event, _ := json.Marshal(map[string]string{"message": input})
+		if !utf8.ValidString(input) || strings.ContainsRune(input, 0) || len(event) > bufSize {
+			t.Skip()
+		}
+
+		// Go is the reference: every other engine must agree with it.
+		want := map[string]string{
+			"String Copy":                        input,
+			"String Copy (Dynamic Allocation)":   input,
+			"Regex Replace":                      processStringGo(input),
+			"Regex Replace (Dynamic Allocation)": processStringGo(input),
+			"VRL Replace":                        processStringGo(input),
+			"VRL Replace (Dynamic Allocation)":   processStringGo(input),
+			"VRL Event Replace":                  processStringGo(input),
+			"Host Call Enrich":                   enrichGo(input),
+		}
+		for _, scenario := range scenarios {
+			if got := scenario.runner(input); got != want[scenario.description] {
+				t.Errorf("%s %s: got %q, want %q", scenario.environment, scenario.description, got, want[scenario.description])
+			}
+		}
+	})
+}
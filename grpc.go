@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// transformServiceName is the gRPC service that runs records through the
+// engines, with the methods:
+//
+//	rpc TransformOne(TransformRecord) returns (TransformRecord);
+//	rpc TransformBatch(TransformBatch) returns (TransformBatch);
+//	rpc Transform(stream TransformRecord) returns (stream TransformRecord);
+//
+// The messages are those of transform.proto, in the protobuf wire format, see
+// protoCodec, or as JSON, see jsonCodec. A request picks the engine by the
+// name of its flag, such as "rust" or "wasmtime", see grpcEngines, or a
+// program of the server's -programs directory, which runs on its own engine.
+// The server's engine is used when neither is set. Records that fail return
+// their error in the response, the RPC only fails when the engine or program
+// doesn't exist. The standard health service reports the service as serving.
+const transformServiceName = "cgotest.Transform"
+
+// TransformRecord is a record to transform, or the result. Engine and Program
+// are only read in requests, Error is only set in responses.
+type TransformRecord struct {
+	Engine  string `json:"engine,omitempty"`
+	Program string `json:"program,omitempty"`
+	Data    string `json:"data"`
+	Error   string `json:"error,omitempty"`
+}
+
+// TransformBatch is many records for the same engine or program.
+type TransformBatch struct {
+	Engine  string            `json:"engine,omitempty"`
+	Program string            `json:"program,omitempty"`
+	Records []TransformRecord `json:"records"`
+}
+
+// jsonCodec encodes the messages of transformServiceName as JSON, the proto3
+// JSON mapping of transform.proto, for clients without generated code.
+// Clients select it with the "json" content-subtype, application/grpc+json,
+// while the health service keeps using protobuf.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// protoCodec encodes the messages of transformServiceName in the protobuf
+// wire format of transform.proto, for clients generated from it, and leaves
+// every other message, such as the health service's, to grpc's codec.
+type protoCodec struct {
+	encoding.Codec
+}
+
+func (c protoCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *TransformRecord:
+		return m.appendProto(nil), nil
+	case *TransformBatch:
+		return m.appendProto(nil), nil
+	}
+	return c.Codec.Marshal(v)
+}
+
+func (c protoCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *TransformRecord:
+		return m.unmarshalProto(data)
+	case *TransformBatch:
+		return m.unmarshalProto(data)
+	}
+	return c.Codec.Unmarshal(data, v)
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+	encoding.RegisterCodec(protoCodec{encoding.GetCodec("proto")})
+}
+
+func (r *TransformRecord) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, r.Engine)
+	b = appendProtoString(b, 2, r.Program)
+	b = appendProtoString(b, 3, r.Data)
+	return appendProtoString(b, 4, r.Error)
+}
+
+func (r *TransformRecord) unmarshalProto(data []byte) error {
+	*r = TransformRecord{}
+	return rangeProtoFields(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			r.Engine = string(value)
+		case 2:
+			r.Program = string(value)
+		case 3:
+			r.Data = string(value)
+		case 4:
+			r.Error = string(value)
+		}
+		return nil
+	})
+}
+
+func (batch *TransformBatch) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, batch.Engine)
+	b = appendProtoString(b, 2, batch.Program)
+	for i := range batch.Records {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, batch.Records[i].appendProto(nil))
+	}
+	return b
+}
+
+func (batch *TransformBatch) unmarshalProto(data []byte) error {
+	*batch = TransformBatch{}
+	return rangeProtoFields(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			batch.Engine = string(value)
+		case 2:
+			batch.Program = string(value)
+		case 3:
+			var record TransformRecord
+			if err := record.unmarshalProto(value); err != nil {
+				return err
+			}
+			batch.Records = append(batch.Records, record)
+		}
+		return nil
+	})
+}
+
+// appendProtoString appends a string field, which proto3 leaves out when it
+// is empty.
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// rangeProtoFields calls f with every length-delimited field of a message,
+// which are all the fields of transform.proto, and skips any other.
+func rangeProtoFields(data []byte, f func(num protowire.Number, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, data); n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := f(num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transformFunc runs a record on the engines of w.
+type transformFunc func(w *pipelineWorker, record string) (string, error)
+
+// grpcEngines are the engines the service runs, by the name of their flag.
+var grpcEngines = map[string]transformFunc{
+	"go": func(_ *pipelineWorker, record string) (string, error) {
+		return processStringGo(record), nil
+	},
+	"noopgo": func(_ *pipelineWorker, record string) (string, error) {
+		return simpleStringGo(record), nil
+	},
+	"rust": func(_ *pipelineWorker, record string) (string, error) {
+		return processStringRs(record), nil
+	},
+	"nooprust": func(_ *pipelineWorker, record string) (string, error) {
+		return noopStringRs(record), nil
+	},
+	"vrl": func(_ *pipelineWorker, record string) (string, error) {
+		return processStringVrl(record)
+	},
+	"noopwazero": func(w *pipelineWorker, record string) (string, error) {
+		return fitBuffer(record, w.wazero.runNoop, w.wazero.runNoopDynamicAllocation)
+	},
+	"regexwazero": func(w *pipelineWorker, record string) (string, error) {
+		return fitBuffer(record, w.wazero.runRegex, w.wazero.runRegexDynamicAllocation)
+	},
+	"wazero": func(w *pipelineWorker, record string) (string, error) {
+		return fitBuffer(record, w.wazero.runVrl, w.wazero.runVrlDynamicAllocation)
+	},
+	"noopwasmtime": func(w *pipelineWorker, record string) (string, error) {
+		return fitBuffer(record, w.wasmtime.runNoop, w.wasmtime.runNoopDynamicAllocation)
+	},
+	"regexwasmtime": func(w *pipelineWorker, record string) (string, error) {
+		return fitBuffer(record, w.wasmtime.runRegex, w.wasmtime.runRegexDynamicAllocation)
+	},
+	"wasmtime": func(w *pipelineWorker, record string) (string, error) {
+		return fitBuffer(record, w.wasmtime.runVrl, w.wasmtime.runVrlDynamicAllocation)
+	},
+	"bloblang": func(w *pipelineWorker, record string) (string, error) {
+		if w.exe == nil {
+			// Only the mapping of -bloblang-mapping can, see setupBloblang.
+			return "", fmt.Errorf("bloblang cannot limit replacements to %d", regexConfig.Count)
+		}
+		return queryBloblang(w.exe, record, false)
+	},
+}
+
+// fitBuffer runs a record that fits the wasm runners' buffer with buffered,
+// and a bigger one with dynamic, which takes its memory from the guest's
+// allocator. Clients send records of any size.
+func fitBuffer(record string, buffered, dynamic VrlFunc) (string, error) {
+	if len(record) > bufSize {
+		return dynamic(record)
+	}
+	return buffered(record)
+}
+
+// transformService is what transformServiceDesc calls, implemented by
+// TransformServer.
+type transformService interface {
+	transformOne(in *TransformRecord) (*TransformRecord, error)
+	transformBatch(in *TransformBatch) (*TransformBatch, error)
+	transform(stream grpc.ServerStream) error
+}
+
+var transformServiceDesc = grpc.ServiceDesc{
+	ServiceName: transformServiceName,
+	HandlerType: (*transformService)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "TransformOne",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				in := &TransformRecord{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				handler := func(_ context.Context, in any) (any, error) {
+					return srv.(transformService).transformOne(in.(*TransformRecord))
+				}
+				if interceptor == nil {
+					return handler(ctx, in)
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + transformServiceName + "/TransformOne"}, handler)
+			},
+		},
+		{
+			MethodName: "TransformBatch",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				in := &TransformBatch{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				handler := func(_ context.Context, in any) (any, error) {
+					return srv.(transformService).transformBatch(in.(*TransformBatch))
+				}
+				if interceptor == nil {
+					return handler(ctx, in)
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + transformServiceName + "/TransformBatch"}, handler)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Transform",
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				return srv.(transformService).transform(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+// TransformServer serves transformServiceName with a pool of workers, each
+// with its own wasm runners and Bloblang executor.
+type TransformServer struct {
+	engine   string
+	registry *ProgramRegistry
+	workers  chan *pipelineWorker
+	health   *health.Server
+	server   *grpc.Server
+}
+
+// NewTransformServer creates a server running requests without an engine or
+// program on engine, and programs from registry, which may be nil.
+func NewTransformServer(engine string, workers int, registry *ProgramRegistry) *TransformServer {
+	if _, ok := grpcEngines[engine]; !ok {
+		log.Panicf("The gRPC service doesn't support the %s engine", engine)
+	}
+
+	s := &TransformServer{
+		engine:   engine,
+		registry: registry,
+		workers:  make(chan *pipelineWorker, workers),
+		health:   health.NewServer(),
+		server:   grpc.NewServer(),
+	}
+	for i := 0; i < workers; i++ {
+		w := &pipelineWorker{
+			wazero:   NewWazeroRunner(context.Background(), compiledWasmBytes),
+			wasmtime: NewWasmtimeRunner(compiledWasmBytes),
+		}
+		if bloblangConfig.supportsRegexConfig() {
+			w.exe = setupBloblang()
+		}
+		s.workers <- w
+	}
+
+	s.server.RegisterService(&transformServiceDesc, s)
+	healthpb.RegisterHealthServer(s.server, s.health)
+	s.health.SetServingStatus(transformServiceName, healthpb.HealthCheckResponse_SERVING)
+	return s
+}
+
+// Serve accepts connections on listener until Stop.
+func (s *TransformServer) Serve(listener net.Listener) error {
+	return s.server.Serve(listener)
+}
+
+// Stop reports the service as not serving, waits for the RPCs in flight and
+// releases the workers.
+func (s *TransformServer) Stop() {
+	s.health.Shutdown()
+	s.server.GracefulStop()
+	for i := 0; i < cap(s.workers); i++ {
+		(<-s.workers).Close()
+	}
+}
+
+// transformFunc returns how to run the records of a request.
+func (s *TransformServer) transformFunc(engine, program string) (transformFunc, error) {
+	if program != "" {
+		if s.registry == nil {
+			return nil, status.Errorf(codes.NotFound, "program %q: the server has no -programs", program)
+		}
+		p, ok := s.registry.programs[program]
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "unknown program %q", program)
+		}
+		return func(_ *pipelineWorker, record string) (string, error) {
+			return p.Run(record)
+		}, nil
+	}
+
+	if engine == "" {
+		engine = s.engine
+	}
+	run, ok := grpcEngines[engine]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown engine %q", engine)
+	}
+	return run, nil
+}
+
+// runRecords runs every record on one worker and sets its output or error.
+func (s *TransformServer) runRecords(run transformFunc, records []TransformRecord) {
+	w := <-s.workers
+	defer func() { s.workers <- w }()
+
+	for i := range records {
+		out, err := run(w, records[i].Data)
+		records[i] = TransformRecord{Data: out}
+		if err != nil {
+			records[i].Error = err.Error()
+		}
+	}
+}
+
+func (s *TransformServer) transformOne(in *TransformRecord) (*TransformRecord, error) {
+	run, err := s.transformFunc(in.Engine, in.Program)
+	if err != nil {
+		return nil, err
+	}
+	records := []TransformRecord{*in}
+	s.runRecords(run, records)
+	return &records[0], nil
+}
+
+func (s *TransformServer) transformBatch(in *TransformBatch) (*TransformBatch, error) {
+	run, err := s.transformFunc(in.Engine, in.Program)
+	if err != nil {
+		return nil, err
+	}
+	s.runRecords(run, in.Records)
+	return &TransformBatch{Records: in.Records}, nil
+}
+
+// transform answers every record of the stream in order.
+func (s *TransformServer) transform(stream grpc.ServerStream) error {
+	for {
+		in := &TransformRecord{}
+		if err := stream.RecvMsg(in); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		out, err := s.transformOne(in)
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(out); err != nil {
+			return err
+		}
+	}
+}
+
+// serveGrpc serves transformServiceName on address until SIGINT or SIGTERM.
+func serveGrpc(address, engine string, workers int, programsDir string) {
+	var registry *ProgramRegistry
+	if programsDir != "" {
+		var err error
+		if registry, err = loadProgramRegistry(programsDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, ok := grpcEngines[engine]; !ok {
+		log.Fatalf("-grpc-serve doesn't support the %s engine", engine)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := NewTransformServer(engine, workers, registry)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		log.Print("Shutting down, finishing the RPCs in flight...")
+		s.Stop()
+		close(stopped)
+	}()
+
+	log.Printf("Serving %s on %s with %d workers, engine %s", transformServiceName, listener.Addr(), workers, engine)
+	if err := s.Serve(listener); err != nil {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// TransformClient calls transformServiceName.
+type TransformClient struct {
+	conn *grpc.ClientConn
+}
+
+// DialTransformService connects to the service at address, and checks that
+// it is serving.
+func DialTransformService(address string) (*TransformClient, error) {
+	conn, err := grpc.Dial(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name())))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{Service: transformServiceName})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %w", address, err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %s is %s", address, transformServiceName, res.Status)
+	}
+	return &TransformClient{conn: conn}, nil
+}
+
+func (c *TransformClient) Close() {
+	c.conn.Close()
+}
+
+// recordResult returns the output or the error of a response.
+func recordResult(out *TransformRecord) (string, error) {
+	if out.Error != "" {
+		return "", fmt.Errorf("%s: %s", transformServiceName, out.Error)
+	}
+	return out.Data, nil
+}
+
+// run transforms record with TransformOne.
+func (c *TransformClient) run(engine, program, record string) (string, error) {
+	in := &TransformRecord{Engine: engine, Program: program, Data: record}
+	out := &TransformRecord{}
+	if err := c.conn.Invoke(context.Background(), "/"+transformServiceName+"/TransformOne", in, out); err != nil {
+		return "", err
+	}
+	return recordResult(out)
+}
+
+// runner returns a VrlFunc running records on engine.
+func (c *TransformClient) runner(engine string) VrlFunc {
+	return func(record string) (string, error) {
+		return c.run(engine, "", record)
+	}
+}
+
+// runBatch transforms records with a single TransformBatch, and emits the
+// results in order. When the RPC fails, every record is emitted with its
+// error.
+func (c *TransformClient) runBatch(engine, program string, records []string, emit func(string, error)) {
+	in := &TransformBatch{Engine: engine, Program: program, Records: make([]TransformRecord, len(records))}
+	for i, record := range records {
+		in.Records[i].Data = record
+	}
+	out := &TransformBatch{}
+	err := c.conn.Invoke(context.Background(), "/"+transformServiceName+"/TransformBatch", in, out)
+	if err == nil && len(out.Records) != len(records) {
+		err = fmt.Errorf("%s: got %d records for %d", transformServiceName, len(out.Records), len(records))
+	}
+	if err != nil {
+		for range records {
+			emit("", err)
+		}
+		return
+	}
+	for i := range out.Records {
+		emit(recordResult(&out.Records[i]))
+	}
+}
+
+// runStream transforms records on one Transform stream, sending while it
+// receives, and emits the results in order.
+func (c *TransformClient) runStream(engine, program string, records []string, emit func(string, error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := c.conn.NewStream(ctx, &transformServiceDesc.Streams[0], "/"+transformServiceName+"/Transform")
+	if err == nil {
+		go func() {
+			for _, record := range records {
+				if stream.SendMsg(&TransformRecord{Engine: engine, Program: program, Data: record}) != nil {
+					// RecvMsg returns the error.
+					return
+				}
+			}
+			stream.CloseSend()
+		}()
+	}
+
+	for range records {
+		if err != nil {
+			emit("", err)
+			continue
+		}
+		out := &TransformRecord{}
+		if err = stream.RecvMsg(out); err != nil {
+			emit("", err)
+			continue
+		}
+		emit(recordResult(out))
+	}
+}
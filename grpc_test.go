@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// startTransformService serves registry on 127.0.0.1 and returns a client.
+func startTransformService(t *testing.T, registry *ProgramRegistry) *TransformClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewTransformServer("go", 2, registry)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	client, err := DialTransformService(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestTransformService(t *testing.T) {
+	client := startTransformService(t, nil)
+
+	for _, engine := range []string{"", "go", "rust", "vrl", "regexwazero", "wasmtime", "bloblang"} {
+		if got, err := client.run(engine, "", "abcd efghi"); got != "xxxx efghi" || err != nil {
+			t.Errorf("%q: got %q, %v, want %q", engine, got, err, "xxxx efghi")
+		}
+	}
+
+	// Records bigger than the wasm buffer take the dynamic allocation path.
+	big := strings.Repeat("abcd ", bufSize)
+	for _, engine := range []string{"regexwazero", "wazero", "regexwasmtime", "wasmtime"} {
+		if got, err := client.run(engine, "", big); err != nil || got != strings.Repeat("xxxx ", bufSize) {
+			t.Errorf("%q: got %d bytes, %v for a record of %d bytes", engine, len(got), err, len(big))
+		}
+	}
+
+	records := []string{"abcd", "efghi", "ab cdef"}
+	want := []string{"xxxx", "efghi", "ab xxxx"}
+	for name, run := range map[string]func(string, string, []string, func(string, error)){
+		"batch":  client.runBatch,
+		"stream": client.runStream,
+	} {
+		var got []string
+		run("rust", "", records, func(output string, err error) {
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			got = append(got, output)
+		})
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %q, want %q", name, got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: got %q, want %q", name, got, want)
+				break
+			}
+		}
+	}
+
+	if _, err := client.run("python", "", "abcd"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument for an unknown engine", err)
+	}
+	if _, err := client.run("", "redact", "abcd"); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v, want NotFound without -programs", err)
+	}
+}
+
+func TestTransformServicePrograms(t *testing.T) {
+	dir := t.TempDir()
+	program := `{"pattern": "\\d{4}", "replacement": "****"}`
+	if err := os.WriteFile(filepath.Join(dir, "redact.regex"), []byte(program), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := loadProgramRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := startTransformService(t, registry)
+
+	// The program wins over the engine.
+	if got, err := client.run("rust", "redact", "card 1234"); got != "card ****" || err != nil {
+		t.Errorf("got %q, %v, want %q", got, err, "card ****")
+	}
+	if _, err := client.run("", "upper", "abcd"); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v, want NotFound for an unknown program", err)
+	}
+}
+
+func TestTransformServiceHealth(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewTransformServer("go", 1, nil)
+	go server.Serve(listener)
+
+	client, err := DialTransformService(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server.Stop()
+	// DialTransformService checked it was serving, Stop closes the connection.
+	if _, err := healthpb.NewHealthClient(client.conn).Check(context.Background(), &healthpb.HealthCheckRequest{Service: transformServiceName}); err == nil {
+		t.Error("the service still answers after Stop")
+	}
+}
+
+// Clients generated from transform.proto use the protobuf wire format.
+func TestTransformServiceProto(t *testing.T) {
+	client := startTransformService(t, nil)
+	conn, err := grpc.Dial(client.conn.Target(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	in := &TransformBatch{Engine: "rust", Records: []TransformRecord{{Data: "abcd"}, {Data: ""}, {Data: "ab cdef"}}}
+	out := &TransformBatch{}
+	if err := conn.Invoke(context.Background(), "/"+transformServiceName+"/TransformBatch", in, out); err != nil {
+		t.Fatal(err)
+	}
+	want := []TransformRecord{{Data: "xxxx"}, {}, {Data: "ab xxxx"}}
+	if len(out.Records) != len(want) {
+		t.Fatalf("got %+v, want %+v", out.Records, want)
+	}
+	for i := range want {
+		if out.Records[i] != want[i] {
+			t.Errorf("record %d: got %+v, want %+v", i, out.Records[i], want[i])
+		}
+	}
+
+	one := &TransformRecord{}
+	err = conn.Invoke(context.Background(), "/"+transformServiceName+"/TransformOne", &TransformRecord{Engine: "python", Data: "abcd"}, one)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument for an unknown engine", err)
+	}
+}
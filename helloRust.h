@@ -1,4 +1,52 @@
+#include <stdint.h>
 
 char* transform(char* str);
 char* noop(char* str);
-char* transform_vrl(char* str);
+
+// Exactly one of output and error is set. error is a runtime error as JSON.
+typedef struct {
+    char* output;
+    char* error;
+} VrlResult;
+
+VrlResult transform_vrl(char* str);
+VrlResult transform_vrl_event(char* str);
+VrlResult transform_vrl_target(char* str);
+char* configure(char* pattern, char* replacement, unsigned int count);
+char* compile(char* source);
+char* compile_named(char* name, char* source);
+VrlResult transform_vrl_named(char* name, char* str);
+VrlResult transform_vrl_event_named(char* name, char* str);
+
+// The worker pool of workers.rs, fed by workerpool.go.
+typedef struct {
+    uint32_t seq;
+    uint32_t job;
+} WorkerQueueCell;
+
+// A record for a worker. output_len has bit 31 set for a VRL runtime error,
+// is 0xFFFFFFFF when the output didn't fit and 0xFFFFFFFE when the transform
+// panicked.
+typedef struct {
+    uint32_t done;
+    uint32_t transform;
+    uint32_t input_len;
+    uint32_t output_len;
+    unsigned char* input;
+    unsigned char* output;
+} WorkerJob;
+
+typedef struct {
+    uint32_t head;
+    uint8_t pad0[60];
+    uint32_t tail;
+    uint8_t pad1[60];
+    uint32_t shutdown;
+    uint32_t capacity;
+    uint32_t record_capacity;
+    WorkerQueueCell* cells;
+    WorkerJob* jobs;
+} WorkerQueue;
+
+WorkerQueue* worker_pool_start(unsigned int threads, unsigned int capacity, unsigned int record_capacity);
+void worker_pool_stop(WorkerQueue* queue);
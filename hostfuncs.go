@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// hostModule is the import module of the functions the host provides to
+// wasm guests, in addition to WASI. Guests may import any of them:
+//
+//   - log(level i32, ptr i32, len i32): logs the message at ptr, prefixed
+//     with the guest's instance. level is one of hostLogLevels.
+//   - metric(name_ptr i32, name_len i32, value f64): records a value of the
+//     named metric, reported with the throughput, see guestMetrics.
+//   - kv_lookup(key_ptr i32, key_len i32, value_ptr i32, value_cap i32) -> i32:
+//     looks the key up in enrichmentTable, writes at most value_cap bytes of
+//     its value at value_ptr and returns the value's full length, or -1 when
+//     the key is missing.
+//   - now() -> i64: the current time in nanoseconds since the Unix epoch.
+//
+// A pointer outside the guest's memory fails the call.
+const hostModule = "host"
+
+var hostLogLevels = []string{"debug", "info", "warn", "error"}
+
+// enrichmentTable is what kv_lookup looks keys up in. Set with
+// -enrichment-table before the runners are created.
+var enrichmentTable = map[string]string{
+	"XSS":  "cross-site scripting",
+	"SQLI": "sql injection",
+	"CSRF": "cross-site request forgery",
+}
+
+// hostFunctions implements hostModule for the guests of one runner.
+type hostFunctions struct {
+	instance string
+}
+
+// guestSlice returns size bytes of memory at ptr, or an error when they are
+// out of range. The host functions fail the guest's call with it.
+func guestSlice(memory []byte, ptr, size uint32) ([]byte, error) {
+	if uint64(ptr)+uint64(size) > uint64(len(memory)) {
+		return nil, fmt.Errorf("%s: [%d, %d) out of range of memory size %d", hostModule, ptr, uint64(ptr)+uint64(size), len(memory))
+	}
+	return memory[ptr : ptr+size], nil
+}
+
+func (h hostFunctions) log(memory []byte, level, ptr, size uint32) error {
+	message, err := guestSlice(memory, ptr, size)
+	if err != nil {
+		return err
+	}
+	name := "unknown"
+	if int(level) < len(hostLogLevels) {
+		name = hostLogLevels[level]
+	}
+	log.Printf("%s %s: %s", h.instance, name, message)
+	return nil
+}
+
+func (h hostFunctions) metric(memory []byte, namePtr, nameSize uint32, value float64) error {
+	name, err := guestSlice(memory, namePtr, nameSize)
+	if err != nil {
+		return err
+	}
+	guestMetrics.record(string(name), value)
+	return nil
+}
+
+func (h hostFunctions) kvLookup(memory []byte, keyPtr, keySize, valuePtr, valueCap uint32) (int32, error) {
+	key, err := guestSlice(memory, keyPtr, keySize)
+	if err != nil {
+		return 0, err
+	}
+	buf, err := guestSlice(memory, valuePtr, valueCap)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := enrichmentTable[string(key)]
+	if !ok {
+		return -1, nil
+	}
+	copy(buf, value)
+	return int32(len(value)), nil
+}
+
+func hostNow() int64 {
+	return time.Now().UnixNano()
+}
+
+// instantiateWazeroHost provides hostModule to the guests of r.
+func instantiateWazeroHost(ctx context.Context, r wazero.Runtime, h hostFunctions) error {
+	// Read returns a view of the memory, so kv_lookup can write to it.
+	memory := func(m api.Module) []byte {
+		buf, _ := m.Memory().Read(0, m.Memory().Size())
+		return buf
+	}
+
+	// wazero fails the guest's call with what a host function panics with.
+	check := func(err error) {
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	_, err := r.NewHostModuleBuilder(hostModule).
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, level, ptr, size uint32) {
+			check(h.log(memory(m), level, ptr, size))
+		}).
+		Export("log").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, namePtr, nameSize uint32, value float64) {
+			check(h.metric(memory(m), namePtr, nameSize, value))
+		}).
+		Export("metric").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, keyPtr, keySize, valuePtr, valueCap uint32) int32 {
+			length, err := h.kvLookup(memory(m), keyPtr, keySize, valuePtr, valueCap)
+			check(err)
+			return length
+		}).
+		Export("kv_lookup").
+		NewFunctionBuilder().
+		WithFunc(hostNow).
+		Export("now").
+		Instantiate(ctx)
+	return err
+}
+
+// defineWasmtimeHost provides hostModule to the guests linked by linker.
+func defineWasmtimeHost(linker *wasmtime.Linker, h hostFunctions) error {
+	memory := func(caller *wasmtime.Caller) []byte {
+		return caller.GetExport("memory").Memory().UnsafeData(caller)
+	}
+	// wasmtime-go panics again once the call returns when a host function
+	// panics, so they fail the guest's call with a trap.
+	trap := func(err error) *wasmtime.Trap {
+		if err != nil {
+			return wasmtime.NewTrap(err.Error())
+		}
+		return nil
+	}
+
+	if err := linker.FuncWrap(hostModule, "log", func(caller *wasmtime.Caller, level, ptr, size int32) *wasmtime.Trap {
+		return trap(h.log(memory(caller), uint32(level), uint32(ptr), uint32(size)))
+	}); err != nil {
+		return err
+	}
+	if err := linker.FuncWrap(hostModule, "metric", func(caller *wasmtime.Caller, namePtr, nameSize int32, value float64) *wasmtime.Trap {
+		return trap(h.metric(memory(caller), uint32(namePtr), uint32(nameSize), value))
+	}); err != nil {
+		return err
+	}
+	if err := linker.FuncWrap(hostModule, "kv_lookup", func(caller *wasmtime.Caller, keyPtr, keySize, valuePtr, valueCap int32) (int32, *wasmtime.Trap) {
+		length, err := h.kvLookup(memory(caller), uint32(keyPtr), uint32(keySize), uint32(valuePtr), uint32(valueCap))
+		return length, trap(err)
+	}); err != nil {
+		return err
+	}
+	return linker.FuncWrap(hostModule, "now", hostNow)
+}
+
+// metricValues aggregates the values of one guest metric.
+type metricValues struct {
+	count    int64
+	sum      float64
+	min, max float64
+}
+
+// guestMetrics holds what guests record with the metric host function.
+var guestMetrics = &metricRegistry{metrics: map[string]*metricValues{}}
+
+type metricRegistry struct {
+	mu      sync.Mutex
+	metrics map[string]*metricValues
+}
+
+func (r *metricRegistry) record(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.metrics[name]
+	if !ok {
+		m = &metricValues{min: value, max: value}
+		r.metrics[name] = m
+	}
+	m.count++
+	m.sum += value
+	if value < m.min {
+		m.min = value
+	}
+	if value > m.max {
+		m.max = value
+	}
+}
+
+// Summary reports every metric, one line each, or an empty string when
+// guests recorded none.
+func (r *metricRegistry) Summary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		m := r.metrics[name]
+		fmt.Fprintf(&b, "Guest metric %s: %d values, mean %.4g, min %.4g, max %.4g\n",
+			name, m.count, m.sum/float64(m.count), m.min, m.max)
+	}
+	return b.String()
+}
+
+// enrichGo is the Go version of the guest's enrich_wasm export: it looks the
+// second " | " separated field of line up in enrichmentTable and appends its
+// value, timing the lookup like the guest does.
+func enrichGo(line string) string {
+	fields := strings.SplitN(line, " | ", 3)
+	if len(fields) < 2 {
+		return line
+	}
+
+	start := hostNow()
+	value, ok := enrichmentTable[fields[1]]
+	guestMetrics.record("enrich_lookup_ns", float64(hostNow()-start))
+	if !ok {
+		value = "unknown"
+	}
+	return line + " | " + value
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/tetratelabs/wazero"
+)
+
+func TestHostKvLookup(t *testing.T) {
+	h := hostFunctions{instance: "test 1"}
+	memory := make([]byte, 64)
+	copy(memory, "XSS")
+
+	if got, err := h.kvLookup(memory, 0, 3, 16, 8); err != nil || got != int32(len("cross-site scripting")) {
+		t.Errorf("got length %d, %v, want %d", got, err, len("cross-site scripting"))
+	}
+	if got, want := string(memory[16:26]), "cross-si\x00\x00"; got != want {
+		t.Errorf("got value %q, want %q cut at the capacity", got, want)
+	}
+	if got, err := h.kvLookup(memory, 0, 2, 16, 8); err != nil || got != -1 {
+		t.Errorf("got %d, %v for a missing key, want -1", got, err)
+	}
+	if _, err := h.kvLookup(memory, 0, 3, 60, 8); err == nil {
+		t.Error("got no error for a value outside memory")
+	}
+}
+
+func TestGuestSliceOutOfRange(t *testing.T) {
+	if _, err := guestSlice(make([]byte, 16), 10, 8); err == nil {
+		t.Error("got no error for a range outside memory")
+	}
+	if got, err := guestSlice(make([]byte, 16), 8, 8); err != nil || len(got) != 8 {
+		t.Errorf("got %d bytes, %v for the end of memory, want 8", len(got), err)
+	}
+}
+
+// badLogWasm exports bad, which logs 16 bytes past the end of its memory:
+//
+//	(module
+//	  (import "host" "log" (func $log (param i32 i32 i32)))
+//	  (memory (export "memory") 1)
+//	  (func (export "bad") (call $log (i32.const 0) (i32.const 65536) (i32.const 16))))
+var badLogWasm = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	0x01, 0x0a, 0x02, 0x60, 0x03, 0x7f, 0x7f, 0x7f, 0x00, 0x60, 0x00, 0x00, // types
+	0x02, 0x0c, 0x01, 0x04, 'h', 'o', 's', 't', 0x03, 'l', 'o', 'g', 0x00, 0x00, // import host.log
+	0x03, 0x02, 0x01, 0x01, // func 1 has type 1
+	0x05, 0x03, 0x01, 0x00, 0x01, // one page of memory
+	0x07, 0x10, 0x02, 0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00, 0x03, 'b', 'a', 'd', 0x00, 0x01, // exports
+	0x0a, 0x0e, 0x01, 0x0c, 0x00, 0x41, 0x00, 0x41, 0x80, 0x80, 0x04, 0x41, 0x10, 0x10, 0x00, 0x0b, // code
+}
+
+// A guest passing a pointer outside its memory fails its call, on both
+// runtimes, instead of panicking in the host.
+func TestHostFunctionOutOfRange(t *testing.T) {
+	h := hostFunctions{instance: "test 1"}
+
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	if err := instantiateWazeroHost(ctx, r, h); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := r.Instantiate(ctx, badLogWasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mod.ExportedFunction("bad").Call(ctx); err == nil {
+		t.Error("wazero: got no error for a pointer outside memory")
+	}
+
+	engine := wasmtime.NewEngine()
+	linker := wasmtime.NewLinker(engine)
+	if err := defineWasmtimeHost(linker, h); err != nil {
+		t.Fatal(err)
+	}
+	module, err := wasmtime.NewModule(engine, badLogWasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := wasmtime.NewStore(engine)
+	instance, err := linker.Instantiate(store, module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.GetFunc(store, "bad").Call(store); err == nil {
+		t.Error("wasmtime: got no error for a pointer outside memory")
+	}
+}
+
+func TestEnrichBufferOverflow(t *testing.T) {
+	wazeroRunner := NewWazeroRunner(context.Background(), compiledWasmBytes)
+	defer wazeroRunner.Close()
+	wasmtimeRunner := NewWasmtimeRunner(compiledWasmBytes)
+	defer wasmtimeRunner.Close()
+
+	// The line fills the buffer, so the appended value doesn't fit.
+	line := "Oct 17 | XSS | " + strings.Repeat("x", bufSize-len("Oct 17 | XSS | "))
+	for name, run := range map[string]VrlFunc{
+		"Rust (WASM Wazero)":   wazeroRunner.runEnrich,
+		"Rust (WASM Wasmtime)": wasmtimeRunner.runEnrich,
+	} {
+		_, err := run(line)
+		var overflowErr *BufferOverflowError
+		if !errors.As(err, &overflowErr) {
+			t.Errorf("%s: got %v, want a *BufferOverflowError", name, err)
+		}
+		if got, err := run("Oct 17 | XSS"); err != nil || got != "Oct 17 | XSS | cross-site scripting" {
+			t.Errorf("%s: got %q, %v after an overflow", name, got, err)
+		}
+	}
+}
+
+func TestMetricRegistry(t *testing.T) {
+	r := &metricRegistry{metrics: map[string]*metricValues{}}
+	if got := r.Summary(); got != "" {
+		t.Errorf("got %q without metrics, want nothing", got)
+	}
+	r.record("b", 3)
+	r.record("a", 1)
+	r.record("a", 5)
+
+	want := "Guest metric a: 2 values, mean 3, min 1, max 5\n" +
+		"Guest metric b: 1 values, mean 3, min 3, max 3\n"
+	if got := r.Summary(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEnrichGo(t *testing.T) {
+	for input, want := range map[string]string{
+		"":                          "",
+		"no fields":                 "no fields",
+		"Oct 17 | XSS | ERROR":      "Oct 17 | XSS | ERROR | cross-site scripting",
+		"Oct 17 | NOPE":             "Oct 17 | NOPE | unknown",
+		"Oct 17 | SQLI | a | b | c": "Oct 17 | SQLI | a | b | c | sql injection",
+	} {
+		if got := enrichGo(input); got != want {
+			t.Errorf("enrichGo(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
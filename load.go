@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// LoadConfig describes an open-loop ramp: records are offered at a fixed
+// rate regardless of how fast the engine keeps up, and the rate is raised
+// step by step until the engine saturates.
+type LoadConfig struct {
+	StartRate    float64       // records per second for the first step
+	MaxRate      float64       // stop ramping once this rate is reached
+	RampFactor   float64       // each step offers RampFactor times the previous rate
+	StepDuration time.Duration // how long each rate is held
+	MaxLatency   time.Duration // p99 latency above this counts as saturated
+	Target       uint64        // bytes per second we need to sustain, used for the cores estimate
+}
+
+type loadStep struct {
+	rate     float64
+	achieved float64
+	p99      time.Duration
+	backlog  int
+	dropped  int
+}
+
+func (s loadStep) saturated(cfg LoadConfig) bool {
+	// A backlog of more than a tenth of a second of records at the end of a
+	// step means the queue is growing faster than the engine drains it.
+	return s.dropped > 0 ||
+		s.backlog > int(s.rate/10) ||
+		s.p99 > cfg.MaxLatency ||
+		s.achieved < s.rate*0.95
+}
+
+// maxLoadPrealloc bounds what runLoadStep allocates up front for the queue
+// and the latencies, as -load-max-rate times the step can be huge.
+const maxLoadPrealloc = 1 << 20
+
+// runLoadStep offers records to runner at rate for the given duration.
+// Latency is measured from the time each record was scheduled to be sent,
+// not when it was dequeued, so queueing delay is included.
+func runLoadStep(runner StringInStringOut, input string, rate float64, duration time.Duration) loadStep {
+	// Allow up to one second of backlog before we start dropping, but no
+	// more than maxLoadPrealloc records, which is long saturated anyway.
+	queue := make(chan time.Time, int(math.Max(math.Min(rate, maxLoadPrealloc), 1)))
+	latencies := make([]time.Duration, 0, int(math.Min(rate*duration.Seconds(), maxLoadPrealloc)))
+	done := make(chan struct{})
+
+	start := time.Now()
+	end := start.Add(duration)
+	completedInStep := 0
+
+	go func() {
+		for scheduled := range queue {
+			runner(input)
+			now := time.Now()
+			latencies = append(latencies, now.Sub(scheduled))
+			if now.Before(end) {
+				completedInStep++
+			}
+		}
+		close(done)
+	}()
+
+	interval := float64(time.Second) / rate
+	dropped := 0
+	for i := 0; ; i++ {
+		scheduled := start.Add(time.Duration(float64(i) * interval))
+		if !scheduled.Before(end) {
+			break
+		}
+		// Sleep when we are ahead of schedule, otherwise send immediately
+		// so a slow sender doesn't hide a slow engine.
+		if wait := time.Until(scheduled); wait > time.Millisecond {
+			time.Sleep(wait)
+		}
+		select {
+		case queue <- scheduled:
+		default:
+			dropped++
+		}
+	}
+
+	backlog := len(queue)
+	close(queue)
+	<-done
+
+	return loadStep{
+		rate:     rate,
+		achieved: float64(completedInStep) / duration.Seconds(),
+		p99:      percentile(latencies, 0.99),
+		backlog:  backlog,
+		dropped:  dropped,
+	}
+}
+
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[int(float64(len(latencies)-1)*p)]
+}
+
+type loadResult struct {
+	scenario  *Scenario
+	sustained loadStep
+}
+
+// rampScenario raises the offered rate until the engine saturates and
+// returns the last step it sustained.
+func rampScenario(scenario *Scenario, input string, cfg LoadConfig) loadStep {
+	var sustained loadStep
+	for rate := cfg.StartRate; rate <= cfg.MaxRate; rate *= cfg.RampFactor {
+		step := runLoadStep(scenario.runner, input, rate, cfg.StepDuration)
+		log.Printf("Scenario %q %q offered %.0f/s achieved %.0f/s p99 %s backlog %d dropped %d",
+			scenario.environment, scenario.description, step.rate, step.achieved, step.p99, step.backlog, step.dropped)
+		if step.saturated(cfg) {
+			break
+		}
+		sustained = step
+	}
+	return sustained
+}
+
+func generateLoadTable(cfg LoadConfig, filter *regexp.Regexp) string {
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	scenarios := filterScenarios(benchmarkScenarios(engines), filter)
+
+	var results []loadResult
+	for _, scenario := range scenarios {
+		results = append(results, loadResult{scenario, rampScenario(scenario, BenchmarkInput, cfg)})
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "| Execution Environment | Scenario | Max Sustained Rate | Throughput | p99 Latency | Cores for %s / second |\n", humanize.Bytes(cfg.Target))
+	fmt.Fprintf(&b, "| --------------------- | -------- | ------------------ | ---------- | ----------- | --------------------- |\n")
+	for _, result := range results {
+		bytesPerSecond := result.sustained.rate * float64(len(BenchmarkInput))
+		cores := "-"
+		if bytesPerSecond > 0 {
+			cores = fmt.Sprint(math.Ceil(float64(cfg.Target) / bytesPerSecond))
+		}
+		fmt.Fprintf(&b, "| %s | %s | %.0f records / second | %s / second | %s | %s |\n",
+			result.scenario.environment, result.scenario.description,
+			result.sustained.rate, humanize.Bytes(uint64(bytesPerSecond)), result.sustained.p99, cores)
+	}
+
+	return b.String()
+}
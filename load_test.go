@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadStepSaturated(t *testing.T) {
+	cfg := LoadConfig{MaxLatency: 10 * time.Millisecond}
+	sustained := loadStep{rate: 1000, achieved: 990, p99: time.Millisecond, backlog: 100}
+	tests := []struct {
+		name string
+		step loadStep
+		want bool
+	}{
+		{"sustained", sustained, false},
+		{"dropped", loadStep{rate: 1000, achieved: 1000, dropped: 1}, true},
+		{"backlog", loadStep{rate: 1000, achieved: 1000, backlog: 101}, true},
+		{"latency", loadStep{rate: 1000, achieved: 1000, p99: 11 * time.Millisecond}, true},
+		{"achieved", loadStep{rate: 1000, achieved: 949}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.step.saturated(cfg); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	if got := percentile(nil, 0.99); got != 0 {
+		t.Errorf("got %s for no latencies, want 0", got)
+	}
+
+	var latencies []time.Duration
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, time.Millisecond},
+		{0.5, 50 * time.Millisecond},
+		{0.99, 99 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := percentile(latencies, tt.p); got != tt.want {
+			t.Errorf("p%v: got %s, want %s", tt.p*100, got, tt.want)
+		}
+	}
+}
@@ -15,18 +15,22 @@ import (
 	"bufio"
 	"context"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 
-	"github.com/benthosdev/benthos/v4/public/bloblang"
 	"github.com/dustin/go-humanize"
 	"go.uber.org/atomic"
 )
@@ -37,14 +41,28 @@ const (
 	bufSize      = 2048
 )
 
-func getUdsReader() *bufio.Reader {
-	if _, err := os.Stat(sockAddr); err == nil {
-		if err := os.RemoveAll(sockAddr); err != nil {
+// getUdsReader waits for a single connection on the socket at path. The
+// returned function closes it and removes the socket file.
+func getUdsReader(path string) (*bufio.Reader, func()) {
+	if _, err := os.Stat(path); err == nil {
+		if err := os.RemoveAll(path); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	listener, err := net.Listen("unix", sockAddr)
+	reader, closeConn := getListenerReader("unix", path)
+	return reader, func() {
+		closeConn()
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Print(err)
+		}
+	}
+}
+
+// getListenerReader waits for a single connection on address. The returned
+// function closes the connection and the listener.
+func getListenerReader(network, address string) (*bufio.Reader, func()) {
+	listener, err := net.Listen(network, address)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -57,25 +75,34 @@ func getUdsReader() *bufio.Reader {
 
 	log.Print("Accepted connection from ", conn.RemoteAddr().Network())
 
-	return bufio.NewReader(conn)
+	return bufio.NewReader(conn), func() {
+		conn.Close()
+		listener.Close()
+	}
 }
 
+// throughputRecorder is safe for concurrent use, as every worker records its
+// output while the metrics are reported.
 type throughputRecorder struct {
-	start      time.Time
+	// start is when the first output was recorded, in Unix nanoseconds, or 0.
+	start      atomic.Int64
 	totalBytes atomic.Float64
 }
 
 func (tr *throughputRecorder) Record(nBytes int) {
-	if time.Time.IsZero(tr.start) {
-		tr.start = time.Now()
+	if tr.start.Load() == 0 {
+		tr.start.CompareAndSwap(0, time.Now().UnixNano())
 	}
 	tr.totalBytes.Add(float64(nBytes))
 }
 
-func (tr *throughputRecorder) AvgThroughput() string {
-	now := time.Now()
+// Started reports whether any output was recorded.
+func (tr *throughputRecorder) Started() bool {
+	return tr.start.Load() != 0
+}
 
-	elapsed := now.Sub(tr.start)
+func (tr *throughputRecorder) AvgThroughput() string {
+	elapsed := time.Since(time.Unix(0, tr.start.Load()))
 	avgBytes := uint64(tr.totalBytes.Load() / elapsed.Seconds())
 	return fmt.Sprintf("%s / second", humanize.Bytes(avgBytes))
 }
@@ -92,6 +119,41 @@ func getBlackholeWriter(tr *throughputRecorder) func(a ...any) (int, error) {
 	return blackhole
 }
 
+// fileSink writes output lines to a file through a buffer, which Close
+// flushes.
+type fileSink struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+	tr *throughputRecorder
+}
+
+func newFileSink(filename string, tr *throughputRecorder) (*fileSink, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{f: f, w: bufio.NewWriter(f), tr: tr}, nil
+}
+
+func (fs *fileSink) Println(a ...any) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := fmt.Fprintln(fs.w, a...)
+	fs.tr.Record(n)
+	return n, err
+}
+
+func (fs *fileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.w.Flush(); err != nil {
+		fs.f.Close()
+		return err
+	}
+	return fs.f.Close()
+}
+
 type OutFunc func(a ...any) (int, error)
 
 // rustWasm was compiled using `cargo build --release --target wasm32-wasi`
@@ -111,96 +173,584 @@ func main() {
 	useWasmtimeNoop := flag.Bool("noopwasmtime", false, "use no-op wasm via wasmtime runtime")
 	useWasmtime := flag.Bool("wasmtime", false, "use vrl running inside wasmtime")
 	useWasmtimeRegex := flag.Bool("regexwasmtime", false, "use raw regex running inside wasmtime")
+	useSidecarNoop := flag.Bool("noopsidecar", false, "use no-op rust running in a sidecar process")
+	useSidecar := flag.Bool("sidecar", false, "use vrl running in a sidecar process")
+	useSidecarRegex := flag.Bool("regexsidecar", false, "use raw regex running in a sidecar process")
 	useBloblang := flag.Bool("bloblang", false, "use bloblang")
 
+	// regex
+	pattern := flag.String("pattern", defaultRegexConfig.Pattern, "Go regexp syntax pattern used by every regex and VRL engine")
+	replacement := flag.String("replacement", defaultRegexConfig.Replacement, "Replacement for each match, $1 expands to the first submatch")
+	replaceCount := flag.Int("replace-count", defaultRegexConfig.Count, "Replace at most this many matches, 0 replaces all of them")
+
+	// vrl
+	vrlProgramFile := flag.String("vrl-program", "", "Run the VRL program in this file instead of the regex replacement")
+	vrlEvents := flag.Bool("vrl-events", false, "Run VRL (-vrl, -wazero, -wasmtime) on structured JSON events instead of raw strings")
+	ndjson := flag.Bool("ndjson", false, "With -vrl-events, each input line is a JSON object rather than a raw message")
+	vrlMetadataFile := flag.String("vrl-metadata", "", "With -vrl-events, JSON file with the metadata every event starts with. Output includes the resulting metadata")
+	vrlSecretsFile := flag.String("vrl-secrets", "", "With -vrl-events, JSON file of secrets available to get_secret. Output includes the resulting metadata")
+
+	// bloblang
+	bloblangMappingFile := flag.String("bloblang-mapping", "", "Run the Bloblang mapping in this file instead of the regex replacement")
+	bloblangJson := flag.Bool("bloblang-json", false, "Parse each input line as JSON and query the mapping with the document instead of the raw string")
+	bloblangAllow := flag.String("bloblang-allow-functions", "", "Comma separated Bloblang functions to allow, every other function is removed")
+	bloblangDeny := flag.String("bloblang-deny-functions", strings.Join(bloblangConfig.DenyFunctions, ","), "Comma separated Bloblang functions to remove")
+
+	// hot reload
+	reloadCorpus := flag.String("reload-corpus", "", "On SIGHUP, reload -vrl-program and -bloblang-mapping only if every line of this file runs through them without error")
+
+	// program registry
+	programsDir := flag.String("programs", "", "Load named .vrl, .blobl and .regex programs from this directory and route each record to one of them with its routes.json")
+	grpcServe := flag.String("grpc-serve", "", "Serve the engines and -programs as a gRPC Transform service on this host:port instead of running a pipeline")
+	grpcClient := flag.String("grpc-client", "", "Send each batch of -batch-size records to the gRPC Transform service on this host:port, which runs them on the selected engine")
+	grpcProgram := flag.String("grpc-program", "", "With -grpc-client, run the service's program of this name instead of an engine")
+
+	// pipeline
+	configFile := flag.String("config", "", "YAML pipeline config file, flags given on the command line override its settings")
+	workers := flag.Int("workers", 1, "Number of workers processing records, each with its own engines")
+	batchSize := flag.Int("batch-size", 1, "Number of records handed to a worker at a time")
+	wasiEnv := flag.String("wasi-env", "", "Comma separated KEY=VALUE environment variables of the wasm guests")
+	flag.StringVar(&runnerOptions.Wasi.Dir, "wasi-dir", "", "Directory the wasm guests can read as /, e.g. for lookup tables")
+	dynamicAllocation := flag.Bool("wasm-dynamic-allocation", false, "Pass records to -noopwazero, -regexwazero, -wazero and the wasmtime equivalents in memory from the guest's allocator instead of a fixed buffer, so they can be any size")
+	wasmRing := flag.Bool("wasm-ring", false, "Stream each batch of -batch-size records through ring buffers in the memory of -noopwazero, -regexwazero, -wazero or the wasmtime equivalents, with as few calls as fit")
+	ffiWorkers := flag.Int("ffi-workers", 0, "Run -rust, -nooprust and -vrl on this many persistent Rust threads fed through a lock-free queue instead of calling into Rust for every record, 0 disables it")
+	flag.StringVar(&sidecarBinary, "sidecar-binary", sidecarBinary, "helloRustBinary run by -noopsidecar, -regexsidecar and -sidecar")
+	enrichmentTableFile := flag.String("enrichment-table", "", "JSON object of strings the wasm guests look keys up in with the kv_lookup host function")
+	wasmFile := flag.String("wasm", "", "Run this wasm module instead of the embedded one, see the guest ABI in abi.go")
+	flag.StringVar(&runnerOptions.CacheDir, "wasm-cache", runnerOptions.CacheDir, fmt.Sprintf("Directory caching compiled wasm modules, such as %s. Empty disables it", defaultWasmCacheDir()))
+	callTimeoutFlag := flag.Duration("call-timeout", 0, "Abort wasm calls running longer than this, dropping the record and replacing the instance. 0 disables it")
+	maxMemoryPages := flag.Uint("max-memory-pages", 0, "Maximum number of 64KiB pages of wasm guest memory, 0 means no limit")
+	recycleCalls := flag.Int("recycle-calls", 0, "Replace wasm instances after this many calls, 0 disables it")
+	recycleGrowth := flag.String("recycle-growth", "0", "Replace wasm instances once their memory grew by this much, e.g. 64MiB. 0 disables it")
+	metricsInterval := flag.Duration("metrics-interval", time.Second, "How often throughput is reported, 0 disables it. Not reported with -stdout")
+
 	// misc
 	stdout := flag.Bool("stdout", false, "Output to stdout")
+	outputFile := flag.String("output", "", "Write output lines to this file")
 	useUds := flag.Bool("uds", false, "accept data from UDS")
+	udsPath := flag.String("uds-path", sockAddr, "Socket path for -uds")
+	tcpAddr := flag.String("tcp", "", "accept data from a TCP connection on this host:port")
+	input := flag.String("input", "", "read data from this file")
 	benchmarkTable := flag.Bool("benchmarktable", false, "Generate benchmark table by running all interesting combinations and emitting a markdown table")
+	runtimeMatrixFlag := flag.Bool("runtime-matrix", false, "Also run the wasm benchmark scenarios with other wazero and wasmtime settings, such as the interpreter")
+	flag.BoolVar(&wazeroOptions.Interpreter, "wazero-interpreter", false, "Interpret wasm with wazero instead of compiling it")
+	wazeroFeatures := flag.String("wazero-features", "", "WebAssembly core features wazero enables: 1.0 or 2.0. Defaults to 2.0")
+	flag.StringVar(&wasmtimeOptions.OptLevel, "wasmtime-opt-level", "", "Cranelift optimization level: none, speed or speed_and_size. Defaults to speed")
+	flag.BoolVar(&wasmtimeOptions.EpochInterruption, "wasmtime-epoch", false, "Enable wasmtime epoch interruption even without -call-timeout")
+	flag.BoolVar(&wasmtimeOptions.ConsumeFuel, "wasmtime-fuel", false, "Enable wasmtime fuel metering")
+	scenarioFilterFlag := flag.String("scenario-filter", "", "Only run benchmark scenarios whose \"environment scenario\" name matches this regex")
+
+	// open-loop load mode
+	loadTest := flag.Bool("loadtest", false, "Ramp an open-loop offered rate for each scenario and report the highest rate it sustains")
+	loadStartRate := flag.Float64("load-start-rate", 1000, "Offered records per second for the first load step")
+	loadMaxRate := flag.Float64("load-max-rate", 10_000_000, "Stop ramping once the offered rate exceeds this many records per second")
+	loadRampFactor := flag.Float64("load-ramp-factor", 1.25, "Multiply the offered rate by this factor after each sustained step")
+	loadStepDuration := flag.Duration("load-step-duration", 2*time.Second, "How long each offered rate is held")
+	loadMaxLatency := flag.Duration("load-max-latency", 100*time.Millisecond, "p99 latency above which a step counts as saturated")
+	loadTarget := flag.String("load-target", "50MB", "Throughput per second to estimate the number of cores for")
 
 	flag.Parse()
 
+	if *configFile != "" {
+		cfg, err := loadPipelineConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := applyPipelineConfig(flag.CommandLine, cfg); err != nil {
+			log.Fatalf("%s: %v", *configFile, err)
+		}
+	}
+	if *workers < 1 || *batchSize < 1 {
+		log.Fatalf("-workers and -batch-size must be at least 1, got %d and %d", *workers, *batchSize)
+	}
+	runnerOptions.CallTimeout = *callTimeoutFlag
+	if *wasmFile != "" {
+		if err := loadWasmFile(*wasmFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *enrichmentTableFile != "" {
+		enrichmentTable = nil
+		if err := loadJsonObject(*enrichmentTableFile, &enrichmentTable); err != nil {
+			log.Fatal(err)
+		}
+	}
+	env, err := parseWasiEnv(*wasiEnv)
+	if err != nil {
+		log.Fatalf("-wasi-env: %v", err)
+	}
+	runnerOptions.Wasi.Env = env
+	if err := runnerOptions.Wasi.validate(); err != nil {
+		log.Fatalf("-wasi-dir: %v", err)
+	}
+	var scenarioFilter *regexp.Regexp
+	if *scenarioFilterFlag != "" {
+		if scenarioFilter, err = regexp.Compile(*scenarioFilterFlag); err != nil {
+			log.Fatalf("-scenario-filter: %v", err)
+		}
+	}
+	if wazeroOptions.Features, err = parseWazeroFeatures(*wazeroFeatures); err != nil {
+		log.Fatalf("-wazero-features: %v", err)
+	}
+	if err := wasmtimeOptions.validate(); err != nil {
+		log.Fatalf("-wasmtime-opt-level: %v", err)
+	}
+	growth, err := humanize.ParseBytes(*recycleGrowth)
+	if err != nil {
+		log.Fatalf("-recycle-growth: %v", err)
+	}
+	if *maxMemoryPages > 65536 {
+		log.Fatalf("-max-memory-pages must be at most 65536 (4GiB), got %d", *maxMemoryPages)
+	}
+	if *recycleCalls < 0 {
+		log.Fatalf("-recycle-calls must not be negative, got %d", *recycleCalls)
+	}
+	runnerOptions.Memory = MemoryLimits{
+		MaxPages:      uint32(*maxMemoryPages),
+		RecycleCalls:  *recycleCalls,
+		RecycleGrowth: growth,
+	}
+
+	err = setRegexConfig(RegexConfig{
+		Pattern:     *pattern,
+		Replacement: *replacement,
+		Count:       *replaceCount,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *vrlProgramFile != "" {
+		source, err := os.ReadFile(*vrlProgramFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := setVrlProgram(string(source)); err != nil {
+			log.Fatalf("%s: %v", *vrlProgramFile, err)
+		}
+	}
+
+	blobCfg := BloblangConfig{
+		AllowFunctions: splitList(*bloblangAllow),
+		DenyFunctions:  splitList(*bloblangDeny),
+	}
+	blobFilename := "bloblang mapping"
+	if *bloblangMappingFile != "" {
+		mapping, err := os.ReadFile(*bloblangMappingFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		blobCfg.Mapping = string(mapping)
+		blobFilename = *bloblangMappingFile
+	}
+	if err := setBloblangConfig(blobCfg, blobFilename); err != nil {
+		log.Fatal(err)
+	}
+
 	if *benchmarkTable {
-		fmt.Print(generateBenchmarkTable())
+		fmt.Print(generateBenchmarkTable(scenarioFilter, *runtimeMatrixFlag))
 		return
 	}
 
+	if *loadTest {
+		target, err := humanize.ParseBytes(*loadTarget)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *loadRampFactor <= 1 {
+			log.Fatalf("-load-ramp-factor must be greater than 1, got %v", *loadRampFactor)
+		}
+
+		fmt.Print(generateLoadTable(LoadConfig{
+			StartRate:    *loadStartRate,
+			MaxRate:      *loadMaxRate,
+			RampFactor:   *loadRampFactor,
+			StepDuration: *loadStepDuration,
+			MaxLatency:   *loadMaxLatency,
+			Target:       target,
+		}, scenarioFilter))
+		return
+	}
+
+	if *grpcProgram != "" && *grpcClient == "" {
+		log.Fatal("-grpc-program needs -grpc-client")
+	}
+	if *grpcServe != "" {
+		if *grpcClient != "" {
+			log.Fatal("-grpc-serve can't be used with -grpc-client")
+		}
+		serveGrpc(*grpcServe, selectedEngine(flag.CommandLine), *workers, *programsDir)
+		return
+	}
+
+	// The first SIGINT or SIGTERM stops reading input and drains the records
+	// already read, a second one kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	var reader *bufio.Reader
-	if *useUds {
-		reader = getUdsReader()
+	closeSource := func() {}
+	if *tcpAddr != "" {
+		reader, closeSource = getListenerReader("tcp", *tcpAddr)
+	} else if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reader, closeSource = bufio.NewReader(f), func() { f.Close() }
+	} else if *useUds {
+		reader, closeSource = getUdsReader(*udsPath)
 	} else {
 		reader = bufio.NewReader(os.Stdin)
 	}
-
-	var exe *bloblang.Executor
-	if *useBloblang {
-		exe = setupBloblang()
+	var closeSourceOnce sync.Once
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Print("Shutting down, draining records already read...")
+		closeSourceOnce.Do(closeSource)
+	}()
+
+	var registry *ProgramRegistry
+	if *programsDir != "" {
+		registry, err = loadProgramRegistry(*programsDir)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	var wazeroRunner *WazeroRunner
-	if *useWazeroNoop || *useWazero || *useWazeroRegex {
-		// Choose the context to use for function calls.
-		ctx := context.Background()
+	pipelineWorkers := make([]*pipelineWorker, *workers)
+	for i := range pipelineWorkers {
+		w := &pipelineWorker{reloads: make(chan *Reload, 1)}
+		if *grpcClient != "" {
+			// The service runs the records.
+			pipelineWorkers[i] = w
+			continue
+		}
+		if *useBloblang {
+			w.exe = setupBloblang()
+		}
+
+		if *useWazeroNoop || *useWazero || *useWazeroRegex {
+			// Choose the context to use for function calls. Not the
+			// shutdown context: records are still drained after it is done.
+			ctx := context.Background()
 
-		wazeroRunner = NewWazeroRunner(ctx, compiledWasmBytes)
-		defer wazeroRunner.Close() // This closes everything this Runtime created.
-	}
+			w.wazero = NewWazeroRunner(ctx, compiledWasmBytes)
+		}
 
-	var wasmtimeRunner *WasmtimeRunner
-	if *useWasmtimeNoop || *useWasmtime || *useWasmtimeRegex {
-		wasmtimeRunner = NewWasmtimeRunner(compiledWasmBytes)
+		if *useWasmtimeNoop || *useWasmtime || *useWasmtimeRegex {
+			w.wasmtime = NewWasmtimeRunner(compiledWasmBytes)
+		}
+
+		if *useSidecarNoop || *useSidecar || *useSidecarRegex {
+			w.sidecar = NewRustSidecar()
+		}
+		pipelineWorkers[i] = w
 	}
 
+	throughputRecorder := throughputRecorder{}
 	var output OutFunc
+	var sink *fileSink
 	if *stdout {
-		output = fmt.Println
+		output = func(a ...any) (int, error) {
+			n, err := fmt.Println(a...)
+			throughputRecorder.Record(n)
+			return n, err
+		}
+	} else if *outputFile != "" {
+		sink, err = newFileSink(*outputFile, &throughputRecorder)
+		if err != nil {
+			log.Fatal(err)
+		}
+		output = sink.Println
 	} else {
-		throughputRecorder := throughputRecorder{}
 		output = getBlackholeWriter(&throughputRecorder)
-		go func() {
-			oneSecond, err := time.ParseDuration("1s")
-			if err != nil {
-				panic(err)
-			}
+	}
 
+	if !*stdout && *metricsInterval > 0 {
+		go func() {
 			for {
-				time.Sleep(oneSecond)
+				time.Sleep(*metricsInterval)
 				fmt.Println(throughputRecorder.AvgThroughput())
+				if registry != nil {
+					fmt.Print(registry.Summary())
+				}
+				fmt.Print(memorySummary())
+				fmt.Print(guestMetrics.Summary())
+				if errs := recordErrors.String(); errs != "" {
+					fmt.Println("Errors:", errs)
+				}
 			}
 		}()
 	}
 
-	for {
-		text, _ := reader.ReadString('\n')
+	// VRL runtime errors and call timeouts are counted rather than stopping
+	// the run; the record is dropped.
+	outputChecked := func(s string, err error) {
+		if err != nil {
+			recordErrors.Record(err)
+			return
+		}
+		output(s)
+	}
+
+	useVrlEvents := *vrlEvents && (*useVrl || *useWazero || *useWasmtime)
+
+	// With metadata or secrets, events are sent as a VrlTarget instead.
+	var vrlTarget *VrlTarget
+	if useVrlEvents && (*vrlMetadataFile != "" || *vrlSecretsFile != "") {
+		vrlTarget = &VrlTarget{}
+		if *vrlMetadataFile != "" {
+			if err := loadJsonObject(*vrlMetadataFile, &vrlTarget.Metadata); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *vrlSecretsFile != "" {
+			if err := loadJsonObject(*vrlSecretsFile, &vrlTarget.Secrets); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if *wasmRing {
+		if useVrlEvents {
+			log.Fatal("-wasm-ring can't be used with -vrl-events")
+		}
+		for _, w := range pipelineWorkers {
+			var runner wasmRunner
+			transform := ringNoop
+			switch {
+			case *useWazeroNoop:
+				runner = w.wazero
+			case *useWazeroRegex:
+				runner, transform = w.wazero, ringRegex
+			case *useWazero:
+				runner, transform = w.wazero, ringVrl
+			case *useWasmtimeNoop:
+				runner = w.wasmtime
+			case *useWasmtimeRegex:
+				runner, transform = w.wasmtime, ringRegex
+			case *useWasmtime:
+				runner, transform = w.wasmtime, ringVrl
+			default:
+				log.Fatal("-wasm-ring needs one of the wasm engines")
+			}
+			w.streamBatch = func(batch []string) {
+				if err := runner.runRing(batch, transform, outputChecked); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+
+	if *ffiWorkers > 0 {
+		if useVrlEvents {
+			log.Fatal("-ffi-workers can't be used with -vrl-events")
+		}
+		if *wasmRing {
+			log.Fatal("-ffi-workers can't be used with -wasm-ring")
+		}
+		transform := ringNoop
+		switch {
+		case *useRustNoop:
+		case *useRust:
+			transform = ringRegex
+		case *useVrl:
+			transform = ringVrl
+		default:
+			log.Fatal("-ffi-workers needs -rust, -nooprust or -vrl")
+		}
+		pool := NewRustWorkerPool(*ffiWorkers)
+		defer pool.Close()
+		for _, w := range pipelineWorkers {
+			w.streamBatch = func(batch []string) {
+				pool.runBatch(batch, transform, outputChecked)
+			}
+		}
+	}
+
+	if *useSidecarNoop || *useSidecar || *useSidecarRegex {
+		transform := ringNoop
+		if *useSidecarRegex {
+			transform = ringRegex
+		} else if *useSidecar {
+			transform = ringVrl
+		}
+		// Each batch is a single request.
+		for _, w := range pipelineWorkers {
+			sidecar := w.sidecar
+			w.streamBatch = func(batch []string) {
+				sidecar.runBatch(batch, transform, outputChecked)
+			}
+		}
+	}
+
+	if *grpcClient != "" {
+		if useVrlEvents || *wasmRing || *ffiWorkers > 0 || registry != nil {
+			log.Fatal("-grpc-client can't be used with -vrl-events, -wasm-ring, -ffi-workers or -programs, use -grpc-program")
+		}
+		engine := selectedEngine(flag.CommandLine)
+		if _, ok := grpcEngines[engine]; !ok && *grpcProgram == "" {
+			log.Fatalf("-grpc-client doesn't support the %s engine", engine)
+		}
+		client, err := DialTransformService(*grpcClient)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		// Each batch is a single TransformBatch call.
+		for _, w := range pipelineWorkers {
+			w.streamBatch = func(batch []string) {
+				client.runBatch(engine, *grpcProgram, batch, outputChecked)
+			}
+		}
+	}
+
+	reloader := Reloader{
+		VrlProgramFile:      *vrlProgramFile,
+		BloblangMappingFile: *bloblangMappingFile,
+		CorpusFile:          *reloadCorpus,
+		VrlEvents:           useVrlEvents,
+		Ndjson:              *ndjson,
+		BloblangJson:        *bloblangJson,
+	}
+	if reloader.enabled() {
+		reloader.Watch(pipelineWorkers)
+	}
+
+	runPipeline(ctx, reader, pipelineWorkers, *batchSize, func(w *pipelineWorker, text string) {
+		if registry != nil {
+			record := strings.TrimRight(text, "\r\n")
+			if record == "" {
+				return
+			}
+			// Failed and unrouted records are counted in the summary.
+			if _, out, err := registry.Process(record); err == nil {
+				output(out)
+			}
+			runtime.Gosched()
+			return
+		}
+
+		if useVrlEvents {
+			if strings.TrimSpace(text) == "" {
+				return
+			}
+			event, err := newVrlEvent(text, *ndjson)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			text = event
+		}
+
+		if vrlTarget != nil {
+			target := *vrlTarget
+			target.Event = json.RawMessage(text)
+			var run VrlFunc
+			if *useVrl {
+				run = processTargetVrl
+			} else if *useWazero {
+				run = w.wazero.runVrlTarget
+			} else {
+				run = w.wasmtime.runVrlTarget
+			}
+
+			result, err := resolveVrlTarget(run, target)
+			if err != nil {
+				recordErrors.Record(err)
+				return
+			}
+			out, err := json.Marshal(result)
+			if err != nil {
+				log.Panicln(err)
+			}
+			output(string(out))
+			runtime.Gosched()
+			return
+		}
+
 		if *useRust {
 			output(processStringRs(text))
+		} else if *useVrl && useVrlEvents {
+			outputChecked(processEventVrl(text))
 		} else if *useVrl {
-			text = strings.TrimSpace(text)
-			text = fmt.Sprintf("{\"message\":\"%s\"}", text)
-			output(processStringVrl(text))
+			outputChecked(processStringVrl(text))
 		} else if *useBloblang {
-			output(processStringBloblang(exe, text))
+			outputChecked(queryBloblang(w.exe, text, *bloblangJson))
 		} else if *useRustNoop {
 			output(noopStringRs(text))
 		} else if *useGoNoop {
 			output(simpleStringGo(text))
+		} else if *useWazeroNoop && *dynamicAllocation {
+			outputChecked(w.wazero.runNoopDynamicAllocation(text))
 		} else if *useWazeroNoop {
-			output(wazeroRunner.runNoop(text))
+			outputChecked(w.wazero.runNoop(text))
+		} else if *useWazeroRegex && *dynamicAllocation {
+			outputChecked(w.wazero.runRegexDynamicAllocation(text))
 		} else if *useWazeroRegex {
-			output(wazeroRunner.runRegex(text))
+			outputChecked(w.wazero.runRegex(text))
+		} else if *useWazero && useVrlEvents {
+			outputChecked(w.wazero.runVrlEvent(text))
+		} else if *useWazero && *dynamicAllocation {
+			outputChecked(w.wazero.runVrlDynamicAllocation(text))
 		} else if *useWazero {
-			output(wazeroRunner.runVrl(text))
+			outputChecked(w.wazero.runVrl(text))
+		} else if *useWasmtimeNoop && *dynamicAllocation {
+			outputChecked(w.wasmtime.runNoopDynamicAllocation(text))
 		} else if *useWasmtimeNoop {
-			output(wasmtimeRunner.runNoop(text))
+			outputChecked(w.wasmtime.runNoop(text))
+		} else if *useWasmtime && useVrlEvents {
+			outputChecked(w.wasmtime.runVrlEvent(text))
+		} else if *useWasmtime && *dynamicAllocation {
+			outputChecked(w.wasmtime.runVrlDynamicAllocation(text))
 		} else if *useWasmtime {
-			output(wasmtimeRunner.runVrl(text))
+			outputChecked(w.wasmtime.runVrl(text))
+		} else if *useWasmtimeRegex && *dynamicAllocation {
+			outputChecked(w.wasmtime.runRegexDynamicAllocation(text))
 		} else if *useWasmtimeRegex {
-			output(wasmtimeRunner.runRegex(text))
+			outputChecked(w.wasmtime.runRegex(text))
 		} else {
 			output(processStringGo(text))
 		}
 
 		runtime.Gosched()
+	})
+
+	closeSourceOnce.Do(closeSource)
+	if sink != nil {
+		if err := sink.Close(); err != nil {
+			log.Print(err)
+		}
+	}
+	restarts := 0
+	for _, w := range pipelineWorkers {
+		if w.sidecar != nil {
+			restarts += w.sidecar.Restarts()
+		}
+		w.Close()
+	}
+
+	if !throughputRecorder.Started() {
+		log.Print("Final summary: no records")
+	} else {
+		log.Printf("Final summary: %s, %s total", throughputRecorder.AvgThroughput(), humanize.Bytes(uint64(throughputRecorder.totalBytes.Load())))
+	}
+	if registry != nil {
+		log.Print(registry.Summary())
+	}
+	if mem := memorySummary(); mem != "" {
+		log.Print(mem)
+	}
+	if metrics := guestMetrics.Summary(); metrics != "" {
+		log.Print(metrics)
+	}
+	if errs := recordErrors.String(); errs != "" {
+		log.Print("Errors: ", errs)
+	}
+	if restarts > 0 {
+		log.Printf("Sidecar restarts: %d", restarts)
 	}
 }
 
@@ -222,19 +772,110 @@ func processStringRs(str string) string {
 	return s
 }
 
-func processStringVrl(str string) string {
+// configureRs sets the regex used by the Rust transform and VRL program.
+func configureRs(cfg RegexConfig) error {
+	pattern := C.CString(cfg.Pattern)
+	defer C.free(unsafe.Pointer(pattern))
+	replacement := C.CString(cfg.Replacement)
+	defer C.free(unsafe.Pointer(replacement))
+
+	errMsg := C.configure(pattern, replacement, C.uint(cfg.count()))
+	if errMsg == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(errMsg))
+	return fmt.Errorf("rust: %s", C.GoString(errMsg))
+}
+
+// compileVrlRs compiles source and runs it for every following
+// processStringVrl call.
+func compileVrlRs(source string) error {
+	cs := C.CString(source)
+	defer C.free(unsafe.Pointer(cs))
+
+	errJson := C.compile(cs)
+	if errJson == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(errJson))
+	return parseVrlCompileError([]byte(C.GoString(errJson)))
+}
+
+// compileNamedVrlRs compiles source as the program called name, for
+// processNamedVrl and processNamedEventVrl.
+func compileNamedVrlRs(name, source string) error {
+	cn := C.CString(name)
+	defer C.free(unsafe.Pointer(cn))
+	cs := C.CString(source)
+	defer C.free(unsafe.Pointer(cs))
+
+	errJson := C.compile_named(cn, cs)
+	if errJson == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(errJson))
+	return parseVrlCompileError([]byte(C.GoString(errJson)))
+}
+
+// processNamedVrl is processStringVrl with the program called name.
+func processNamedVrl(name, str string) (string, error) {
+	cn := C.CString(name)
+	defer C.free(unsafe.Pointer(cn))
 	cs := C.CString(str)
-	b := C.transform_vrl(cs)
-	s := C.GoString(b)
 	defer C.free(unsafe.Pointer(cs))
-	defer C.free(unsafe.Pointer(b))
-	return s
+	return vrlResultRs(C.transform_vrl_named(cn, cs))
+}
+
+// processNamedEventVrl is processEventVrl with the program called name.
+func processNamedEventVrl(name, event string) (string, error) {
+	cn := C.CString(name)
+	defer C.free(unsafe.Pointer(cn))
+	cs := C.CString(event)
+	defer C.free(unsafe.Pointer(cs))
+	return vrlResultRs(C.transform_vrl_event_named(cn, cs))
+}
+
+// vrlResultRs converts the result of a VRL FFI call, freeing its strings.
+func vrlResultRs(res C.VrlResult) (string, error) {
+	if res.error != nil {
+		defer C.free(unsafe.Pointer(res.error))
+		return "", parseVrlRuntimeError([]byte(C.GoString(res.error)))
+	}
+	defer C.free(unsafe.Pointer(res.output))
+	return C.GoString(res.output), nil
+}
+
+// processEventVrl runs the VRL program on a JSON event and returns the
+// resulting event as JSON.
+func processEventVrl(event string) (string, error) {
+	cs := C.CString(event)
+	defer C.free(unsafe.Pointer(cs))
+	return vrlResultRs(C.transform_vrl_event(cs))
+}
+
+// processTargetVrl runs the VRL program on a JSON target holding an event,
+// its metadata and secrets. See resolveVrlTarget.
+func processTargetVrl(target string) (string, error) {
+	cs := C.CString(target)
+	defer C.free(unsafe.Pointer(cs))
+	return vrlResultRs(C.transform_vrl_target(cs))
 }
 
-var r = regexp.MustCompile(`\b\w{4}\b`)
+func processStringVrl(str string) (string, error) {
+	cs := C.CString(str)
+	defer C.free(unsafe.Pointer(cs))
+	return vrlResultRs(C.transform_vrl(cs))
+}
 
-func processStringGo(str string) string {
-	return r.ReplaceAllString(str, "gogo")
+// splitList splits a comma separated flag value, ignoring empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
 
 // Copy a string
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"sync"
+	"testing"
+)
 
 // Run `./build.sh` first!
 
@@ -37,7 +40,7 @@ func BenchmarkGoRegex100000(b *testing.B) { benchmarkGoRegex(100000, b) }
 func benchmarkRustPassthrough(j int, b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		for i := 0; i < j; i++ {
-			simpleStringRs("Oct 17 14:33:33 | XSS | ERROR | (/viral/interactive/deliverables/holistic.go:3) | sed et dolorem minima et corrupti abcd veniam qui blanditiis optio explicabo et amet qui sint ut iure neque eveniet quod odio distinctio quas veniam voluptatibus quibusdam esse maiores dolores magni numquam sed deserunt quia odio fuga deserunt cumque a aliquam ad dolores dolore aut sapiente necessitatibus ut autem necessitatibus quam eveniet et omnis aut quos dolorem culpa nostrum quas provident tempora voluptate iure quos iste consequatur minima accusantium molestiae consequatur perspiciatis quis quia at incidunt non veritatis deserunt totam iure autem asperiores rerum officiis iusto et explicabo sunt et rerum molestiae hic dolore neque eum vel rerum perspiciatis autem et consequuntur consequatur aliquam dolore magni ea est illum accusamus rerum magnam neque odio voluptatibus est temporibus quo ullam nobis soluta quo ipsum temporibus perferendis et esse repellendus ea id explicabo nostrum repellat vero perferendis possimus optio consectetur deserunt aspern")
+			noopStringRs("Oct 17 14:33:33 | XSS | ERROR | (/viral/interactive/deliverables/holistic.go:3) | sed et dolorem minima et corrupti abcd veniam qui blanditiis optio explicabo et amet qui sint ut iure neque eveniet quod odio distinctio quas veniam voluptatibus quibusdam esse maiores dolores magni numquam sed deserunt quia odio fuga deserunt cumque a aliquam ad dolores dolore aut sapiente necessitatibus ut autem necessitatibus quam eveniet et omnis aut quos dolorem culpa nostrum quas provident tempora voluptate iure quos iste consequatur minima accusantium molestiae consequatur perspiciatis quis quia at incidunt non veritatis deserunt totam iure autem asperiores rerum officiis iusto et explicabo sunt et rerum molestiae hic dolore neque eum vel rerum perspiciatis autem et consequuntur consequatur aliquam dolore magni ea est illum accusamus rerum magnam neque odio voluptatibus est temporibus quo ullam nobis soluta quo ipsum temporibus perferendis et esse repellendus ea id explicabo nostrum repellat vero perferendis possimus optio consectetur deserunt aspern")
 		}
 	}
 }
@@ -62,3 +65,25 @@ func BenchmarkGoPassthrough100(b *testing.B)    { benchmarkGoPassthrough(100, b)
 func BenchmarkGoPassthrough1000(b *testing.B)   { benchmarkGoPassthrough(1000, b) }
 func BenchmarkGoPassthrough10000(b *testing.B)  { benchmarkGoPassthrough(10000, b) }
 func BenchmarkGoPassthrough100000(b *testing.B) { benchmarkGoPassthrough(100000, b) }
+
+// The workers record their output while the metrics goroutine reports it.
+func TestThroughputRecorderConcurrent(t *testing.T) {
+	var tr throughputRecorder
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				tr.Record(10)
+			}
+		}()
+	}
+	_ = tr.Started()
+	_ = tr.AvgThroughput()
+	wg.Wait()
+
+	if got := tr.totalBytes.Load(); !tr.Started() || got != 40000 {
+		t.Errorf("recorded %v bytes, want 40000", got)
+	}
+}
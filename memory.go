@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"go.uber.org/atomic"
+)
+
+// MemoryLimits bounds the linear memory of the wasm runners' guests. Zero
+// values disable a limit.
+type MemoryLimits struct {
+	// MaxPages is enforced by wazero while the guest grows its memory, a
+	// call that needs more traps and returns a *GuestTrapError. wasmtime-go
+	// v1.0.0 has no store limiter, so wasmtime instances that went over it
+	// are replaced after the call instead. Both replace instances that
+	// reached it.
+	MaxPages uint32
+	// RecycleCalls replaces an instance after this many calls.
+	RecycleCalls int
+	// RecycleGrowth replaces an instance once its memory grew by this many
+	// bytes since it was created, which bounds slow leaks in the guest.
+	RecycleGrowth uint64
+}
+
+// overLimit reports whether size bytes of memory reach the page limit.
+func (limits MemoryLimits) overLimit(size uint64) bool {
+	return limits.MaxPages > 0 && size >= uint64(limits.MaxPages)*wasmPageSize
+}
+
+// instanceMemory tracks the memory of the instances of one runner, sampled
+// after every call, and decides when to recycle them. The runner updates it
+// while the stats output reads it.
+type instanceMemory struct {
+	name   string
+	limits MemoryLimits
+
+	// These belong to the runner's current instance. recycleDue is set once
+	// it reached a limit; the runner recycles it before its next call, after
+	// the output of the last one was read.
+	calls       int
+	initialSize uint64
+	recycleDue  bool
+
+	size     atomic.Uint64
+	peak     atomic.Uint64
+	recycled atomic.Int64
+}
+
+var runnerMemory struct {
+	mu        sync.Mutex
+	instances []*instanceMemory
+	// created numbers the runners of each runtime, closed ones included, so
+	// names are not reused.
+	created map[string]int
+}
+
+// newInstanceMemory registers the memory stats of a new runner of runtime,
+// which recycles its instances at limits.
+func newInstanceMemory(runtime string, limits MemoryLimits) *instanceMemory {
+	runnerMemory.mu.Lock()
+	defer runnerMemory.mu.Unlock()
+
+	if runnerMemory.created == nil {
+		runnerMemory.created = map[string]int{}
+	}
+	runnerMemory.created[runtime]++
+	m := &instanceMemory{name: fmt.Sprintf("%s %d", runtime, runnerMemory.created[runtime]), limits: limits}
+	runnerMemory.instances = append(runnerMemory.instances, m)
+	return m
+}
+
+// unregister removes the stats of a closed runner.
+func (m *instanceMemory) unregister() {
+	runnerMemory.mu.Lock()
+	defer runnerMemory.mu.Unlock()
+
+	for i, other := range runnerMemory.instances {
+		if other == m {
+			runnerMemory.instances = append(runnerMemory.instances[:i], runnerMemory.instances[i+1:]...)
+			return
+		}
+	}
+}
+
+// instantiated starts tracking a new instance with size bytes of memory.
+func (m *instanceMemory) instantiated(size uint64) {
+	m.calls = 0
+	m.initialSize = size
+	m.recycleDue = false
+	m.sample(size)
+}
+
+func (m *instanceMemory) sample(size uint64) {
+	m.size.Store(size)
+	if size > m.peak.Load() {
+		m.peak.Store(size)
+	}
+}
+
+// called records a call that left the instance with size bytes of memory.
+func (m *instanceMemory) called(size uint64) {
+	m.calls++
+	m.sample(size)
+
+	limits := m.limits
+	m.recycleDue = limits.overLimit(size) ||
+		(limits.RecycleCalls > 0 && m.calls >= limits.RecycleCalls) ||
+		(limits.RecycleGrowth > 0 && size-m.initialSize >= limits.RecycleGrowth)
+}
+
+// memorySummary reports the memory of every runner, one line each, or an
+// empty string when there are none.
+func memorySummary() string {
+	runnerMemory.mu.Lock()
+	defer runnerMemory.mu.Unlock()
+
+	var b strings.Builder
+	for _, m := range runnerMemory.instances {
+		fmt.Fprintf(&b, "%s memory: %s, peak %s, %d recycled\n", m.name,
+			humanize.IBytes(m.size.Load()), humanize.IBytes(m.peak.Load()), m.recycled.Load())
+	}
+	return b.String()
+}
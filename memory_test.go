@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestInstanceMemoryRecycle(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits MemoryLimits
+		sizes  []uint64
+		want   []bool
+	}{
+		{"no limits", MemoryLimits{}, []uint64{wasmPageSize, 100 * wasmPageSize}, []bool{false, false}},
+		{"calls", MemoryLimits{RecycleCalls: 2}, []uint64{wasmPageSize, wasmPageSize}, []bool{false, true}},
+		{"growth", MemoryLimits{RecycleGrowth: 2 * wasmPageSize}, []uint64{2 * wasmPageSize, 3 * wasmPageSize}, []bool{false, true}},
+		{"max pages", MemoryLimits{MaxPages: 4}, []uint64{3 * wasmPageSize, 4 * wasmPageSize}, []bool{false, true}},
+	}
+	for _, tt := range tests {
+		m := &instanceMemory{name: tt.name, limits: tt.limits}
+		m.instantiated(wasmPageSize)
+		for i, size := range tt.sizes {
+			m.called(size)
+			if m.recycleDue != tt.want[i] {
+				t.Errorf("%s: call %d: recycleDue = %v, want %v", tt.name, i+1, m.recycleDue, tt.want[i])
+			}
+		}
+		if peak := tt.sizes[len(tt.sizes)-1]; m.peak.Load() != peak {
+			t.Errorf("%s: peak %d, want %d", tt.name, m.peak.Load(), peak)
+		}
+	}
+}
+
+func TestRunnerRecycle(t *testing.T) {
+	options := RunnerOptions{Memory: MemoryLimits{RecycleCalls: 2}}
+	wazeroRunner := newWazeroRunner(context.Background(), compiledWasmBytes, WazeroOptions{RunnerOptions: options})
+	defer wazeroRunner.Close()
+	wasmtimeRunner := newWasmtimeRunner(compiledWasmBytes, WasmtimeOptions{RunnerOptions: options})
+	defer wasmtimeRunner.Close()
+
+	runners := map[string]struct {
+		run    VrlFunc
+		memory *instanceMemory
+	}{
+		"Rust (WASM Wazero)":   {wazeroRunner.runRegex, wazeroRunner.memory},
+		"Rust (WASM Wasmtime)": {wasmtimeRunner.runRegex, wasmtimeRunner.memory},
+	}
+
+	want := processStringGo(BenchmarkInput)
+	for name, r := range runners {
+		for i := 0; i < 5; i++ {
+			if got, err := r.run(BenchmarkInput); err != nil || got != want {
+				t.Fatalf("%s: call %d: got %q, %v, want %q", name, i+1, got, err, want)
+			}
+		}
+		// Instances are recycled before the 3rd and 5th call.
+		if recycled := r.memory.recycled.Load(); recycled != 2 {
+			t.Errorf("%s: recycled %d instances, want 2", name, recycled)
+		}
+		if r.memory.size.Load() == 0 {
+			t.Errorf("%s: memory size was not sampled", name)
+		}
+	}
+}
+
+func TestRunnerMaxPages(t *testing.T) {
+	// Leave the guest a little room to grow over the memory it starts with.
+	probe := NewWazeroRunner(context.Background(), compiledWasmBytes)
+	pages := uint32(probe.memory.size.Load()/wasmPageSize) + 16
+	probe.Close()
+
+	options := RunnerOptions{Memory: MemoryLimits{MaxPages: pages}}
+	runner := newWazeroRunner(context.Background(), compiledWasmBytes, WazeroOptions{RunnerOptions: options})
+	defer runner.Close()
+
+	big := strings.Repeat("abcd ", int(pages)*wasmPageSize/5)
+	_, err := runner.runNoopDynamicAllocation(big)
+	var trapErr *GuestTrapError
+	if !errors.As(err, &trapErr) {
+		t.Fatalf("got %v for a record of %d bytes, want a *GuestTrapError", err, len(big))
+	}
+	if recycled := runner.memory.recycled.Load(); recycled != 1 {
+		t.Errorf("recycled %d instances, want 1", recycled)
+	}
+
+	// The replacement instance still runs records that fit.
+	if got, err := runner.runNoopDynamicAllocation(BenchmarkInput); err != nil || got != BenchmarkInput {
+		t.Errorf("got %q, %v after a trap, want %q", got, err, BenchmarkInput)
+	}
+}
+
+func TestRunnerMemoryUnregister(t *testing.T) {
+	runner := NewWazeroRunner(context.Background(), compiledWasmBytes)
+	if !strings.Contains(memorySummary(), runner.memory.name+" memory") {
+		t.Errorf("memory summary %q misses %s", memorySummary(), runner.memory.name)
+	}
+	runner.Close()
+	if strings.Contains(memorySummary(), runner.memory.name+" memory") {
+		t.Errorf("memory summary %q still lists the closed %s", memorySummary(), runner.memory.name)
+	}
+}
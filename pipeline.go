@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/benthosdev/benthos/v4/public/bloblang"
+)
+
+// pipelineWorker holds the engines one worker runs records on. The wasm
+// runners are not safe for concurrent use, so every worker has its own.
+type pipelineWorker struct {
+	wazero   *WazeroRunner
+	wasmtime *WasmtimeRunner
+	exe      *bloblang.Executor
+	sidecar  *RustSidecar
+	// streamBatch, when set, processes whole batches instead of process, see
+	// -wasm-ring, -ffi-workers and the sidecar engines.
+	streamBatch func(batch []string)
+	// reloads delivers programs reloaded with SIGHUP, see Reloader.Watch.
+	reloads chan *Reload
+}
+
+// processBatch runs process on every record of batch. Reloads are applied
+// before the batch, so a record never sees part of one.
+func (w *pipelineWorker) processBatch(batch []string, process func(w *pipelineWorker, text string)) {
+	select {
+	case reload := <-w.reloads:
+		if err := reload.ApplyTo(w); err != nil {
+			log.Printf("Reload failed on a worker, keeping its running programs: %v", err)
+		}
+	default:
+	}
+
+	if w.streamBatch != nil {
+		w.streamBatch(batch)
+		return
+	}
+	for _, text := range batch {
+		process(w, text)
+	}
+}
+
+// offerReload queues reload for the worker, replacing one it hasn't picked up
+// yet, so that an idle worker never blocks Reloader.Watch.
+func (w *pipelineWorker) offerReload(reload *Reload) {
+	select {
+	case <-w.reloads:
+	default:
+	}
+	select {
+	case w.reloads <- reload:
+	default:
+	}
+}
+
+// Close releases the worker's engines.
+func (w *pipelineWorker) Close() {
+	if w.wazero != nil {
+		w.wazero.Close() // This closes everything this Runtime created.
+	}
+	if w.wasmtime != nil {
+		w.wasmtime.Close()
+	}
+	if w.sidecar != nil {
+		w.sidecar.Close()
+	}
+}
+
+// readBatch reads up to n lines from reader. It returns fewer, along with the
+// error, when reading fails.
+func readBatch(reader *bufio.Reader, n int) ([]string, error) {
+	batch := make([]string, 0, n)
+	for len(batch) < n {
+		text, err := reader.ReadString('\n')
+		if text != "" {
+			batch = append(batch, text)
+		}
+		if err != nil {
+			return batch, err
+		}
+	}
+	return batch, nil
+}
+
+// runPipeline reads batches of batchSize records from reader and hands each
+// to one of the workers, until the input ends or ctx is done. Once ctx is
+// done, the records already buffered are still read, and closing the source
+// unblocks a read in progress. It returns once the workers have processed
+// every batch that was read.
+func runPipeline(ctx context.Context, reader *bufio.Reader, workers []*pipelineWorker, batchSize int, process func(w *pipelineWorker, text string)) {
+	batches := make(chan []string, len(workers))
+
+	go func() {
+		defer close(batches)
+		for ctx.Err() == nil || reader.Buffered() > 0 {
+			batch, err := readBatch(reader, batchSize)
+			if len(batch) > 0 {
+				// The workers take every batch until it is closed, so a
+				// batch that was read is never dropped.
+				batches <- batch
+			}
+			if err != nil {
+				// Closing the source on shutdown also ends up here.
+				if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+					log.Print(err)
+				}
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *pipelineWorker) {
+			defer wg.Done()
+			for batch := range batches {
+				w.processBatch(batch, process)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector records what the pipeline processed.
+type collector struct {
+	mu      sync.Mutex
+	records []string
+}
+
+func (c *collector) process(_ *pipelineWorker, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records = append(c.records, strings.TrimSuffix(text, "\n"))
+}
+
+func TestRunPipeline(t *testing.T) {
+	workers := []*pipelineWorker{{}, {}, {}}
+	reader := bufio.NewReader(strings.NewReader("a\nb\nc\nd\ne\nf\ng"))
+
+	var c collector
+	runPipeline(context.Background(), reader, workers, 2, c.process)
+
+	sort.Strings(c.records)
+	if got, want := strings.Join(c.records, ","), "a,b,c,d,e,f,g"; got != want {
+		t.Errorf("processed %s, want %s", got, want)
+	}
+}
+
+func TestRunPipelineShutdown(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var c collector
+	done := make(chan struct{})
+	go func() {
+		runPipeline(ctx, bufio.NewReader(pr), []*pipelineWorker{{}}, 1, c.process)
+		close(done)
+	}()
+
+	if _, err := io.WriteString(pw, "a\nb\n"); err != nil {
+		t.Fatal(err)
+	}
+	// The input stays open, as a client connection would.
+	cancel()
+	pr.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runPipeline did not return after the context was canceled")
+	}
+	// Both records were read before the shutdown, so both are processed.
+	if got, want := strings.Join(c.records, ","), "a,b"; got != want {
+		t.Errorf("processed %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.uber.org/atomic"
+)
+
+// routesFile lists the routes of a program directory, see Route.
+const routesFile = "routes.json"
+
+// Program is one named transform of a ProgramRegistry.
+type Program struct {
+	Name string
+	// Kind is "vrl", "bloblang" or "regex", after the file extension it was
+	// loaded from.
+	Kind string
+	run  func(record string) (string, error)
+
+	throughput throughputRecorder
+	errors     atomic.Int64
+}
+
+// Route sends the records it matches to Program. A record matches when it
+// starts with Prefix and, for JSON records, when Field equals Equals. Empty
+// conditions always match, so a route with neither catches every record.
+type Route struct {
+	Program string `json:"program"`
+	Prefix  string `json:"prefix,omitempty"`
+	// Field is a dot separated path into a JSON object record.
+	Field  string `json:"field,omitempty"`
+	Equals string `json:"equals,omitempty"`
+}
+
+func (route Route) matches(record string, doc map[string]any) bool {
+	if !strings.HasPrefix(record, route.Prefix) {
+		return false
+	}
+	if route.Field == "" {
+		return true
+	}
+
+	var value any = doc
+	for _, key := range strings.Split(route.Field, ".") {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return false
+		}
+		value = obj[key]
+	}
+	return value != nil && fmt.Sprint(value) == route.Equals
+}
+
+// ErrUnrouted is returned for records that no route matches.
+var ErrUnrouted = errors.New("no route matches the record")
+
+// ProgramRegistry holds named VRL, Bloblang and regex programs and routes
+// each record to one of them. VRL programs run on the Rust FFI library.
+type ProgramRegistry struct {
+	programs map[string]*Program
+	routes   []Route
+	unrouted atomic.Int64
+}
+
+// loadProgramRegistry loads every program in dir: `name.vrl`, `name.blobl`
+// and `name.regex`, a JSON RegexConfig. Routes are read from routes.json,
+// which may be left out when dir holds a single program.
+func loadProgramRegistry(dir string) (*ProgramRegistry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	reg := &ProgramRegistry{programs: map[string]*Program{}}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || entry.Name() == routesFile || ext == "" {
+			continue
+		}
+
+		filename := filepath.Join(dir, entry.Name())
+		source, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if _, ok := reg.programs[name]; ok {
+			return nil, fmt.Errorf("%s: duplicate program %q", filename, name)
+		}
+		program, err := newProgram(name, ext, string(source))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		if program != nil {
+			reg.programs[name] = program
+		}
+	}
+
+	if len(reg.programs) == 0 {
+		return nil, fmt.Errorf("%s: no .vrl, .blobl or .regex programs", dir)
+	}
+
+	routes, err := os.ReadFile(filepath.Join(dir, routesFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(routes, &reg.routes); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, routesFile), err)
+		}
+	case errors.Is(err, os.ErrNotExist) && len(reg.programs) == 1:
+		for name := range reg.programs {
+			reg.routes = []Route{{Program: name}}
+		}
+	default:
+		return nil, err
+	}
+
+	for _, route := range reg.routes {
+		if _, ok := reg.programs[route.Program]; !ok {
+			return nil, fmt.Errorf("%s: route to unknown program %q", filepath.Join(dir, routesFile), route.Program)
+		}
+	}
+
+	return reg, nil
+}
+
+// newProgram compiles source by its file extension. Files with any other
+// extension are ignored and return nil.
+func newProgram(name, ext, source string) (*Program, error) {
+	switch ext {
+	case ".vrl":
+		if err := compileNamedVrlRs(name, source); err != nil {
+			return nil, err
+		}
+		return &Program{Name: name, Kind: "vrl", run: func(record string) (string, error) {
+			if isJsonObject(record) {
+				return processNamedEventVrl(name, record)
+			}
+			return processNamedVrl(name, record)
+		}}, nil
+
+	case ".blobl":
+		exe, err := bloblangEnvironment(bloblangConfig).Parse(source)
+		if err != nil {
+			return nil, err
+		}
+		return &Program{Name: name, Kind: "bloblang", run: func(record string) (string, error) {
+			return queryBloblang(exe, record, isJsonObject(record))
+		}}, nil
+
+	case ".regex":
+		var cfg RegexConfig
+		if err := json.Unmarshal([]byte(source), &cfg); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+		return &Program{Name: name, Kind: "regex", run: func(record string) (string, error) {
+			if cfg.Count <= 0 {
+				return re.ReplaceAllString(record, cfg.Replacement), nil
+			}
+			return replaceN(re, record, cfg.Replacement, cfg.Count), nil
+		}}, nil
+	}
+
+	return nil, nil
+}
+
+func isJsonObject(record string) bool {
+	return strings.HasPrefix(strings.TrimSpace(record), "{")
+}
+
+// route returns the program of the first route matching record, or nil.
+func (reg *ProgramRegistry) route(record string) *Program {
+	var doc map[string]any
+	parsed := false
+	for _, route := range reg.routes {
+		// Only parse the record once, and only if a route needs a field.
+		if route.Field != "" && !parsed {
+			parsed = true
+			if isJsonObject(record) {
+				_ = json.Unmarshal([]byte(record), &doc)
+			}
+		}
+		if route.matches(record, doc) {
+			return reg.programs[route.Program]
+		}
+	}
+	return nil
+}
+
+// Process runs record through the program it is routed to and records the
+// output in that program's throughput.
+func (reg *ProgramRegistry) Process(record string) (*Program, string, error) {
+	program := reg.route(record)
+	if program == nil {
+		reg.unrouted.Inc()
+		return nil, "", ErrUnrouted
+	}
+
+	out, err := program.Run(record)
+	return program, out, err
+}
+
+// Run runs record through the program and records the output in its
+// throughput.
+func (program *Program) Run(record string) (string, error) {
+	out, err := program.run(record)
+	if err != nil {
+		program.errors.Inc()
+		return "", err
+	}
+	program.throughput.Record(len(out))
+	return out, nil
+}
+
+// Summary reports the throughput and errors of every program that has seen a
+// record, one line each, sorted by name. It may run while records are
+// processed.
+func (reg *ProgramRegistry) Summary() string {
+	var names []string
+	for name := range reg.programs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		program := reg.programs[name]
+		throughput := "0 B / second"
+		if program.throughput.Started() {
+			throughput = program.throughput.AvgThroughput()
+		} else if program.errors.Load() == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "%s (%s): %s, %d errors\n", name, program.Kind, throughput, program.errors.Load())
+	}
+	if unrouted := reg.unrouted.Load(); unrouted > 0 {
+		fmt.Fprintf(&b, "unrouted: %d records\n", unrouted)
+	}
+	return b.String()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Run `./build.sh` first!
+
+func TestProgramRegistry(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"upper.vrl": `.message = upcase(string!(.message))`,
+		"billing.blobl": `root = this
+root.billed = true`,
+		"redact.regex": `{"pattern": "\\d{4}", "replacement": "****"}`,
+		"routes.json": `[
+			{"program": "upper", "field": "service.name", "equals": "auth"},
+			{"program": "billing", "field": "service.name", "equals": "billing"},
+			{"program": "redact", "prefix": "card "}
+		]`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reg, err := loadProgramRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		record  string
+		program string
+		want    string
+	}{
+		{`{"service":{"name":"auth"},"message":"login"}`, "upper", `{"message":"LOGIN","service":{"name":"auth"}}`},
+		{`{"service":{"name":"billing"}}`, "billing", `{"billed":true,"service":{"name":"billing"}}`},
+		{"card 1234 5678", "redact", "card **** ****"},
+	}
+	for _, c := range cases {
+		program, got, err := reg.Process(c.record)
+		if err != nil {
+			t.Errorf("%s: %v", c.record, err)
+			continue
+		}
+		if program.Name != c.program || got != c.want {
+			t.Errorf("%s: got %s from %s, want %s from %s", c.record, got, program.Name, c.want, c.program)
+		}
+	}
+
+	if _, _, err := reg.Process("no match"); !errors.Is(err, ErrUnrouted) {
+		t.Errorf("got %v, want ErrUnrouted", err)
+	}
+	if summary := reg.Summary(); summary == "" {
+		t.Error("empty summary")
+	}
+}
+
+func TestProgramRegistryUnknownRoute(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.regex"), []byte(`{"pattern": "a"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "routes.json"), []byte(`[{"program": "b"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadProgramRegistry(dir); err == nil {
+		t.Error("got no error for a route to an unknown program")
+	}
+}
+
+// Workers run programs while the metrics goroutine reports the summary, run
+// with -race.
+func TestProgramRegistryConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "redact.regex"), []byte(`{"pattern": "\\d{4}", "replacement": "****"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reg, err := loadProgramRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, _, err := reg.Process("card 1234"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	_ = reg.Summary()
+	wg.Wait()
+
+	if summary := reg.Summary(); !strings.HasPrefix(summary, "redact (regex): ") {
+		t.Errorf("got summary %q", summary)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// RegexConfig is the regex replacement every engine applies. Count limits the
+// number of replaced matches, 0 replaces all of them.
+type RegexConfig struct {
+	Pattern     string
+	Replacement string
+	Count       int
+}
+
+// Must match DEFAULT_PATTERN and DEFAULT_REPLACEMENT in lib.rs.
+var defaultRegexConfig = RegexConfig{
+	Pattern:     `\b\w{4}\b`,
+	Replacement: "xxxx",
+	Count:       0,
+}
+
+// count returns Count in the form the Rust side expects.
+func (cfg RegexConfig) count() uint32 {
+	if cfg.Count < 0 {
+		return 0
+	}
+	return uint32(cfg.Count)
+}
+
+var (
+	regexConfig = defaultRegexConfig
+	r           = regexp.MustCompile(defaultRegexConfig.Pattern)
+)
+
+// setRegexConfig validates cfg with Go's regexp and applies it to Go and the
+// Rust FFI library. Wasm runners configure every instance they create, or
+// recycle, with the current one.
+func setRegexConfig(cfg RegexConfig) error {
+	re, err := regexp.Compile(cfg.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+	if err := configureRs(cfg); err != nil {
+		return err
+	}
+	// configureRs regenerates the VRL program from the regex, so put back the
+	// one that was loaded from a file.
+	if vrlProgram != "" {
+		if err := compileVrlRs(vrlProgram); err != nil {
+			return err
+		}
+	}
+
+	regexConfig = cfg
+	r = re
+	return nil
+}
+
+func processStringGo(str string) string {
+	if regexConfig.Count <= 0 {
+		return r.ReplaceAllString(str, regexConfig.Replacement)
+	}
+	return replaceN(r, str, regexConfig.Replacement, regexConfig.Count)
+}
+
+// replaceN is ReplaceAllString limited to the first n matches.
+func replaceN(re *regexp.Regexp, src, repl string, n int) string {
+	var dst []byte
+	last := 0
+	for _, match := range re.FindAllStringSubmatchIndex(src, n) {
+		dst = append(dst, src[last:match[0]]...)
+		dst = re.ExpandString(dst, repl, src, match)
+		last = match[1]
+	}
+	return string(append(dst, src[last:]...))
+}
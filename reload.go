@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/benthosdev/benthos/v4/public/bloblang"
+)
+
+// reloadCandidate is the name the Rust library compiles a reloaded VRL
+// program under while it is validated, see compileNamedVrlRs.
+const reloadCandidate = "__reload_candidate"
+
+// Reloader recompiles the program files given on the command line. Programs
+// are validated against an optional sample corpus before they are swapped in,
+// so a broken edit keeps the old program running.
+type Reloader struct {
+	VrlProgramFile      string
+	BloblangMappingFile string
+	// CorpusFile holds sample records, one per line, that every reloaded
+	// program must process without error. Blank lines are skipped.
+	CorpusFile string
+
+	// How records are fed to the engines, as set by -vrl-events, -ndjson and
+	// -bloblang-json.
+	VrlEvents    bool
+	Ndjson       bool
+	BloblangJson bool
+}
+
+// Reload is a set of validated programs, ready to be applied between two
+// records.
+type Reload struct {
+	vrlProgram  string // empty when there is no VRL program file
+	bloblangCfg BloblangConfig
+	bloblang    *bloblang.Executor // nil when there is no mapping file
+}
+
+func (rl *Reloader) enabled() bool {
+	return rl.VrlProgramFile != "" || rl.BloblangMappingFile != ""
+}
+
+// Prepare reads, compiles and validates every program file.
+func (rl *Reloader) Prepare() (*Reload, error) {
+	var corpus []string
+	if rl.CorpusFile != "" {
+		var err error
+		if corpus, err = readCorpus(rl.CorpusFile); err != nil {
+			return nil, err
+		}
+	}
+
+	reload := &Reload{}
+	if rl.VrlProgramFile != "" {
+		source, err := os.ReadFile(rl.VrlProgramFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := rl.validateVrl(string(source), corpus); err != nil {
+			return nil, fmt.Errorf("%s: %w", rl.VrlProgramFile, err)
+		}
+		reload.vrlProgram = string(source)
+	}
+
+	if rl.BloblangMappingFile != "" {
+		mapping, err := os.ReadFile(rl.BloblangMappingFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg := bloblangConfig
+		cfg.Mapping = string(mapping)
+		exe, err := newBloblangExecutor(cfg)
+		if err != nil {
+			return nil, bloblangFileError(rl.BloblangMappingFile, err)
+		}
+		for i, record := range corpus {
+			if record == "" {
+				continue
+			}
+			if _, err := queryBloblang(exe, record, rl.BloblangJson); err != nil {
+				return nil, fmt.Errorf("%s: %s:%d: %w", rl.BloblangMappingFile, rl.CorpusFile, i+1, err)
+			}
+		}
+		reload.bloblangCfg = cfg
+		reload.bloblang = exe
+	}
+
+	return reload, nil
+}
+
+// validateVrl compiles source next to the running program and runs the
+// corpus through it.
+func (rl *Reloader) validateVrl(source string, corpus []string) error {
+	if err := compileNamedVrlRs(reloadCandidate, source); err != nil {
+		return err
+	}
+
+	for i, record := range corpus {
+		if record == "" {
+			continue
+		}
+		var err error
+		if rl.VrlEvents {
+			var event string
+			if event, err = newVrlEvent(record, rl.Ndjson); err == nil {
+				_, err = processNamedEventVrl(reloadCandidate, event)
+			}
+		} else {
+			_, err = processNamedVrl(reloadCandidate, record)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", rl.CorpusFile, i+1, err)
+		}
+	}
+	return nil
+}
+
+// Watch prepares a Reload on every SIGHUP, applies it and hands it to every
+// worker. Failed reloads are logged and the running programs are kept.
+func (rl *Reloader) Watch(workers []*pipelineWorker) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			reload, err := rl.Prepare()
+			if err == nil {
+				err = reload.Apply()
+			}
+			if err != nil {
+				log.Printf("Reload failed, keeping the running programs: %v", err)
+				continue
+			}
+			for _, w := range workers {
+				w.offerReload(reload)
+			}
+			log.Print("Reloaded programs")
+		}
+	}()
+}
+
+// Apply swaps the reloaded programs into the FFI library and the Bloblang
+// configuration. Every worker must then pick them up with ApplyTo.
+func (reload *Reload) Apply() error {
+	if reload.vrlProgram != "" {
+		if err := setVrlProgram(reload.vrlProgram); err != nil {
+			return err
+		}
+	}
+	if reload.bloblang != nil {
+		bloblangConfig = reload.bloblangCfg
+	}
+	return nil
+}
+
+// ApplyTo swaps the reloaded programs into the engines of w. It must not run
+// concurrently with them. Engines that fail to compile the program keep the
+// one they ran, and the first error is returned.
+func (reload *Reload) ApplyTo(w *pipelineWorker) error {
+	var errs []error
+	if reload.vrlProgram != "" {
+		if w.wazero != nil {
+			errs = append(errs, w.wazero.compileVrl(reload.vrlProgram))
+		}
+		if w.wasmtime != nil {
+			errs = append(errs, w.wasmtime.compileVrl(reload.vrlProgram))
+		}
+		if w.sidecar != nil {
+			errs = append(errs, w.sidecar.compileVrl(reload.vrlProgram))
+		}
+	}
+	// Workers don't share executors, so each parses the mapping again.
+	if reload.bloblang != nil && w.exe != nil {
+		exe, err := newBloblangExecutor(reload.bloblangCfg)
+		if err == nil {
+			w.exe = exe
+		}
+		errs = append(errs, err)
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readCorpus(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var corpus []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		corpus = append(corpus, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return corpus, scanner.Err()
+}
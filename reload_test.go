@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Run `./build.sh` first!
+
+func TestReloadBloblang(t *testing.T) {
+	dir := t.TempDir()
+	mapping := filepath.Join(dir, "mapping.blobl")
+	corpus := filepath.Join(dir, "corpus.txt")
+	if err := os.WriteFile(corpus, []byte(`{"message":"abcd"}`+"\n\n"+`{"message":"efgh"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rl := Reloader{BloblangMappingFile: mapping, CorpusFile: corpus, BloblangJson: true}
+
+	if err := os.WriteFile(mapping, []byte(`root = this.message.uppercase()`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reload, err := rl.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(cfg BloblangConfig) { bloblangConfig = cfg }(bloblangConfig)
+	if err := reload.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	w := &pipelineWorker{exe: setupBloblang()}
+	if err := reload.ApplyTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := queryBloblang(w.exe, `{"message":"abcd"}`, true); err != nil || got != "ABCD" {
+		t.Errorf("got %q, %v after reload", got, err)
+	}
+
+	// Fails on the corpus: the second record has no count.
+	if err := os.WriteFile(mapping, []byte(`root = this.count + 1`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rl.Prepare(); err == nil {
+		t.Error("got no error for a mapping that fails on the corpus")
+	}
+}
+
+func TestReloadVrl(t *testing.T) {
+	dir := t.TempDir()
+	program := filepath.Join(dir, "program.vrl")
+	corpus := filepath.Join(dir, "corpus.txt")
+	if err := os.WriteFile(corpus, []byte("abcd\nefgh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rl := Reloader{VrlProgramFile: program, CorpusFile: corpus}
+
+	defer func() {
+		vrlProgram = ""
+		if err := setRegexConfig(regexConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	if err := os.WriteFile(program, []byte(`. = upcase(string!(.))`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reload, err := rl.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reload.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	w := &pipelineWorker{wazero: engines.wazero, wasmtime: engines.wasmtime}
+	if err := reload.ApplyTo(w); err != nil {
+		t.Fatal(err)
+	}
+
+	// A program the guests fail to compile leaves them running the last one,
+	// also in instances created after it.
+	if err := (&Reload{vrlProgram: `upcase(`}).ApplyTo(w); err == nil {
+		t.Error("got no error for a program that doesn't compile")
+	}
+	engines.wazero.recycle()
+	engines.wasmtime.recycle()
+
+	// A program that compiles but fails at runtime on the corpus, whose
+	// records have no foo, is not applied.
+	if err := os.WriteFile(program, []byte(`. = string!(.foo)`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = rl.Prepare()
+	var runtimeErr *VrlRuntimeError
+	if !errors.As(err, &runtimeErr) || !strings.Contains(err.Error(), corpus+":1:") {
+		t.Errorf("got %v, want a runtime error on %s:1", err, corpus)
+	}
+
+	for _, scenario := range benchmarkScenarios(engines) {
+		if scenario.description != "VRL Replace" {
+			continue
+		}
+		if got, want := scenario.runner("abcd"), "ABCD"; got != want {
+			t.Errorf("%s: got %q, want %q", scenario.environment, got, want)
+		}
+	}
+}
+
+func TestOfferReload(t *testing.T) {
+	w := &pipelineWorker{reloads: make(chan *Reload, 1)}
+	first, second := &Reload{}, &Reload{}
+
+	// The worker is idle, so the second reload replaces the first instead of
+	// blocking.
+	w.offerReload(first)
+	w.offerReload(second)
+	if got := <-w.reloads; got != second {
+		t.Error("got the first reload, want the second")
+	}
+}
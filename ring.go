@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The ring buffers stream records between the host and a guest that exports
+// ring_drain_wasm, with one call for as many records as fit instead of one
+// call and two copies each. Both rings live in guest memory, allocated with
+// allocate when the instance is created, and the host reads and writes them
+// through its view of that memory.
+//
+// The region starts with a header of little-endian u32s at ringHeader*
+// offsets, followed by the data of the input ring and then the output ring.
+// Heads and tails count bytes since the ring was created, wrapping at 2^32,
+// so the capacities are powers of two. The host advances the input tail and
+// the output head, the guest the input head and the output tail.
+//
+// A record is its length as a u32, with dynamicErrorFlag set for a VRL
+// runtime error, followed by its bytes padded to 4 bytes. When the output of
+// a record doesn't fit in the output ring at all, the guest writes an empty
+// record with ringTooBigFlag set instead. A record never wraps around the end
+// of the data: the writer marks the rest as skipped with a ringWrap length
+// instead.
+const (
+	ringHeaderInCapacity  = 0
+	ringHeaderInHead      = 4
+	ringHeaderInTail      = 8
+	ringHeaderOutCapacity = 12
+	ringHeaderOutHead     = 16
+	ringHeaderOutTail     = 20
+	ringHeaderSize        = 24
+
+	ringWrap       = 0xFFFFFFFF
+	ringTooBigFlag = 1 << 30
+)
+
+// ringCapacity is the size of each ring's data. Records, and what the
+// transform makes of them, must fit.
+const ringCapacity = 64 << 10
+
+// ringTransform is what ring_drain_wasm runs on every record.
+type ringTransform uint32
+
+const (
+	ringNoop ringTransform = iota
+	ringRegex
+	ringVrl
+)
+
+var (
+	errRingRecordTooBig = fmt.Errorf("record does not fit in the ring buffer of %d bytes", ringCapacity)
+	errRingStalled      = errors.New("the guest took no record from the ring buffer")
+	errRingCorrupt      = errors.New("the guest wrote a record out of the bounds of the ring buffer")
+)
+
+// ring is the region of one instance's memory holding its rings.
+type ring struct {
+	ptr uint32
+}
+
+// ringRegionSize is how many bytes of memory the rings take.
+const ringRegionSize = ringHeaderSize + 2*ringCapacity
+
+// init writes the header of empty rings to memory.
+func (r ring) init(memory []byte) {
+	header := memory[r.ptr : r.ptr+ringHeaderSize]
+	for i := range header {
+		header[i] = 0
+	}
+	r.set(memory, ringHeaderInCapacity, ringCapacity)
+	r.set(memory, ringHeaderOutCapacity, ringCapacity)
+}
+
+func (r ring) get(memory []byte, field uint32) uint32 {
+	return binary.LittleEndian.Uint32(memory[r.ptr+field:])
+}
+
+func (r ring) set(memory []byte, field, value uint32) {
+	binary.LittleEndian.PutUint32(memory[r.ptr+field:], value)
+}
+
+func (r ring) in(memory []byte) []byte {
+	start := r.ptr + ringHeaderSize
+	return memory[start : start+ringCapacity]
+}
+
+func (r ring) out(memory []byte) []byte {
+	start := r.ptr + ringHeaderSize + ringCapacity
+	return memory[start : start+ringCapacity]
+}
+
+// push appends record to the input ring, or reports false when it is full.
+func (r ring) push(memory []byte, record string) bool {
+	head, tail := r.get(memory, ringHeaderInHead), r.get(memory, ringHeaderInTail)
+	if head == tail && tail%ringCapacity != 0 {
+		// Start an empty ring over at the beginning of its data, so any
+		// record up to its capacity fits. The guest does the same with the
+		// output ring.
+		tail += ringCapacity - tail%ringCapacity
+		head = tail
+		r.set(memory, ringHeaderInHead, head)
+		r.set(memory, ringHeaderInTail, tail)
+	}
+	tail, ok := ringPush(r.in(memory), head, tail, record, 0)
+	if ok {
+		r.set(memory, ringHeaderInTail, tail)
+	}
+	return ok
+}
+
+// pop takes the next record of the output ring. The bytes are copied, as the
+// guest reuses them.
+func (r ring) pop(memory []byte) (record string, flags uint32, ok bool, err error) {
+	data, flags, head, ok, err := ringPop(r.out(memory), r.get(memory, ringHeaderOutHead), r.get(memory, ringHeaderOutTail))
+	if ok {
+		record = string(data)
+		r.set(memory, ringHeaderOutHead, head)
+	}
+	return record, flags, ok, err
+}
+
+// ringRecordSize is the size of a record of n bytes, with its length.
+func ringRecordSize(n int) uint32 {
+	return 4 + (uint32(n)+3)&^3
+}
+
+// ringPush writes record with flags in its length at tail of the ring data
+// that was read up to head, and returns the new tail, or false when the
+// record doesn't fit.
+func ringPush(data []byte, head, tail uint32, record string, flags uint32) (uint32, bool) {
+	capacity := uint32(len(data))
+	size := ringRecordSize(len(record))
+	offset := tail % capacity
+	skip := uint32(0)
+	if size > capacity-offset {
+		skip = capacity - offset
+	}
+	if tail-head+skip+size > capacity {
+		return tail, false
+	}
+
+	if skip > 0 {
+		binary.LittleEndian.PutUint32(data[offset:], ringWrap)
+		tail += skip
+		offset = 0
+	}
+	binary.LittleEndian.PutUint32(data[offset:], uint32(len(record))|flags)
+	copy(data[offset+4:], record)
+	return tail + size, true
+}
+
+// ringPop reads the record at head of the ring data written up to tail, and
+// returns it with its flags and the new head, or false when it is empty. The
+// writer is the guest, so positions and lengths that point out of the
+// written data return errRingCorrupt.
+func ringPop(data []byte, head, tail uint32) (record []byte, flags uint32, newHead uint32, ok bool, err error) {
+	if head == tail {
+		return nil, 0, head, false, nil
+	}
+	capacity := uint32(len(data))
+	written := tail - head
+	offset := head % capacity
+	if written > capacity || written < 4 || offset > capacity-4 {
+		return nil, 0, head, false, errRingCorrupt
+	}
+	length := binary.LittleEndian.Uint32(data[offset:])
+	if length == ringWrap {
+		skip := capacity - offset
+		if skip+4 > written {
+			return nil, 0, head, false, errRingCorrupt
+		}
+		written -= skip
+		head += skip
+		offset = 0
+		length = binary.LittleEndian.Uint32(data)
+	}
+
+	flags = length & (dynamicErrorFlag | ringTooBigFlag)
+	n := length &^ flags
+	size := ringRecordSize(int(n))
+	if size > written || size > capacity-offset {
+		return nil, 0, head, false, errRingCorrupt
+	}
+	return data[offset+4 : offset+4+n], flags, head + size, true, nil
+}
+
+// ringGuest is what streamRing needs from a runner.
+type ringGuest interface {
+	// ring returns the rings of the current instance.
+	ring() ring
+	// ringMemory returns the memory of the current instance. Every call to
+	// drainRing invalidates it.
+	ringMemory() []byte
+	// drainRing calls ring_drain_wasm, which returns how many records it
+	// took. It returns a *CallTimeoutError when the call timed out and the
+	// instance was replaced, along with the records in its rings.
+	drainRing(transform ringTransform) (uint32, error)
+	// recycleIfDue replaces the instance when it reached a memory limit.
+	recycleIfDue()
+}
+
+// streamRing runs transform on every record through the rings of g, and
+// emits the results in order. A record that is too big, or whose output is,
+// or that was in the rings when a call timed out, is emitted with an error.
+// When the guest corrupted its output ring, the rings are emptied and
+// errRingCorrupt is returned without emitting the records left.
+func streamRing(g ringGuest, records []string, transform ringTransform, emit func(string, error)) error {
+	var inFlight []string
+	for len(records) > 0 || len(inFlight) > 0 {
+		if len(inFlight) == 0 {
+			g.recycleIfDue()
+		}
+		r, memory := g.ring(), g.ringMemory()
+		for len(records) > 0 && r.push(memory, records[0]) {
+			inFlight = append(inFlight, records[0])
+			records = records[1:]
+		}
+		if len(inFlight) == 0 {
+			emit("", errRingRecordTooBig)
+			records = records[1:]
+			continue
+		}
+
+		taken, err := g.drainRing(transform)
+		if err != nil {
+			for range inFlight {
+				emit("", err)
+			}
+			inFlight = nil
+			continue
+		}
+
+		memory = g.ringMemory()
+		popped := 0
+		for {
+			output, flags, ok, err := r.pop(memory)
+			if err == nil && ok && popped == len(inFlight) {
+				// More outputs than records.
+				err = errRingCorrupt
+			}
+			if err != nil {
+				r.init(memory)
+				return err
+			}
+			if !ok {
+				break
+			}
+			popped++
+			switch {
+			case flags&ringTooBigFlag != 0:
+				emit("", errRingRecordTooBig)
+			case flags&dynamicErrorFlag != 0:
+				emit("", parseVrlRuntimeError([]byte(output)))
+			default:
+				emit(output, nil)
+			}
+		}
+		if popped == 0 && taken == 0 {
+			// A guest that can't write to its empty output ring would never
+			// make progress, so start over with empty rings.
+			for range inFlight {
+				emit("", errRingStalled)
+			}
+			r.init(memory)
+			inFlight = nil
+			continue
+		}
+		inFlight = inFlight[popped:]
+	}
+	return nil
+}
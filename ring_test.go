@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRingPushPop(t *testing.T) {
+	data := make([]byte, 64)
+	head, tail := uint32(0), uint32(0)
+
+	// 4+20 and 4+24 bytes fill 52 of 64, so the 4+12 byte record has to
+	// wrap.
+	for _, record := range []string{strings.Repeat("a", 18), strings.Repeat("b", 24)} {
+		var ok bool
+		if tail, ok = ringPush(data, head, tail, record, 0); !ok {
+			t.Fatalf("push %q: full", record)
+		}
+	}
+	c := strings.Repeat("c", 12)
+	if _, ok := ringPush(data, head, tail, c, 0); ok {
+		t.Fatal("push into a full ring succeeded")
+	}
+
+	record, _, head, _, _ := ringPop(data, head, tail)
+	if string(record) != strings.Repeat("a", 18) {
+		t.Fatalf("got %q", record)
+	}
+	var ok bool
+	if tail, ok = ringPush(data, head, tail, c, 0); !ok {
+		t.Fatal("push after pop: full")
+	}
+	if tail != 64+16 {
+		t.Errorf("got tail %d, want the record at the start of the data after a wrap marker", tail)
+	}
+
+	for _, want := range []string{strings.Repeat("b", 24), c} {
+		if record, _, head, ok, _ = ringPop(data, head, tail); !ok || string(record) != want {
+			t.Fatalf("got %q, %v, want %q", record, ok, want)
+		}
+	}
+	if _, _, _, ok, _ := ringPop(data, head, tail); ok {
+		t.Error("pop from an empty ring succeeded")
+	}
+}
+
+func TestRingPopCorrupt(t *testing.T) {
+	tests := []struct {
+		name               string
+		head, tail, length uint32
+	}{
+		{"length past the tail", 0, 8, 1000},
+		{"length past the end of the data", 56, 72, 8},
+		{"tail past the capacity", 0, 68, 0},
+		{"unaligned head", 62, 64, 0},
+		{"wrap marker at the tail", 56, 64, ringWrap},
+	}
+	for _, tt := range tests {
+		data := make([]byte, 64)
+		if tt.head%4 == 0 {
+			binary.LittleEndian.PutUint32(data[tt.head%64:], tt.length)
+		}
+		if _, _, _, ok, err := ringPop(data, tt.head, tt.tail); ok || err != errRingCorrupt {
+			t.Errorf("%s: got %v, %v, want %v", tt.name, ok, err, errRingCorrupt)
+		}
+	}
+}
+
+// fakeRingGuest drains the rings in Go, like ring_drain_wasm does in the
+// guest.
+type fakeRingGuest struct {
+	memory    []byte
+	rings     ring
+	transform func(string) string
+	// timeoutCall makes that call time out, counting from 1.
+	timeoutCall, calls int
+	// corruptCall makes that call write a length past the output ring.
+	corruptCall int
+}
+
+func newFakeRingGuest(transform func(string) string) *fakeRingGuest {
+	g := &fakeRingGuest{memory: make([]byte, 8+ringRegionSize), rings: ring{ptr: 8}, transform: transform}
+	g.rings.init(g.memory)
+	return g
+}
+
+func (g *fakeRingGuest) ring() ring         { return g.rings }
+func (g *fakeRingGuest) ringMemory() []byte { return g.memory }
+func (g *fakeRingGuest) recycleIfDue()      {}
+
+func (g *fakeRingGuest) drainRing(transform ringTransform) (uint32, error) {
+	g.calls++
+	if g.calls == g.timeoutCall {
+		g.rings.init(g.memory)
+		return 0, &CallTimeoutError{Runtime: "fake", Function: "ring_drain_wasm"}
+	}
+
+	r, memory := g.rings, g.memory
+	taken := uint32(0)
+	for {
+		record, _, inHead, ok, _ := ringPop(r.in(memory), r.get(memory, ringHeaderInHead), r.get(memory, ringHeaderInTail))
+		if !ok {
+			return taken, nil
+		}
+		output, flags := g.transform(string(record)), uint32(0)
+		if ringRecordSize(len(output)) > ringCapacity {
+			output, flags = "", ringTooBigFlag
+		}
+		outTail, ok := ringPush(r.out(memory), r.get(memory, ringHeaderOutHead), r.get(memory, ringHeaderOutTail), output, flags)
+		if !ok {
+			return taken, nil
+		}
+		if g.calls == g.corruptCall {
+			offset := r.get(memory, ringHeaderOutTail) % ringCapacity
+			binary.LittleEndian.PutUint32(r.out(memory)[offset:], ringCapacity)
+		}
+		r.set(memory, ringHeaderInHead, inHead)
+		r.set(memory, ringHeaderOutTail, outTail)
+		taken++
+	}
+}
+
+func TestStreamRing(t *testing.T) {
+	var records []string
+	for i := 0; i < 500; i++ {
+		records = append(records, strings.Repeat(string(rune('a'+i%26)), i*7%3000))
+	}
+	records[100] = strings.Repeat("x", ringCapacity)
+
+	g := newFakeRingGuest(strings.ToUpper)
+	var got []string
+	err := streamRing(g, records, ringNoop, func(output string, err error) {
+		if err != nil {
+			output = err.Error()
+		}
+		got = append(got, output)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(records) {
+		t.Fatalf("got %d outputs, want %d", len(got), len(records))
+	}
+	for i, record := range records {
+		want := strings.ToUpper(record)
+		if i == 100 {
+			want = errRingRecordTooBig.Error()
+		}
+		if got[i] != want {
+			t.Errorf("record %d: got %d bytes %.10q, want %d bytes %.10q", i, len(got[i]), got[i], len(want), want)
+		}
+	}
+	if g.calls >= len(records)/2 {
+		t.Errorf("%d calls for %d records, want them streamed in bigger batches", g.calls, len(records))
+	}
+}
+
+func TestStreamRingOutputTooBig(t *testing.T) {
+	records := []string{"a", strings.Repeat("b", ringCapacity/2), "c"}
+
+	g := newFakeRingGuest(func(s string) string { return s + s + s })
+	var got []string
+	err := streamRing(g, records, ringNoop, func(output string, err error) {
+		if err != nil {
+			output = err.Error()
+		}
+		got = append(got, output)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"aaa", errRingRecordTooBig.Error(), "ccc"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %.40q, want %q", got, want)
+	}
+}
+
+func TestStreamRingTimeout(t *testing.T) {
+	records := make([]string, 100)
+	for i := range records {
+		records[i] = strings.Repeat("r", 2000)
+	}
+
+	g := newFakeRingGuest(func(s string) string { return s })
+	g.timeoutCall = 2
+	var outputs, timeouts int
+	err := streamRing(g, records, ringNoop, func(output string, err error) {
+		var timeout *CallTimeoutError
+		switch {
+		case errors.As(err, &timeout):
+			timeouts++
+		case err != nil:
+			t.Fatal(err)
+		default:
+			outputs++
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if timeouts == 0 || outputs+timeouts != len(records) {
+		t.Errorf("got %d outputs and %d timeouts, want some timeouts and %d in total", outputs, timeouts, len(records))
+	}
+}
+
+func TestStreamRingCorrupt(t *testing.T) {
+	records := []string{"a", "b", "c"}
+
+	g := newFakeRingGuest(func(s string) string { return s })
+	g.corruptCall = 1
+	var outputs int
+	err := streamRing(g, records, ringNoop, func(output string, err error) {
+		outputs++
+	})
+	if err != errRingCorrupt || outputs != 0 {
+		t.Errorf("got %v after %d outputs, want %v", err, outputs, errRingCorrupt)
+	}
+
+	// The rings were emptied, so the next batch goes through.
+	var got []string
+	err = streamRing(g, records, ringNoop, func(output string, err error) {
+		got = append(got, output)
+	})
+	if err != nil || strings.Join(got, ",") != "a,b,c" {
+		t.Errorf("got %q, %v after a corrupt ring", got, err)
+	}
+}
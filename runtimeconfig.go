@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// RunnerOptions are the settings both wasm runners share. The zero value
+// sets no limits and caches nothing.
+type RunnerOptions struct {
+	Memory MemoryLimits
+	// CallTimeout bounds every wasm call that transforms a record, 0
+	// disables it.
+	CallTimeout time.Duration
+	Wasi        WasiConfig
+	// CacheDir holds the compiled wasm modules of both runtimes, so only the
+	// first runner compiles them. Empty, the default, disables the cache.
+	//
+	// Compiled modules are native code that is loaded without being
+	// verified, so the directory must only be writable by the user running
+	// the benchmarks.
+	CacheDir string
+}
+
+// runnerOptions are used by NewWazeroRunner and NewWasmtimeRunner. Set with
+// -max-memory-pages, -recycle-calls, -recycle-growth, -call-timeout,
+// -wasi-env, -wasi-dir and -wasm-cache.
+var runnerOptions RunnerOptions
+
+// WazeroOptions configure the runtime of a WazeroRunner. The zero value is
+// wazero's default: the compiler where it is supported, with WebAssembly 2.0
+// features.
+type WazeroOptions struct {
+	Interpreter bool
+	// Features replaces the default core features when it is not zero, see
+	// wazeroFeatureSets.
+	Features api.CoreFeatures
+	RunnerOptions
+}
+
+// wazeroOptions are used by NewWazeroRunner. Set with -wazero-interpreter
+// and -wazero-features.
+var wazeroOptions WazeroOptions
+
+// wazeroFeatureSets are the values of -wazero-features.
+var wazeroFeatureSets = map[string]api.CoreFeatures{
+	"1.0": api.CoreFeaturesV1,
+	"2.0": api.CoreFeaturesV2,
+}
+
+// parseWazeroFeatures returns the feature set called name, or 0 for the
+// default when name is empty.
+func parseWazeroFeatures(name string) (api.CoreFeatures, error) {
+	if name == "" {
+		return 0, nil
+	}
+	features, ok := wazeroFeatureSets[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown wazero feature set %q, want 1.0 or 2.0", name)
+	}
+	return features, nil
+}
+
+func (o WazeroOptions) runtimeConfig() wazero.RuntimeConfig {
+	config := wazero.NewRuntimeConfig()
+	if o.Interpreter {
+		config = wazero.NewRuntimeConfigInterpreter()
+	}
+	if o.Features != 0 {
+		config = config.WithCoreFeatures(o.Features)
+	}
+	if o.Memory.MaxPages > 0 {
+		config = config.WithMemoryLimitPages(o.Memory.MaxPages)
+	}
+	// Closes the module when the context of a call is done, even in a loop
+	// that calls nothing. It costs a check in every loop, so it is only on
+	// with a timeout.
+	config = config.WithCloseOnContextDone(o.CallTimeout > 0)
+	return config
+}
+
+func (o WazeroOptions) String() string {
+	s := "compiler"
+	if o.Interpreter {
+		s = "interpreter"
+	}
+	if o.Features != 0 {
+		s += ", features " + o.featuresName()
+	}
+	if o.Memory.MaxPages > 0 {
+		s += fmt.Sprintf(", max %d pages", o.Memory.MaxPages)
+	}
+	return s
+}
+
+func (o WazeroOptions) featuresName() string {
+	for name, features := range wazeroFeatureSets {
+		if features == o.Features {
+			return name
+		}
+	}
+	return fmt.Sprintf("%#x", uint64(o.Features))
+}
+
+// checkFeatures returns the error wazero rejects wasmBytes with under
+// Features. Modules built by newer toolchains use instructions that older
+// feature sets lack. Only the interpreter is used, which just validates.
+func (o WazeroOptions) checkFeatures(wasmBytes []byte) error {
+	if o.Features == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter().WithCoreFeatures(o.Features))
+	defer r.Close(ctx)
+	_, err := r.CompileModule(ctx, wasmBytes)
+	return err
+}
+
+// WasmtimeOptions configure the engine of a WasmtimeRunner. The zero value is
+// wasmtime's default, optimized for speed. wasmtime-go v1.0.0 doesn't expose
+// the memory and bounds check settings of the engine.
+type WasmtimeOptions struct {
+	// OptLevel is "none", "speed" or "speed_and_size", empty means speed.
+	OptLevel string
+	// EpochInterruption is always on with a CallTimeout.
+	EpochInterruption bool
+	// ConsumeFuel meters every instruction. The store gets more fuel than it
+	// can use, so this only measures the cost of metering.
+	ConsumeFuel bool
+	RunnerOptions
+}
+
+// wasmtimeOptions are used by NewWasmtimeRunner. Set with
+// -wasmtime-opt-level, -wasmtime-epoch and -wasmtime-fuel.
+var wasmtimeOptions WasmtimeOptions
+
+var wasmtimeOptLevels = map[string]wasmtime.OptLevel{
+	"none":           wasmtime.OptLevelNone,
+	"speed":          wasmtime.OptLevelSpeed,
+	"speed_and_size": wasmtime.OptLevelSpeedAndSize,
+}
+
+func (o WasmtimeOptions) validate() error {
+	if _, ok := wasmtimeOptLevels[o.OptLevel]; o.OptLevel != "" && !ok {
+		return fmt.Errorf("unknown wasmtime opt level %q, want none, speed or speed_and_size", o.OptLevel)
+	}
+	return nil
+}
+
+func (o WasmtimeOptions) epochInterruption() bool {
+	return o.EpochInterruption || o.CallTimeout > 0
+}
+
+func (o WasmtimeOptions) config() *wasmtime.Config {
+	config := wasmtime.NewConfig()
+	if level, ok := wasmtimeOptLevels[o.OptLevel]; ok {
+		config.SetCraneliftOptLevel(level)
+	}
+	// A timeout bumps the engine's epoch, which interrupts the store's call.
+	config.SetEpochInterruption(o.epochInterruption())
+	config.SetConsumeFuel(o.ConsumeFuel)
+	return config
+}
+
+// String describes the options, it also keys the compilation cache.
+func (o WasmtimeOptions) String() string {
+	parts := []string{"speed"}
+	if o.OptLevel != "" {
+		parts[0] = o.OptLevel
+	}
+	if o.epochInterruption() {
+		parts = append(parts, "epoch")
+	}
+	if o.ConsumeFuel {
+		parts = append(parts, "fuel")
+	}
+	if o.Memory.MaxPages > 0 {
+		parts = append(parts, fmt.Sprintf("max %d pages", o.Memory.MaxPages))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matrixMaxPages is the memory limit of the runtimeMatrix rows that set one,
+// big enough for every scenario.
+const matrixMaxPages = 1024
+
+// runtimeMatrix lists the runtime settings -runtime-matrix compares. Rows
+// without memory limits use those of runnerOptions.
+var runtimeMatrix = struct {
+	wazero   []WazeroOptions
+	wasmtime []WasmtimeOptions
+}{
+	wazero: []WazeroOptions{
+		{},
+		{Interpreter: true},
+		{Features: api.CoreFeaturesV1},
+		{RunnerOptions: RunnerOptions{Memory: MemoryLimits{MaxPages: matrixMaxPages}}},
+	},
+	wasmtime: []WasmtimeOptions{
+		{},
+		{OptLevel: "none"},
+		{OptLevel: "speed_and_size"},
+		{EpochInterruption: true},
+		{ConsumeFuel: true},
+		{RunnerOptions: RunnerOptions{Memory: MemoryLimits{MaxPages: matrixMaxPages}}},
+	},
+}
+
+// wasmRunner is what the scenarios need from WazeroRunner and WasmtimeRunner.
+type wasmRunner interface {
+	runNoop(input string) (string, error)
+	runRegex(input string) (string, error)
+	runVrl(input string) (string, error)
+	runVrlEvent(event string) (string, error)
+	runEnrich(input string) (string, error)
+	runNoopDynamicAllocation(input string) (string, error)
+	runRegexDynamicAllocation(input string) (string, error)
+	runVrlDynamicAllocation(input string) (string, error)
+	runRing(records []string, transform ringTransform, emit func(string, error)) error
+	hasExport(name string) bool
+	Close()
+}
+
+// runtimeVariant is a wasm runner created with one set of runtime settings.
+type runtimeVariant struct {
+	environment string
+	runner      wasmRunner
+	startup     time.Duration
+}
+
+// newRuntimeVariants creates a runner for every setting of runtimeMatrix.
+func newRuntimeVariants() []runtimeVariant {
+	var variants []runtimeVariant
+	add := func(environment string, create func() wasmRunner) {
+		start := time.Now()
+		runner := create()
+		variants = append(variants, runtimeVariant{environment, runner, time.Since(start)})
+		log.Printf("Created %s in %s", environment, variants[len(variants)-1].startup)
+	}
+
+	for _, o := range runtimeMatrix.wazero {
+		o := o
+		o.RunnerOptions = matrixRunnerOptions(o.Memory)
+		if err := o.checkFeatures(compiledWasmBytes); err != nil {
+			log.Printf("Skipping Rust (WASM Wazero, %s): %v", o, err)
+			continue
+		}
+		add(fmt.Sprintf("Rust (WASM Wazero, %s)", o), func() wasmRunner {
+			return newWazeroRunner(context.Background(), compiledWasmBytes, o)
+		})
+	}
+	for _, o := range runtimeMatrix.wasmtime {
+		o := o
+		o.RunnerOptions = matrixRunnerOptions(o.Memory)
+		add(fmt.Sprintf("Rust (WASM Wasmtime, %s)", o), func() wasmRunner {
+			return newWasmtimeRunner(compiledWasmBytes, o)
+		})
+	}
+	return variants
+}
+
+// matrixRunnerOptions returns runnerOptions with the memory limits of a
+// runtimeMatrix row, if it sets any.
+func matrixRunnerOptions(memory MemoryLimits) RunnerOptions {
+	options := runnerOptions
+	if memory != (MemoryLimits{}) {
+		options.Memory = memory
+	}
+	return options
+}
+
+// scenarios returns the wasm scenarios of benchmarkScenarios for v.
+func (v runtimeVariant) scenarios() []*Scenario {
+	return withoutMissingExports([]*Scenario{
+		{v.environment, "String Copy", mustRun(v.runner.runNoop), ""},
+		{v.environment, "String Copy (Dynamic Allocation)", mustRun(v.runner.runNoopDynamicAllocation), ""},
+		{v.environment, "Regex Replace", mustRun(v.runner.runRegex), ""},
+		{v.environment, "Regex Replace (Dynamic Allocation)", mustRun(v.runner.runRegexDynamicAllocation), ""},
+		{v.environment, "VRL Replace", mustRun(v.runner.runVrl), ""},
+		{v.environment, "VRL Replace (Dynamic Allocation)", mustRun(v.runner.runVrlDynamicAllocation), ""},
+		{v.environment, "VRL Event Replace", vrlEventRunner(mustRun(v.runner.runVrlEvent)), ""},
+		{v.environment, "Host Call Enrich", mustRun(v.runner.runEnrich), ""},
+	}, v.runner.hasExport)
+}
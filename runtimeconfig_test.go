@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+func TestRuntimeMatrix(t *testing.T) {
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+	want := map[string]string{}
+	for _, scenario := range benchmarkScenarios(engines) {
+		if scenario.environment == "Rust (WASM Wazero)" {
+			want[scenario.description] = scenario.runner(BenchmarkInput)
+		}
+	}
+
+	for _, v := range newRuntimeVariants() {
+		for _, scenario := range v.scenarios() {
+			if got := scenario.runner(BenchmarkInput); got != want[scenario.description] {
+				t.Errorf("%s %s: got %q, want %q", v.environment, scenario.description, got, want[scenario.description])
+			}
+		}
+		v.runner.Close()
+	}
+}
+
+func TestWasmtimeOptions(t *testing.T) {
+	tests := []struct {
+		options WasmtimeOptions
+		want    string
+	}{
+		{WasmtimeOptions{}, "speed"},
+		{WasmtimeOptions{OptLevel: "none", EpochInterruption: true}, "none, epoch"},
+		{WasmtimeOptions{OptLevel: "speed_and_size", ConsumeFuel: true}, "speed_and_size, fuel"},
+		{WasmtimeOptions{RunnerOptions: RunnerOptions{Memory: MemoryLimits{MaxPages: 1024}}}, "speed, max 1024 pages"},
+	}
+	for _, tt := range tests {
+		if got := tt.options.String(); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.options, got, tt.want)
+		}
+		if err := tt.options.validate(); err != nil {
+			t.Errorf("%+v: %v", tt.options, err)
+		}
+	}
+
+	if err := (WasmtimeOptions{OptLevel: "fast"}).validate(); err == nil {
+		t.Error("got no error for an unknown opt level")
+	}
+}
+
+// signExtWasm uses i32.extend8_s, which WebAssembly 1.0 doesn't have:
+//
+//	(module (func (param i32) (result i32) (i32.extend8_s (local.get 0))))
+var signExtWasm = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	0x01, 0x06, 0x01, 0x60, 0x01, 0x7f, 0x01, 0x7f, // type (i32) -> i32
+	0x03, 0x02, 0x01, 0x00, // func 0 has type 0
+	0x0a, 0x07, 0x01, 0x05, 0x00, 0x20, 0x00, 0xc0, 0x0b, // local.get 0 i32.extend8_s
+}
+
+func TestWazeroOptions(t *testing.T) {
+	tests := []struct {
+		options WazeroOptions
+		want    string
+	}{
+		{WazeroOptions{}, "compiler"},
+		{WazeroOptions{Interpreter: true, Features: api.CoreFeaturesV1}, "interpreter, features 1.0"},
+		{WazeroOptions{RunnerOptions: RunnerOptions{Memory: MemoryLimits{MaxPages: 1024}}}, "compiler, max 1024 pages"},
+	}
+	for _, tt := range tests {
+		if got := tt.options.String(); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.options, got, tt.want)
+		}
+	}
+
+	if features, err := parseWazeroFeatures("1.0"); err != nil || features != api.CoreFeaturesV1 {
+		t.Errorf("got %#x, %v for 1.0", features, err)
+	}
+	if _, err := parseWazeroFeatures("3.0"); err == nil {
+		t.Error("got no error for an unknown feature set")
+	}
+
+	if err := (WazeroOptions{Features: api.CoreFeaturesV1}).checkFeatures(signExtWasm); err == nil {
+		t.Error("got no error for a sign extension with WebAssembly 1.0")
+	}
+	if err := (WazeroOptions{Features: api.CoreFeaturesV2}).checkFeatures(signExtWasm); err != nil {
+		t.Error(err)
+	}
+}
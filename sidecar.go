@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The sidecar runs the Rust library in a helloRustBinary process, so a Rust
+// panic or abort only ends that process instead of the Go one. The process
+// serves the first connection on a Unix socket with requests and responses
+// framed as little-endian u32s:
+//
+//   - a request is an op, a field count, and each field as its length
+//     followed by its bytes. Ops 0 to 2 run the ringTransform of the same
+//     number on every field, sidecarConfigure takes the pattern, replacement
+//     and count of a RegexConfig, and sidecarCompile the source of a VRL
+//     program.
+//   - a response is a field count and each field as its length, with
+//     dynamicErrorFlag set for an error, followed by its bytes. Transforms
+//     answer with one field per record, sidecarConfigure and sidecarCompile
+//     with an empty field, or the error.
+//
+// See serve in src/bin.rs for the other end.
+const (
+	sidecarConfigure = 3
+	sidecarCompile   = 4
+)
+
+// sidecarBinary is the helloRustBinary the sidecars run, built by build.sh.
+// Set with -sidecar-binary.
+var sidecarBinary = filepath.Join("target", rustTargetTriple(), "release", "helloRustBinary")
+
+// rustTargetTriple returns the target build.sh builds for this platform.
+func rustTargetTriple() string {
+	arch := map[string]string{"amd64": "x86_64", "arm64": "aarch64"}[runtime.GOARCH]
+	if runtime.GOOS == "darwin" {
+		return arch + "-apple-darwin"
+	}
+	return arch + "-unknown-linux-gnu"
+}
+
+// sidecarStartTimeout bounds how long a new process may take to listen.
+const sidecarStartTimeout = 10 * time.Second
+
+// errSidecarStopped is what a request gets after Close.
+var errSidecarStopped = errors.New("sidecar stopped")
+
+// SidecarCrashError is returned for the records of a request the sidecar
+// process didn't answer. A new process has already replaced it, unless
+// StartFailed is set: then Err is why it couldn't be started, and the next
+// request tries again.
+type SidecarCrashError struct {
+	Err         error
+	StartFailed bool
+}
+
+func (e *SidecarCrashError) Error() string {
+	if e.StartFailed {
+		return fmt.Sprintf("sidecar: %s, starting it again on the next request", e.Err)
+	}
+	return fmt.Sprintf("sidecar: %s, restarted it", e.Err)
+}
+
+func (e *SidecarCrashError) Unwrap() error {
+	return e.Err
+}
+
+// RustSidecar talks to one helloRustBinary process, which it starts with the
+// current regexConfig and vrlProgram, and starts again whenever it exits. It
+// is safe for concurrent use, but requests are answered one at a time.
+type RustSidecar struct {
+	name string
+
+	mu      sync.Mutex
+	dir     string
+	process *os.Process
+	// exited is closed once the process exited and its stderr was logged.
+	exited chan struct{}
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// program is the VRL program set with compileVrl, for new processes.
+	program  string
+	restarts int
+	// closed is set by Close. Until then, a missing process is started by
+	// the next request.
+	closed bool
+}
+
+var sidecarCount struct {
+	sync.Mutex
+	n int
+}
+
+// NewRustSidecar starts a sidecar process.
+func NewRustSidecar() *RustSidecar {
+	sidecarCount.Lock()
+	sidecarCount.n++
+	s := &RustSidecar{name: fmt.Sprintf("sidecar %d", sidecarCount.n), program: vrlProgram}
+	sidecarCount.Unlock()
+
+	if err := s.start(); err != nil {
+		log.Panicln(err)
+	}
+	return s
+}
+
+// start runs a new process and configures it.
+func (s *RustSidecar) start() error {
+	dir, err := os.MkdirTemp("", "cgotest-sidecar")
+	if err != nil {
+		return err
+	}
+	socket := filepath.Join(dir, "sidecar.sock")
+
+	s.dir = dir
+	stderr := newGuestLogger(s.name, "stderr")
+	cmd := exec.Command(sidecarBinary, "serve", socket)
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("%s: %w, run ./build.sh or set -sidecar-binary", s.name, err)
+	}
+	s.process = cmd.Process
+	s.exited = make(chan struct{})
+	go func(exited chan struct{}) {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("%s: %v", s.name, err)
+		}
+		stderr.Close()
+		close(exited)
+	}(s.exited)
+
+	deadline := time.Now().Add(sidecarStartTimeout)
+	for {
+		s.conn, err = net.Dial("unix", socket)
+		if err == nil {
+			break
+		}
+		select {
+		case <-s.exited:
+			s.stop()
+			return fmt.Errorf("%s: exited before listening", s.name)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			s.stop()
+			return fmt.Errorf("%s: not listening after %s: %w", s.name, sidecarStartTimeout, err)
+		}
+	}
+	s.reader = bufio.NewReader(s.conn)
+	s.writer = bufio.NewWriter(s.conn)
+
+	if err := s.configure(regexConfig); err != nil {
+		s.stop()
+		return err
+	}
+	if s.program != "" {
+		if err := s.compile(s.program); err != nil {
+			s.stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// stop closes the connection, which makes the process exit, waits for it,
+// killing it when it is stuck, and removes its socket.
+func (s *RustSidecar) stop() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.process != nil {
+		select {
+		case <-s.exited:
+		case <-time.After(time.Second):
+			s.process.Kill()
+			<-s.exited
+		}
+		s.process = nil
+	}
+	os.RemoveAll(s.dir)
+}
+
+// restart replaces a process that failed with err.
+func (s *RustSidecar) restart(err error) error {
+	s.stop()
+	s.restarts++
+	log.Printf("%s: restarting after %v", s.name, err)
+	if err := s.start(); err != nil {
+		log.Print(err)
+		return &SidecarCrashError{Err: err, StartFailed: true}
+	}
+	return &SidecarCrashError{Err: err}
+}
+
+// ensureStarted starts a process when the last restart failed.
+func (s *RustSidecar) ensureStarted() error {
+	if s.closed {
+		return errSidecarStopped
+	}
+	if s.conn == nil {
+		if err := s.start(); err != nil {
+			return &SidecarCrashError{Err: err, StartFailed: true}
+		}
+	}
+	return nil
+}
+
+// Close stops the process.
+func (s *RustSidecar) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stop()
+	s.closed = true
+}
+
+// Restarts returns how many times the process was replaced.
+func (s *RustSidecar) Restarts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.restarts
+}
+
+// sidecarField is a field of a response.
+type sidecarField struct {
+	data  string
+	flags uint32
+}
+
+// request sends a request and reads its response. When either fails, the
+// process is replaced and a *SidecarCrashError is returned.
+func (s *RustSidecar) request(op uint32, fields []string) ([]sidecarField, error) {
+	if err := s.ensureStarted(); err != nil {
+		return nil, err
+	}
+	responses, err := s.roundTrip(op, fields)
+	if err != nil {
+		return nil, s.restart(err)
+	}
+	if len(responses) != len(fields) && op < sidecarConfigure {
+		return nil, s.restart(fmt.Errorf("got %d fields for %d records", len(responses), len(fields)))
+	}
+	return responses, nil
+}
+
+func (s *RustSidecar) roundTrip(op uint32, fields []string) ([]sidecarField, error) {
+	var header [4]byte
+	writeU32 := func(v uint32) {
+		binary.LittleEndian.PutUint32(header[:], v)
+		s.writer.Write(header[:])
+	}
+	writeU32(op)
+	writeU32(uint32(len(fields)))
+	for _, field := range fields {
+		writeU32(uint32(len(field)))
+		s.writer.WriteString(field)
+	}
+	if err := s.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	readU32 := func() (uint32, error) {
+		if _, err := io.ReadFull(s.reader, header[:]); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint32(header[:]), nil
+	}
+	count, err := readU32()
+	if err != nil {
+		return nil, err
+	}
+	responses := make([]sidecarField, count)
+	for i := range responses {
+		length, err := readU32()
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length&^dynamicErrorFlag)
+		if _, err := io.ReadFull(s.reader, data); err != nil {
+			return nil, err
+		}
+		responses[i] = sidecarField{string(data), length & dynamicErrorFlag}
+	}
+	return responses, nil
+}
+
+// configure applies cfg to the process.
+func (s *RustSidecar) configure(cfg RegexConfig) error {
+	responses, err := s.roundTrip(sidecarConfigure, []string{cfg.Pattern, cfg.Replacement, strconv.Itoa(int(cfg.count()))})
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.name, err)
+	}
+	if len(responses) == 1 && responses[0].flags != 0 {
+		return fmt.Errorf("%s: %s", s.name, responses[0].data)
+	}
+	return nil
+}
+
+// compile makes source the VRL program of the process.
+func (s *RustSidecar) compile(source string) error {
+	responses, err := s.roundTrip(sidecarCompile, []string{source})
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.name, err)
+	}
+	if len(responses) == 1 && responses[0].flags != 0 {
+		return parseVrlCompileError([]byte(responses[0].data))
+	}
+	return nil
+}
+
+// compileVrl makes source the VRL program of this and every later process.
+func (s *RustSidecar) compileVrl(source string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ensureStarted(); err != nil {
+		return err
+	}
+	if err := s.compile(source); err != nil {
+		return err
+	}
+	s.program = source
+	return nil
+}
+
+// runBatch transforms records with a single request, and emits the results
+// in order, like streamRing. When the process crashed, every record is
+// emitted with a *SidecarCrashError.
+func (s *RustSidecar) runBatch(records []string, transform ringTransform, emit func(string, error)) {
+	s.mu.Lock()
+	responses, err := s.request(uint32(transform), records)
+	s.mu.Unlock()
+
+	if err != nil {
+		for range records {
+			emit("", err)
+		}
+		return
+	}
+	for _, response := range responses {
+		if response.flags&dynamicErrorFlag != 0 {
+			emit("", parseVrlRuntimeError([]byte(response.data)))
+		} else {
+			emit(response.data, nil)
+		}
+	}
+}
+
+// run transforms a single record.
+func (s *RustSidecar) run(record string, transform ringTransform) (output string, err error) {
+	s.runBatch([]string{record}, transform, func(o string, e error) {
+		output, err = o, e
+	})
+	return output, err
+}
+
+func (s *RustSidecar) runNoop(record string) (string, error) {
+	return s.run(record, ringNoop)
+}
+
+func (s *RustSidecar) runRegex(record string) (string, error) {
+	return s.run(record, ringRegex)
+}
+
+func (s *RustSidecar) runVrl(record string) (string, error) {
+	return s.run(record, ringVrl)
+}
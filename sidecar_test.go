@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestSidecarRestart(t *testing.T) {
+	s := NewRustSidecar()
+	defer s.Close()
+
+	if got, err := s.runRegex("abcd efghi"); got != "xxxx efghi" || err != nil {
+		t.Fatalf("got %q, %v, want %q", got, err, "xxxx efghi")
+	}
+
+	if err := s.process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	<-s.exited
+
+	var errs []error
+	s.runBatch([]string{"abcd", "efgh"}, ringRegex, func(_ string, err error) {
+		errs = append(errs, err)
+	})
+	var crashErr *SidecarCrashError
+	if len(errs) != 2 || !errors.As(errs[0], &crashErr) || !errors.As(errs[1], &crashErr) {
+		t.Fatalf("got %v, want a *SidecarCrashError for both records", errs)
+	}
+
+	if got, err := s.runRegex("abcd efghi"); got != "xxxx efghi" || err != nil {
+		t.Errorf("after the restart, got %q, %v, want %q", got, err, "xxxx efghi")
+	}
+	if s.Restarts() != 1 {
+		t.Errorf("got %d restarts, want 1", s.Restarts())
+	}
+}
+
+// TestSidecarStartFailed replaces the binary with one that doesn't exist
+// before the process crashes, so it can't be started again until the binary
+// is back.
+func TestSidecarStartFailed(t *testing.T) {
+	s := NewRustSidecar()
+	defer s.Close()
+
+	defer func(binary string) { sidecarBinary = binary }(sidecarBinary)
+	binary := sidecarBinary
+	sidecarBinary = filepath.Join(t.TempDir(), "missing")
+	if err := s.process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	<-s.exited
+
+	for i := 0; i < 2; i++ {
+		_, err := s.runRegex("abcd")
+		var crashErr *SidecarCrashError
+		if !errors.As(err, &crashErr) || !crashErr.StartFailed {
+			t.Fatalf("request %d: got %v, want a *SidecarCrashError that failed to start", i, err)
+		}
+	}
+
+	sidecarBinary = binary
+	if got, err := s.runRegex("abcd efghi"); got != "xxxx efghi" || err != nil {
+		t.Errorf("with the binary back, got %q, %v, want %q", got, err, "xxxx efghi")
+	}
+}
+
+func TestSidecarClose(t *testing.T) {
+	s := NewRustSidecar()
+	s.Close()
+
+	if _, err := s.runNoop("abcd"); err != errSidecarStopped {
+		t.Errorf("got %v, want %v", err, errSidecarStopped)
+	}
+}
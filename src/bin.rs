@@ -1,8 +1,107 @@
 mod lib;
 
+use std::io::{self, BufReader, BufWriter, Read, Write};
+use std::os::unix::net::UnixListener;
+
+// Requests of the sidecar protocol, see sidecar.go. The transforms are
+// numbered like those of ring_drain_wasm.
+const OP_NOOP: u32 = 0;
+const OP_REGEX: u32 = 1;
+const OP_VRL: u32 = 2;
+const OP_CONFIGURE: u32 = 3;
+const OP_COMPILE: u32 = 4;
+
+/// Set in the length of a response field that is an error.
+const ERROR_FLAG: u32 = 1 << 31;
+
 fn main() {
+    let args: Vec<String> = std::env::args().collect();
+    if args.len() == 3 && args[1] == "serve" {
+        if let Err(err) = serve(&args[2]) {
+            eprintln!("{}", err);
+            std::process::exit(1);
+        }
+        return;
+    }
+
     loop {
-        println!("{}", lib::run_vrl("{\"message\":\"abcd\"}"));
+        println!("{}", lib::run_vrl("{\"message\":\"abcd\"}").unwrap());
         //println!("{}", "{\"message\":\"rust\"}");
     }
 }
+
+/// Serves the sidecar protocol to the first connection on the Unix socket at
+/// `path`, until it is closed. Requests are handled on the main thread, so a
+/// panic ends the process and the host starts a new one.
+fn serve(path: &str) -> io::Result<()> {
+    let listener = UnixListener::bind(path)?;
+    let (stream, _) = listener.accept()?;
+    let mut reader = BufReader::new(stream.try_clone()?);
+    let mut writer = BufWriter::new(stream);
+
+    loop {
+        let op = match read_u32(&mut reader) {
+            Ok(op) => op,
+            Err(err) if err.kind() == io::ErrorKind::UnexpectedEof => return Ok(()),
+            Err(err) => return Err(err),
+        };
+        let count = read_u32(&mut reader)?;
+        let mut fields = Vec::with_capacity(count as usize);
+        for _ in 0..count {
+            let len = read_u32(&mut reader)?;
+            let mut field = vec![0u8; len as usize];
+            reader.read_exact(&mut field)?;
+            fields.push(String::from_utf8_lossy(&field).into_owned());
+        }
+
+        let responses = handle(op, fields)?;
+        write_u32(&mut writer, responses.len() as u32)?;
+        for (field, flags) in responses {
+            write_u32(&mut writer, field.len() as u32 | flags)?;
+            writer.write_all(field.as_bytes())?;
+        }
+        writer.flush()?;
+    }
+}
+
+/// Runs one request and returns the fields of its response, with their
+/// flags.
+fn handle(op: u32, fields: Vec<String>) -> io::Result<Vec<(String, u32)>> {
+    let status = |result: Result<(), String>| match result {
+        Ok(()) => vec![(String::new(), 0)],
+        Err(err) => vec![(err, ERROR_FLAG)],
+    };
+
+    Ok(match (op, fields.as_slice()) {
+        (OP_NOOP, _) => fields.into_iter().map(|field| (field, 0)).collect(),
+        (OP_REGEX, _) => fields.iter().map(|field| (lib::run_regex(field), 0)).collect(),
+        (OP_VRL, _) => fields
+            .iter()
+            .map(|field| match lib::run_vrl(field) {
+                Ok(output) => (output, 0),
+                Err(err) => (err, ERROR_FLAG),
+            })
+            .collect(),
+        (OP_CONFIGURE, [pattern, replacement, count]) => {
+            let count = count.parse().unwrap_or(0);
+            status(lib::configure_regex(pattern, replacement, count))
+        }
+        (OP_COMPILE, [source]) => status(lib::load_vrl(source)),
+        _ => {
+            return Err(io::Error::new(
+                io::ErrorKind::InvalidData,
+                format!("invalid request {} with {} fields", op, fields.len()),
+            ))
+        }
+    })
+}
+
+fn read_u32(reader: &mut impl Read) -> io::Result<u32> {
+    let mut buf = [0u8; 4];
+    reader.read_exact(&mut buf)?;
+    Ok(u32::from_le_bytes(buf))
+}
+
+fn write_u32(writer: &mut impl Write, value: u32) -> io::Result<()> {
+    writer.write_all(&value.to_le_bytes())
+}
@@ -2,43 +2,272 @@ extern crate alloc;
 use ::value::{Secrets, Value};
 use lazy_static::lazy_static;
 use regex::Regex;
+use serde_json::json;
+use std::borrow::Cow;
 use std::cell::RefCell;
-use std::collections::BTreeMap;
+use std::collections::{BTreeMap, HashMap};
 use std::ffi::CStr;
 use std::ffi::CString;
-use vrl::diagnostic::Formatter;
+use std::sync::RwLock;
+use vrl::diagnostic::{Diagnostic, DiagnosticMessage, Formatter};
 use vrl::Program;
 use vrl::TimeZone;
-use vrl::{state, Runtime, TargetValueRef};
+use vrl::{state, Runtime, TargetValueRef, Terminate};
 
 use alloc::vec::Vec;
 use std::mem::MaybeUninit;
 use std::slice;
 
+// The path keeps working when bin.rs includes this file as `mod lib`.
+#[cfg(not(target_arch = "wasm32"))]
+#[path = "workers.rs"]
+mod workers;
+
+// Must match `defaultRegexConfig` on the Go side.
+const DEFAULT_PATTERN: &str = r"\b\w{4}\b";
+const DEFAULT_REPLACEMENT: &str = "xxxx";
+
+/// The regex every regex transform applies, set from Go through [`configure`]
+/// or [`_configure_wasm`].
+struct RegexConfig {
+    re: Regex,
+    replacement: String,
+    // 0 replaces every match
+    count: usize,
+}
+
+impl RegexConfig {
+    fn new(pattern: &str, replacement: &str, count: usize) -> Result<RegexConfig, String> {
+        let re = Regex::new(&go_compatible_pattern(pattern)).map_err(|e| e.to_string())?;
+        Ok(RegexConfig {
+            re,
+            replacement: String::from(replacement),
+            count,
+        })
+    }
+
+    fn replace<'t>(&self, s: &'t str) -> Cow<'t, str> {
+        self.re.replacen(s, self.count, self.replacement.as_str())
+    }
+}
+
 lazy_static! {
-    static ref RE: Regex = Regex::new(r"\b\w{4}\b").unwrap();
-    static ref VRL_PROGRAM: Program = compile_vrl();
+    static ref REGEX: RwLock<RegexConfig> =
+        RwLock::new(RegexConfig::new(DEFAULT_PATTERN, DEFAULT_REPLACEMENT, 0).unwrap());
+    static ref VRL_PROGRAM: RwLock<LoadedProgram> = RwLock::new(
+        LoadedProgram::compile(
+            vrl_replace_program(DEFAULT_PATTERN, DEFAULT_REPLACEMENT, 0).unwrap()
+        )
+        .unwrap()
+    );
+    /// Programs loaded by name for the Go program registry, run with
+    /// [`run_named_vrl`] and [`run_named_vrl_event`].
+    static ref NAMED_VRL_PROGRAMS: RwLock<HashMap<String, LoadedProgram>> =
+        RwLock::new(HashMap::new());
+}
+
+/// A compiled VRL program, with its source kept to describe runtime errors.
+struct LoadedProgram {
+    program: Program,
+    source: String,
+}
+
+impl LoadedProgram {
+    fn compile(source: String) -> Result<LoadedProgram, String> {
+        let program = compile_vrl(&source)?;
+        Ok(LoadedProgram { program, source })
+    }
 }
 
 thread_local! {static RUNTIME: RefCell<Runtime> = RefCell::new(Runtime::new(state::Runtime::default()));}
 
-pub fn compile_vrl() -> Program {
-    // let program = r#"."#;
-    let program = r#". = replace(string!(.), r'\b\w{4}\b', "rust", 1)"#;
+/// Rewrites the Perl classes of a Go regexp pattern so they keep their ASCII
+/// meaning. The regex crate makes `\b`, `\w`, `\d` and `\s` Unicode-aware,
+/// which would make the Rust engines replace different words than Go.
+///
+/// The replacements are classes themselves, and the regex crate allows
+/// nesting classes, so they are also valid inside `[...]`.
+fn go_compatible_pattern(pattern: &str) -> String {
+    let mut out = String::with_capacity(pattern.len());
+    let mut chars = pattern.chars();
+    while let Some(c) = chars.next() {
+        if c != '\\' {
+            out.push(c);
+            continue;
+        }
+        match chars.next() {
+            Some('b') => out.push_str(r"(?-u:\b)"),
+            Some('w') => out.push_str("[[:word:]]"),
+            Some('W') => out.push_str("[[:^word:]]"),
+            Some('d') => out.push_str("[[:digit:]]"),
+            Some('D') => out.push_str("[[:^digit:]]"),
+            Some('s') => out.push_str(r"[\t\n\f\r ]"),
+            Some('S') => out.push_str(r"[^\t\n\f\r ]"),
+            Some(other) => {
+                out.push('\\');
+                out.push(other);
+            }
+            None => out.push('\\'),
+        }
+    }
+    out
+}
+
+/// Builds the VRL equivalent of the regex transform.
+fn vrl_replace_program(pattern: &str, replacement: &str, count: usize) -> Result<String, String> {
+    let pattern = go_compatible_pattern(pattern);
+    if pattern.contains('\'') {
+        return Err(String::from("VRL regex literals cannot contain '"));
+    }
+    // VRL uses -1 for "replace every match"
+    let count = if count == 0 { -1 } else { count as i64 };
+    let replacement = serde_json::to_string(replacement).unwrap();
+    let replace = |path: &str| {
+        format!(
+            "replace(string!({}), r'{}', {}, {})",
+            path, pattern, replacement, count
+        )
+    };
+    // Plain strings are replaced as a whole, structured events only have
+    // their message replaced.
+    Ok(format!(
+        "if is_string(.) {{ . = {} }} else {{ .message = {} }}",
+        replace("."),
+        replace(".message")
+    ))
+}
+
+fn compile_vrl_program(source: &str) -> Result<Program, Vec<Diagnostic>> {
     let functions = vrl_stdlib::all();
-    match vrl::compile(&program, &functions) {
-        Ok(res) => res.program,
-        Err(err) => {
-            let f = Formatter::new(&"", err);
-            panic!("{:#}", f)
+    match vrl::compile(source, &functions) {
+        Ok(res) => Ok(res.program),
+        Err(err) => Err(err.into()),
+    }
+}
+
+pub fn compile_vrl(program: &str) -> Result<Program, String> {
+    compile_vrl_program(program).map_err(|err| format!("{:#}", Formatter::new(program, err)))
+}
+
+/// Renders compiler diagnostics as JSON, for Go to decode into a
+/// `VrlCompileError`. Spans are byte offsets into `source`.
+fn diagnostics_json(source: &str, diagnostics: Vec<Diagnostic>) -> String {
+    let list: Vec<serde_json::Value> = diagnostics
+        .iter()
+        .map(|d| {
+            let labels: Vec<serde_json::Value> = d
+                .labels
+                .iter()
+                .map(|l| {
+                    json!({
+                        "message": l.message,
+                        "primary": l.primary,
+                        "start": l.span.start(),
+                        "end": l.span.end(),
+                    })
+                })
+                .collect();
+            json!({
+                "severity": format!("{:?}", d.severity).to_lowercase(),
+                "code": d.code,
+                "message": d.message,
+                "labels": labels,
+            })
+        })
+        .collect();
+
+    json!({
+        "formatted": format!("{:#}", Formatter::new(source, diagnostics)),
+        "diagnostics": list,
+    })
+    .to_string()
+}
+
+/// Compiles `source` and makes it the program run by [`run_vrl`]. On failure
+/// the previous program keeps running and the diagnostics are returned as
+/// JSON.
+pub fn load_vrl(source: &str) -> Result<(), String> {
+    match compile_vrl_program(source) {
+        Ok(program) => {
+            *VRL_PROGRAM.write().unwrap() = LoadedProgram {
+                program,
+                source: String::from(source),
+            };
+            Ok(())
         }
+        Err(diagnostics) => Err(diagnostics_json(source, diagnostics)),
     }
 }
 
-pub fn run_vrl(s: &str) -> String {
-    let mut value: Value = Value::from(s);
-    let mut metadata = Value::Object(BTreeMap::new());
-    let mut secrets = Secrets::new();
+/// Compiles `source` as the program called `name`, replacing any program
+/// with that name. Errors are returned as for [`load_vrl`].
+pub fn load_named_vrl(name: &str, source: &str) -> Result<(), String> {
+    match compile_vrl_program(source) {
+        Ok(program) => {
+            NAMED_VRL_PROGRAMS.write().unwrap().insert(
+                String::from(name),
+                LoadedProgram {
+                    program,
+                    source: String::from(source),
+                },
+            );
+            Ok(())
+        }
+        Err(diagnostics) => Err(diagnostics_json(source, diagnostics)),
+    }
+}
+
+/// Runs the regex replacement set with [`configure_regex`] on `s`.
+pub fn run_regex(s: &str) -> String {
+    REGEX.read().unwrap().replace(s).into_owned()
+}
+
+/// Replaces the pattern used by the regex transforms and the VRL program.
+/// Nothing changes if either fails to compile.
+pub fn configure_regex(pattern: &str, replacement: &str, count: usize) -> Result<(), String> {
+    let regex = RegexConfig::new(pattern, replacement, count)?;
+    let program = LoadedProgram::compile(vrl_replace_program(pattern, replacement, count)?)?;
+
+    *REGEX.write().unwrap() = regex;
+    *VRL_PROGRAM.write().unwrap() = program;
+    Ok(())
+}
+
+/// Runs the VRL program with `value` as the event and returns the event as
+/// the program left it.
+fn resolve_vrl(value: Value) -> Result<Value, String> {
+    resolve_program(&VRL_PROGRAM.read().unwrap(), value)
+}
+
+/// Runs `loaded` with `value` as the event and returns the event as the
+/// program left it.
+fn resolve_program(loaded: &LoadedProgram, value: Value) -> Result<Value, String> {
+    let (value, _) = resolve_program_target(
+        loaded,
+        value,
+        Value::Object(BTreeMap::new()),
+        Secrets::new(),
+    )?;
+    Ok(value)
+}
+
+/// Runs the VRL program on an event with its metadata and secrets, and
+/// returns the event and metadata as the program left them. Runtime errors
+/// are returned as JSON, see [`runtime_error_json`].
+fn resolve_vrl_target(
+    value: Value,
+    metadata: Value,
+    secrets: Secrets,
+) -> Result<(Value, Value), String> {
+    resolve_program_target(&VRL_PROGRAM.read().unwrap(), value, metadata, secrets)
+}
+
+fn resolve_program_target(
+    loaded: &LoadedProgram,
+    mut value: Value,
+    mut metadata: Value,
+    mut secrets: Secrets,
+) -> Result<(Value, Value), String> {
     let mut target = TargetValueRef {
         value: &mut value,
         metadata: &mut metadata,
@@ -46,19 +275,288 @@ pub fn run_vrl(s: &str) -> String {
     };
 
     let output = RUNTIME.with(|r| {
-        // r.borrow_mut().clear();
-        return r
-            .borrow_mut()
-            .resolve(&mut target, &VRL_PROGRAM, &TimeZone::Local);
+        let mut runtime = r.borrow_mut();
+        let output = runtime.resolve(&mut target, &loaded.program, &TimeZone::Local);
+        // A failed program can leave state behind for the next event.
+        if output.is_err() {
+            runtime.clear();
+        }
+        output
     });
 
-    return output.unwrap().to_string();
+    match output {
+        Ok(_) => Ok((value, metadata)),
+        Err(Terminate::Abort(err)) => Err(runtime_error_json("abort", &err, &loaded.source)),
+        Err(Terminate::Error(err)) => Err(runtime_error_json("error", &err, &loaded.source)),
+    }
+}
+
+/// Describes a runtime error as JSON, for Go to decode into a
+/// `VrlRuntimeError`. The span is a byte range of the program source, and
+/// `function` is the name of the function called there, if any.
+fn runtime_error_json(kind: &str, err: &impl DiagnosticMessage, source: &str) -> String {
+    let labels = err.labels();
+    let span = labels
+        .iter()
+        .find(|l| l.primary)
+        .or_else(|| labels.first())
+        .map(|l| (l.span.start(), l.span.end()));
+
+    let function = span
+        .and_then(|(start, end)| source.get(start..end))
+        .and_then(|call| call.split_once('('))
+        .map(|(name, _)| name.trim().trim_end_matches('!'))
+        .filter(|name| !name.is_empty() && name.chars().all(|c| c.is_alphanumeric() || c == '_'));
+
+    json!({
+        "kind": kind,
+        "code": err.code(),
+        "message": err.message(),
+        "function": function,
+        "start": span.map(|(start, _)| start),
+        "end": span.map(|(_, end)| end),
+    })
+    .to_string()
+}
+
+/// Describes input that could not be turned into an event, or output that
+/// can't be returned as a C string, in the same JSON shape as
+/// [`runtime_error_json`].
+fn invalid_input_json(err: impl std::fmt::Display) -> String {
+    json!({
+        "kind": "invalid_input",
+        "code": 0,
+        "message": err.to_string(),
+    })
+    .to_string()
+}
+
+/// Describes a call to a named program that was never loaded, in the same
+/// JSON shape as [`runtime_error_json`].
+fn unknown_program_json(name: &str) -> String {
+    json!({
+        "kind": "unknown_program",
+        "code": 0,
+        "message": format!("no VRL program named {:?}", name),
+    })
+    .to_string()
+}
+
+pub fn run_vrl(s: &str) -> Result<String, String> {
+    Ok(vrl_output_string(resolve_vrl(Value::from(s))?))
+}
+
+// Return strings as-is rather than their quoted VRL representation, so the
+// output can be compared with the other engines.
+fn vrl_output_string(value: Value) -> String {
+    match value {
+        Value::Bytes(bytes) => String::from_utf8_lossy(&bytes).into_owned(),
+        value => value_to_json(value).to_string(),
+    }
+}
+
+/// [`run_vrl`] with the program called `name`.
+pub fn run_named_vrl(name: &str, s: &str) -> Result<String, String> {
+    let programs = NAMED_VRL_PROGRAMS.read().unwrap();
+    let loaded = programs
+        .get(name)
+        .ok_or_else(|| unknown_program_json(name))?;
+    Ok(vrl_output_string(resolve_program(loaded, Value::from(s))?))
+}
+
+/// [`run_vrl_event`] with the program called `name`.
+pub fn run_named_vrl_event(name: &str, json: &str) -> Result<String, String> {
+    let event: serde_json::Value = serde_json::from_str(json).map_err(invalid_input_json)?;
+    let programs = NAMED_VRL_PROGRAMS.read().unwrap();
+    let loaded = programs
+        .get(name)
+        .ok_or_else(|| unknown_program_json(name))?;
+    Ok(value_to_json(resolve_program(loaded, json_to_value(event))?).to_string())
+}
+
+/// Runs the VRL program on an event encoded as JSON, so the program can
+/// address fields such as `.message`, and returns the resulting event as JSON.
+pub fn run_vrl_event(json: &str) -> Result<String, String> {
+    let event: serde_json::Value = serde_json::from_str(json).map_err(invalid_input_json)?;
+    Ok(value_to_json(resolve_vrl(json_to_value(event))?).to_string())
+}
+
+/// Runs the VRL program on a target encoded as JSON:
+/// `{"event": ..., "metadata": {...}, "secrets": {"name": "value"}}`.
+/// Returns `{"event": ..., "metadata": {...}}` as the program left them.
+pub fn run_vrl_target(json: &str) -> Result<String, String> {
+    let mut target: serde_json::Value = serde_json::from_str(json).map_err(invalid_input_json)?;
+
+    let event = json_to_value(target["event"].take());
+    let metadata = match target["metadata"].take() {
+        serde_json::Value::Null => Value::Object(BTreeMap::new()),
+        metadata => json_to_value(metadata),
+    };
+    let mut secrets = Secrets::new();
+    if let serde_json::Value::Object(map) = target["secrets"].take() {
+        for (name, secret) in map {
+            if let serde_json::Value::String(secret) = secret {
+                secrets.insert(name, secret.as_str());
+            }
+        }
+    }
+
+    let (event, metadata) = resolve_vrl_target(event, metadata, secrets)?;
+    Ok(json!({
+        "event": value_to_json(event),
+        "metadata": value_to_json(metadata),
+    })
+    .to_string())
+}
+
+fn json_to_value(json: serde_json::Value) -> Value {
+    match json {
+        serde_json::Value::Null => Value::Null,
+        serde_json::Value::Bool(b) => Value::Boolean(b),
+        serde_json::Value::Number(n) => match n.as_i64() {
+            Some(i) => Value::Integer(i),
+            None => Value::from_f64_or_zero(n.as_f64().unwrap_or_default()),
+        },
+        serde_json::Value::String(s) => Value::from(s),
+        serde_json::Value::Array(a) => Value::Array(a.into_iter().map(json_to_value).collect()),
+        serde_json::Value::Object(o) => {
+            Value::Object(o.into_iter().map(|(k, v)| (k, json_to_value(v))).collect())
+        }
+    }
+}
+
+fn value_to_json(value: Value) -> serde_json::Value {
+    match value {
+        Value::Null => serde_json::Value::Null,
+        Value::Boolean(b) => json!(b),
+        Value::Integer(i) => json!(i),
+        Value::Float(f) => json!(f.into_inner()),
+        Value::Bytes(b) => json!(String::from_utf8_lossy(&b)),
+        Value::Timestamp(ts) => json!(ts.to_rfc3339()),
+        Value::Array(a) => serde_json::Value::Array(a.into_iter().map(value_to_json).collect()),
+        Value::Object(o) => {
+            serde_json::Value::Object(o.into_iter().map(|(k, v)| (k, value_to_json(v))).collect())
+        }
+        // Regexes have no JSON equivalent
+        other => json!(other.to_string()),
+    }
+}
+
+/// What the VRL FFI functions return: exactly one of `output` and `error` is
+/// set, and the caller must free it. `error` is a runtime error as JSON.
+#[repr(C)]
+pub struct VrlResult {
+    output: *const libc::c_char,
+    error: *const libc::c_char,
+}
+
+impl From<Result<String, String>> for VrlResult {
+    fn from(result: Result<String, String>) -> VrlResult {
+        // An output holding a NUL byte is an error rather than a panic, which
+        // would abort the Go process.
+        match result.and_then(|output| CString::new(output).map_err(invalid_input_json)) {
+            Ok(output) => VrlResult {
+                output: output.into_raw(),
+                error: std::ptr::null(),
+            },
+            Err(err) => VrlResult {
+                output: std::ptr::null(),
+                // The errors are JSON, which escapes NUL bytes.
+                error: CString::new(err.replace('\0', ""))
+                    .expect("NUL bytes were removed")
+                    .into_raw(),
+            },
+        }
+    }
+}
+
+/// Reads a string argument of the FFI functions. Records come from UDS and
+/// TCP clients and programs from files, so they may not be UTF-8.
+unsafe fn input_str<'a>(input: *const libc::c_char) -> Result<&'a str, String> {
+    CStr::from_ptr(input).to_str().map_err(invalid_input_json)
+}
+
+/// Sets the pattern, replacement and maximum number of replacements (0 for
+/// all) used by [`transform`] and [`transform_vrl`]. Returns NULL on success,
+/// or an error message that the caller must free: the invalid_input JSON if
+/// an argument is not UTF-8.
+#[no_mangle]
+pub extern "C" fn configure(
+    pattern: *const libc::c_char,
+    replacement: *const libc::c_char,
+    count: u32,
+) -> *const libc::c_char {
+    match unsafe {
+        input_str(pattern)
+            .and_then(|pattern| configure_regex(pattern, input_str(replacement)?, count as usize))
+    } {
+        Ok(()) => std::ptr::null(),
+        Err(err) => CString::new(err).expect("CString::new failed").into_raw(),
+    }
+}
+
+/// Compiles the VRL program in `source` and runs it for every following
+/// [`transform_vrl`] call. Returns NULL on success, or the compiler
+/// diagnostics as JSON, which the caller must free. A source that is not
+/// UTF-8 returns the invalid_input JSON instead.
+#[no_mangle]
+pub extern "C" fn compile(source: *const libc::c_char) -> *const libc::c_char {
+    match unsafe { input_str(source) }.and_then(load_vrl) {
+        Ok(()) => std::ptr::null(),
+        Err(err) => CString::new(err).expect("CString::new failed").into_raw(),
+    }
+}
+
+/// Compiles `source` as the program called `name`, for
+/// [`transform_vrl_named`] and [`transform_vrl_event_named`]. Returns as
+/// [`compile`] does.
+#[no_mangle]
+pub extern "C" fn compile_named(
+    name: *const libc::c_char,
+    source: *const libc::c_char,
+) -> *const libc::c_char {
+    match unsafe { input_str(name).and_then(|name| load_named_vrl(name, input_str(source)?)) } {
+        Ok(()) => std::ptr::null(),
+        Err(err) => CString::new(err).expect("CString::new failed").into_raw(),
+    }
+}
+
+#[no_mangle]
+pub extern "C" fn transform_vrl_named(
+    name: *const libc::c_char,
+    input: *const libc::c_char,
+) -> VrlResult {
+    VrlResult::from(unsafe {
+        input_str(name).and_then(|name| run_named_vrl(name, input_str(input)?))
+    })
+}
+
+#[no_mangle]
+pub extern "C" fn transform_vrl_event_named(
+    name: *const libc::c_char,
+    input: *const libc::c_char,
+) -> VrlResult {
+    VrlResult::from(unsafe {
+        input_str(name).and_then(|name| run_named_vrl_event(name, input_str(input)?))
+    })
+}
+
+#[no_mangle]
+pub extern "C" fn transform_vrl_event(input: *const libc::c_char) -> VrlResult {
+    VrlResult::from(unsafe { input_str(input) }.and_then(run_vrl_event))
+}
+
+#[no_mangle]
+pub extern "C" fn transform_vrl_target(input: *const libc::c_char) -> VrlResult {
+    VrlResult::from(unsafe { input_str(input) }.and_then(run_vrl_target))
 }
 
 #[no_mangle]
 pub extern "C" fn transform(input: *const libc::c_char) -> *const libc::c_char {
     let inpt: &CStr = unsafe { CStr::from_ptr(input) };
-    let replaced = RE.replacen(inpt.to_str().unwrap(), 1, "rust");
+    // Invalid UTF-8 is replaced rather than aborting the Go process.
+    let inpt = inpt.to_string_lossy();
+    let replaced = REGEX.read().unwrap().replace(&inpt);
     let c_str = CString::new(replaced.as_bytes()).expect("CString::new failed");
     return c_str.into_raw();
 }
@@ -66,62 +564,189 @@ pub extern "C" fn transform(input: *const libc::c_char) -> *const libc::c_char {
 #[no_mangle]
 pub extern "C" fn noop(input: *const libc::c_char) -> *const libc::c_char {
     let inpt: &CStr = unsafe { CStr::from_ptr(input) };
-    let c_str = CString::new(inpt.to_str().unwrap()).expect("CString::new failed");
+    let c_str = CString::new(inpt.to_bytes()).expect("CString::new failed");
     return c_str.into_raw();
 }
 
 #[no_mangle]
-pub extern "C" fn transform_vrl(input: *const libc::c_char) -> *const libc::c_char {
-    let inpt: &CStr = unsafe { CStr::from_ptr(input) };
-    let output = run_vrl(inpt.to_str().unwrap());
-    let c_str = CString::new(output.as_bytes()).expect("CString::new failed");
-    return c_str.into_raw();
+pub extern "C" fn transform_vrl(input: *const libc::c_char) -> VrlResult {
+    VrlResult::from(unsafe { input_str(input) }.and_then(run_vrl))
 }
 
 // Wasm Integration Below
 //
 /// WebAssembly export that accepts a string (linear memory offset, byteCount)
-/// and creates a copy, then writes that copy back into the same place in
-/// memory. It returns the length of the string that was just written.
+/// in a buffer of `capacity` bytes and replaces the regex in it, then writes
+/// the result back into the same place in memory. See [`store_output`] for
+/// the return value.
 ///
 #[cfg_attr(all(target_arch = "wasm32"), export_name = "regex_wasm")]
 #[no_mangle]
-pub unsafe extern "C" fn _regex_wasm(ptr: u32, len: u32) -> u32 {
+pub unsafe extern "C" fn _regex_wasm(ptr: u32, len: u32, capacity: u32) -> u32 {
     let name = &ptr_to_string(ptr, len);
 
-    let output = RE.replacen(name, 1, "rust");
-    store_string_at_ptr(&output, ptr);
+    let output = REGEX.read().unwrap().replace(name);
+    store_output(&output, ptr, capacity)
+}
 
-    output.len() as u32
+/// WebAssembly export that sets the regex used by `regex_wasm` and `vrl_wasm`.
+/// The pattern and replacement are written back to back at `ptr`. Returns 0
+/// on success, or the length of an error message written at `ptr`, truncated
+/// to `capacity` bytes.
+#[cfg_attr(all(target_arch = "wasm32"), export_name = "configure_wasm")]
+#[no_mangle]
+pub unsafe extern "C" fn _configure_wasm(
+    ptr: u32,
+    pattern_len: u32,
+    replacement_len: u32,
+    count: u32,
+    capacity: u32,
+) -> u32 {
+    let pattern = ptr_to_string(ptr, pattern_len);
+    let replacement = ptr_to_string(ptr + pattern_len, replacement_len);
+
+    match configure_regex(&pattern, &replacement, count as usize) {
+        Ok(()) => 0,
+        Err(mut err) => {
+            truncate_string(&mut err, capacity as usize);
+            store_string_at_ptr(&err, ptr);
+            err.len() as u32
+        }
+    }
 }
 /// WebAssembly export that accepts a string (linear memory offset, byteCount)
-/// and creates a copy, then writes that copy back into the same place in
-/// memory. It returns the length of the string that was just written.
-///
+/// in a buffer of `capacity` bytes, runs the VRL program on it, then writes
+/// the result back into the same place in memory. See [`store_vrl_result`]
+/// for the return value.
 #[cfg_attr(all(target_arch = "wasm32"), export_name = "vrl_wasm")]
 #[no_mangle]
-pub unsafe extern "C" fn _vrl_wasm_buffered(ptr: u32, len: u32) -> u32 {
+pub unsafe extern "C" fn _vrl_wasm_buffered(ptr: u32, len: u32, capacity: u32) -> u64 {
     let name = &ptr_to_string(ptr, len);
 
-    let output = run_vrl(name);
-    store_string_at_ptr(&output, ptr);
+    store_vrl_result(run_vrl(name), ptr, capacity)
+}
 
-    output.len() as u32
+/// WebAssembly export that accepts a JSON event (linear memory offset,
+/// byteCount) in a buffer of `capacity` bytes, runs the VRL program on it,
+/// then writes the resulting event back into the same place in memory. See
+/// [`store_vrl_result`] for the return value.
+#[cfg_attr(all(target_arch = "wasm32"), export_name = "vrl_event_wasm")]
+#[no_mangle]
+pub unsafe extern "C" fn _vrl_event_wasm_buffered(ptr: u32, len: u32, capacity: u32) -> u64 {
+    let event = &ptr_to_string(ptr, len);
+
+    store_vrl_result(run_vrl_event(event), ptr, capacity)
+}
+
+/// WebAssembly export that accepts a JSON target (linear memory offset,
+/// byteCount) in a buffer of `capacity` bytes, holding an event, its metadata
+/// and secrets, runs the VRL program on it, then writes the resulting event
+/// and metadata back into the same place in memory. See [`store_vrl_result`]
+/// for the return value.
+#[cfg_attr(all(target_arch = "wasm32"), export_name = "vrl_target_wasm")]
+#[no_mangle]
+pub unsafe extern "C" fn _vrl_target_wasm_buffered(ptr: u32, len: u32, capacity: u32) -> u64 {
+    let target = &ptr_to_string(ptr, len);
+
+    store_vrl_result(run_vrl_target(target), ptr, capacity)
 }
 
 /// WebAssembly export that accepts a string (linear memory offset, byteCount)
-/// and creates a copy, then writes that copy back into the same place in
-/// memory. It returns the length of the string that was just written.
+/// in a buffer of `capacity` bytes and creates a copy, then writes that copy
+/// back into the same place in memory. See [`store_output`] for the return
+/// value.
 ///
 #[cfg_attr(all(target_arch = "wasm32"), export_name = "noop_wasm")]
 #[no_mangle]
-pub unsafe extern "C" fn _noop_wasm_buffered(ptr: u32, len: u32) -> u32 {
+pub unsafe extern "C" fn _noop_wasm_buffered(ptr: u32, len: u32, capacity: u32) -> u32 {
     let name = &ptr_to_string(ptr, len);
     let new_string = String::from(name); // the no-op
-    store_string_at_ptr(&new_string, ptr);
+    store_output(&new_string, ptr, capacity)
+}
+/// Functions the host provides to wasm guests, see `hostModule` in
+/// hostfuncs.go.
+#[cfg(target_arch = "wasm32")]
+mod host {
+    #[link(wasm_import_module = "host")]
+    extern "C" {
+        pub fn log(level: u32, ptr: u32, len: u32);
+        pub fn metric(name_ptr: u32, name_len: u32, value: f64);
+        pub fn kv_lookup(key_ptr: u32, key_len: u32, value_ptr: u32, value_cap: u32) -> i32;
+        pub fn now() -> i64;
+    }
 
-    new_string.len() as u32
+    pub const WARN: u32 = 2;
 }
+
+/// WebAssembly export that accepts a string (linear memory offset, byteCount)
+/// in a buffer of `capacity` bytes and looks its second " | " separated field
+/// up with the host's `kv_lookup`, then writes the string with the value
+/// appended back into the same place in memory. See [`store_output`] for the
+/// return value. The lookup time is recorded with the host's `metric`.
+#[cfg(target_arch = "wasm32")]
+#[export_name = "enrich_wasm"]
+pub unsafe extern "C" fn _enrich_wasm(ptr: u32, len: u32, capacity: u32) -> u32 {
+    let line = ptr_to_string(ptr, len);
+    let key = match line.split(" | ").nth(1) {
+        Some(key) => key,
+        None => return len,
+    };
+
+    let lookup = |value: &mut Vec<u8>| {
+        host::kv_lookup(
+            key.as_ptr() as u32,
+            key.len() as u32,
+            value.as_mut_ptr() as u32,
+            value.len() as u32,
+        )
+    };
+    let mut value = vec![0u8; 256];
+    let start = host::now();
+    let mut value_len = lookup(&mut value);
+    if value_len > value.len() as i32 {
+        // kv_lookup returns the length of the whole value, so look it up
+        // again with room for all of it.
+        value.resize(value_len as usize, 0);
+        value_len = lookup(&mut value);
+    }
+    let name = "enrich_lookup_ns";
+    host::metric(
+        name.as_ptr() as u32,
+        name.len() as u32,
+        (host::now() - start) as f64,
+    );
+
+    let value = if value_len < 0 {
+        let msg = format!("no enrichment for {:?}", key);
+        host::log(host::WARN, msg.as_ptr() as u32, msg.len() as u32);
+        "unknown"
+    } else {
+        // Only cut when the value grew between the lookups.
+        let end = (value_len as usize).min(value.len());
+        std::str::from_utf8(&value[..end]).unwrap_or("unknown")
+    };
+
+    let output = format!("{} | {}", line, value);
+    store_output(&output, ptr, capacity)
+}
+
+/// WebAssembly export that compiles the VRL program at (linear memory offset,
+/// byteCount) and runs it for every following `vrl_wasm` call. Returns 0 on
+/// success, or the pointer/size pair of the JSON diagnostics packed into a
+/// u64.
+///
+/// Note: The diagnostics are leaked to the caller, so it must call
+/// [`deallocate`] when finished.
+#[cfg_attr(all(target_arch = "wasm32"), export_name = "compile_vrl_wasm")]
+#[no_mangle]
+pub unsafe extern "C" fn _compile_vrl_wasm(ptr: u32, len: u32) -> u64 {
+    let source = ptr_to_string(ptr, len);
+    match load_vrl(&source) {
+        Ok(()) => 0,
+        Err(err) => leak_string(err),
+    }
+}
+
 /// WebAssembly export that accepts a string (linear memory offset, byteCount)
 /// and returns a pointer/size pair packed into a u64.
 ///
@@ -145,6 +770,173 @@ pub unsafe extern "C" fn _noop_wasm(ptr: u32, len: u32) -> u64 {
     return ((ptr as u64) << 32) | len as u64;
 }
 
+/// WebAssembly export that accepts a string (linear memory offset, byteCount)
+/// and returns the regex replacement as a pointer/size pair packed into a u64.
+///
+/// Note: The return value is leaked to the caller, so it must call
+/// [`deallocate`] when finished.
+#[cfg_attr(
+    all(target_arch = "wasm32"),
+    export_name = "regex_wasm_dynamic_allocation"
+)]
+#[no_mangle]
+pub unsafe extern "C" fn _regex_wasm_dynamic_allocation(ptr: u32, len: u32) -> u64 {
+    let input = &ptr_to_string(ptr, len);
+    let output = REGEX.read().unwrap().replace(input).into_owned();
+    leak_string(output)
+}
+
+/// WebAssembly export that accepts a string (linear memory offset, byteCount),
+/// runs the VRL program on it and returns the output as a pointer/size pair
+/// packed into a u64. The top bit of the size is set when the output is a
+/// runtime error as JSON.
+///
+/// Note: The return value is leaked to the caller, so it must call
+/// [`deallocate`] when finished, with the size without that bit.
+#[cfg_attr(
+    all(target_arch = "wasm32"),
+    export_name = "vrl_wasm_dynamic_allocation"
+)]
+#[no_mangle]
+pub unsafe extern "C" fn _vrl_wasm_dynamic_allocation(ptr: u32, len: u32) -> u64 {
+    let input = &ptr_to_string(ptr, len);
+    match run_vrl(input) {
+        Ok(output) => leak_string(output),
+        Err(err) => leak_string(err) | DYNAMIC_ERROR_FLAG,
+    }
+}
+
+/// Set in the size returned by `vrl_wasm_dynamic_allocation` when the output
+/// is an error.
+const DYNAMIC_ERROR_FLAG: u64 = 1 << 31;
+
+// Ring buffers shared with the host, see ring.go for their layout.
+const RING_IN_CAPACITY: u32 = 0;
+const RING_IN_HEAD: u32 = 4;
+const RING_IN_TAIL: u32 = 8;
+const RING_OUT_CAPACITY: u32 = 12;
+const RING_OUT_HEAD: u32 = 16;
+const RING_OUT_TAIL: u32 = 20;
+const RING_HEADER_SIZE: u32 = 24;
+const RING_WRAP: u32 = u32::MAX;
+/// Set in the length of the empty record written for an output that doesn't
+/// fit in the output ring even when it is empty.
+const RING_TOO_BIG_FLAG: u32 = 1 << 30;
+
+/// WebAssembly export that runs a transform on the records of the input ring
+/// at `ring` and writes the results to its output ring, until the input is
+/// empty or the output is full. `transform` is 0 for the no-op, 1 for the
+/// regex and 2 for the VRL program, whose runtime errors are written as JSON
+/// with [`DYNAMIC_ERROR_FLAG`] set in their length. An output too big for the
+/// output ring is replaced by an empty record with [`RING_TOO_BIG_FLAG`] set.
+/// Returns the number of records taken from the input ring.
+#[cfg_attr(all(target_arch = "wasm32"), export_name = "ring_drain_wasm")]
+#[no_mangle]
+pub unsafe extern "C" fn _ring_drain_wasm(ring: u32, transform: u32) -> u32 {
+    let in_capacity = ring_field(ring, RING_IN_CAPACITY);
+    let out_capacity = ring_field(ring, RING_OUT_CAPACITY);
+    let in_data = ring + RING_HEADER_SIZE;
+    let out_data = in_data + in_capacity;
+
+    let mut taken = 0;
+    loop {
+        let mut head = ring_field(ring, RING_IN_HEAD);
+        if head == ring_field(ring, RING_IN_TAIL) {
+            break;
+        }
+        let mut offset = head % in_capacity;
+        let mut len = ring_u32(in_data + offset);
+        if len == RING_WRAP {
+            head = head.wrapping_add(in_capacity - offset);
+            offset = 0;
+            len = ring_u32(in_data);
+        }
+
+        let input = ptr_to_string(in_data + offset + 4, len);
+        let (mut output, mut flags) = match transform {
+            0 => (input, 0),
+            1 => (REGEX.read().unwrap().replace(&input).into_owned(), 0),
+            _ => match run_vrl(&input) {
+                Ok(output) => (output, 0),
+                Err(err) => (err, DYNAMIC_ERROR_FLAG as u32),
+            },
+        };
+        // Capacities are multiples of 4, so this is the biggest record that
+        // fits. Waiting for room would never let a bigger one through.
+        if output.len() > (out_capacity - 4) as usize {
+            output = String::new();
+            flags = RING_TOO_BIG_FLAG;
+        }
+        // When the output doesn't fit, the record stays in the input ring
+        // and is transformed again by the next call.
+        if !ring_push(ring, out_data, &output, flags) {
+            break;
+        }
+        set_ring_field(ring, RING_IN_HEAD, head.wrapping_add(ring_record_size(len)));
+        taken += 1;
+    }
+    taken
+}
+
+/// Writes `record` to the output ring at `ring`, whose data starts at `data`.
+/// Returns false when it doesn't fit.
+unsafe fn ring_push(ring: u32, data: u32, record: &str, flags: u32) -> bool {
+    let capacity = ring_field(ring, RING_OUT_CAPACITY);
+    let mut head = ring_field(ring, RING_OUT_HEAD);
+    let mut tail = ring_field(ring, RING_OUT_TAIL);
+    if head == tail && tail % capacity != 0 {
+        // Start an empty ring over at the beginning of its data, so any
+        // record up to its capacity fits.
+        tail = tail.wrapping_add(capacity - tail % capacity);
+        head = tail;
+        set_ring_field(ring, RING_OUT_HEAD, head);
+    }
+
+    let size = ring_record_size(record.len() as u32);
+    let mut offset = tail % capacity;
+    let skip = if size > capacity - offset {
+        capacity - offset
+    } else {
+        0
+    };
+    if tail.wrapping_sub(head) as u64 + skip as u64 + size as u64 > capacity as u64 {
+        set_ring_field(ring, RING_OUT_TAIL, tail);
+        return false;
+    }
+
+    if skip > 0 {
+        set_ring_u32(data + offset, RING_WRAP);
+        tail = tail.wrapping_add(skip);
+        offset = 0;
+    }
+    set_ring_u32(data + offset, record.len() as u32 | flags);
+    store_string_at_ptr(record, data + offset + 4);
+    set_ring_field(ring, RING_OUT_TAIL, tail.wrapping_add(size));
+    true
+}
+
+/// Returns the size of a ring record of `len` bytes, with its length.
+fn ring_record_size(len: u32) -> u32 {
+    4 + ((len + 3) & !3)
+}
+
+unsafe fn ring_field(ring: u32, field: u32) -> u32 {
+    ring_u32(ring + field)
+}
+
+unsafe fn set_ring_field(ring: u32, field: u32, value: u32) {
+    set_ring_u32(ring + field, value)
+}
+
+/// Reads the little-endian u32 at `ptr`, which may be unaligned.
+unsafe fn ring_u32(ptr: u32) -> u32 {
+    u32::from_le(std::ptr::read_unaligned(ptr as *const u32))
+}
+
+unsafe fn set_ring_u32(ptr: u32, value: u32) {
+    std::ptr::write_unaligned(ptr as *mut u32, value.to_le())
+}
+
 // WASM String-related helper functions
 /// Returns a string from WebAssembly compatible numeric types representing
 /// its pointer and length.
@@ -155,7 +947,8 @@ unsafe fn ptr_to_string(ptr: u32, len: u32) -> String {
 }
 
 /// Stores the given string 's' at the memory location pointed to by 'ptr'
-/// This assumes no buffer overflows - here be dragons.
+/// This assumes no buffer overflows - here be dragons. Transforms writing to
+/// the host's buffer use [`store_output`] instead.
 unsafe fn store_string_at_ptr(s: &str, ptr: u32) {
     // Create a mutable slice of u8 pointing at the buffer given as 'ptr'
     // with a length of the string we're about to copy into it
@@ -163,6 +956,48 @@ unsafe fn store_string_at_ptr(s: &str, ptr: u32) {
     dest.copy_from_slice(s.as_bytes());
 }
 
+/// Stores `output` at `ptr` if it fits the buffer of `capacity` bytes there.
+/// Returns its length either way, so a length over `capacity` tells the host
+/// that nothing was written.
+unsafe fn store_output(output: &str, ptr: u32, capacity: u32) -> u32 {
+    if output.len() <= capacity as usize {
+        store_string_at_ptr(output, ptr);
+    }
+    output.len() as u32
+}
+
+/// Stores the output of a VRL run, or its runtime error as JSON, at `ptr`
+/// like [`store_output`]. Returns the length in the low 32 bits, and 1 in the
+/// high 32 bits if it is an error.
+unsafe fn store_vrl_result(result: Result<String, String>, ptr: u32, capacity: u32) -> u64 {
+    match result {
+        Ok(output) => store_output(&output, ptr, capacity) as u64,
+        Err(err) => (1 << 32) | store_output(&err, ptr, capacity) as u64,
+    }
+}
+
+/// Leaks `s` to the caller, returning its pointer/size pair packed into a
+/// u64. A boxed str has no spare capacity, so [`deallocate`] gets the size it
+/// was allocated with.
+unsafe fn leak_string(s: String) -> u64 {
+    let s = s.into_boxed_str();
+    let len = s.len();
+    let ptr = Box::into_raw(s) as *mut u8;
+    ((ptr as u64) << 32) | len as u64
+}
+
+/// Truncates `s` to at most `max` bytes without splitting a character.
+fn truncate_string(s: &mut String, max: usize) {
+    if s.len() <= max {
+        return;
+    }
+    let mut end = max;
+    while !s.is_char_boundary(end) {
+        end -= 1;
+    }
+    s.truncate(end);
+}
+
 /// Returns a pointer and size pair for the given string in a way compatible
 /// with WebAssembly numeric types.
 ///
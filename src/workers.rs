@@ -0,0 +1,231 @@
+//! Persistent worker threads that Go feeds through a queue in shared memory,
+//! instead of calling into Rust for every record. See workerpool.go.
+//!
+//! Go submits a job by writing its input into the job's buffer and pushing
+//! the job's index onto a bounded MPMC queue (Dmitry Vyukov's), then polls
+//! the job's `done` flag. The layout of every shared struct matches
+//! helloRust.h.
+
+use std::panic::{self, AssertUnwindSafe};
+use std::sync::atomic::{AtomicU32, Ordering};
+use std::thread::{self, JoinHandle};
+use std::time::Duration;
+
+/// Set in `output_len` when the output is a VRL runtime error as JSON.
+const JOB_ERROR_FLAG: u32 = 1 << 31;
+/// `output_len` of a job whose output is bigger than its buffer.
+const JOB_OVERFLOW: u32 = u32::MAX;
+/// `output_len` of a job whose transform panicked.
+const JOB_PANICKED: u32 = u32::MAX - 1;
+
+#[repr(C)]
+pub struct WorkerQueueCell {
+    seq: AtomicU32,
+    job: AtomicU32,
+}
+
+#[repr(C)]
+pub struct WorkerJob {
+    done: AtomicU32,
+    transform: u32,
+    input_len: u32,
+    output_len: u32,
+    input: *mut u8,
+    output: *mut u8,
+}
+
+/// The queue Go pushes job indexes onto. The head and tail are on separate
+/// cache lines, as the workers move one and Go the other.
+#[repr(C)]
+pub struct WorkerQueue {
+    head: AtomicU32,
+    _pad0: [u8; 60],
+    tail: AtomicU32,
+    _pad1: [u8; 60],
+    shutdown: AtomicU32,
+    capacity: u32,
+    record_capacity: u32,
+    cells: *mut WorkerQueueCell,
+    jobs: *mut WorkerJob,
+}
+
+/// The queue with what is only needed to stop the pool. The queue comes
+/// first, so Go can use a pointer to either.
+#[repr(C)]
+#[allow(dead_code)] // cells, jobs and buffers are only used through the queue
+struct WorkerPool {
+    queue: WorkerQueue,
+    threads: Vec<JoinHandle<()>>,
+    cells: Vec<WorkerQueueCell>,
+    jobs: Vec<WorkerJob>,
+    buffers: Vec<Box<[u8]>>,
+}
+
+/// Lets the worker threads share the queue, which lives until
+/// [`worker_pool_stop`] joined them.
+struct QueuePtr(*const WorkerQueue);
+
+unsafe impl Send for QueuePtr {}
+
+impl WorkerQueue {
+    /// Pops the index of the next job, if any.
+    fn dequeue(&self) -> Option<u32> {
+        let mut pos = self.head.load(Ordering::Relaxed);
+        loop {
+            let cell = unsafe { &*self.cells.add((pos & (self.capacity - 1)) as usize) };
+            let seq = cell.seq.load(Ordering::Acquire);
+            let dif = seq.wrapping_sub(pos.wrapping_add(1)) as i32;
+            if dif == 0 {
+                match self.head.compare_exchange_weak(
+                    pos,
+                    pos.wrapping_add(1),
+                    Ordering::Relaxed,
+                    Ordering::Relaxed,
+                ) {
+                    Ok(_) => {
+                        let job = cell.job.load(Ordering::Relaxed);
+                        cell.seq
+                            .store(pos.wrapping_add(self.capacity), Ordering::Release);
+                        return Some(job);
+                    }
+                    Err(current) => pos = current,
+                }
+            } else if dif < 0 {
+                return None;
+            } else {
+                pos = self.head.load(Ordering::Relaxed);
+            }
+        }
+    }
+}
+
+/// Starts `threads` workers with `capacity` jobs, a power of two, whose
+/// input and output hold up to `record_capacity` bytes each.
+#[no_mangle]
+pub extern "C" fn worker_pool_start(
+    threads: u32,
+    capacity: u32,
+    record_capacity: u32,
+) -> *mut WorkerQueue {
+    assert!(
+        capacity.is_power_of_two(),
+        "capacity must be a power of two"
+    );
+
+    let mut buffers = Vec::with_capacity(2 * capacity as usize);
+    let mut buffer = || {
+        let mut b = vec![0u8; record_capacity as usize].into_boxed_slice();
+        let ptr = b.as_mut_ptr();
+        buffers.push(b);
+        ptr
+    };
+    let mut jobs = Vec::with_capacity(capacity as usize);
+    for _ in 0..capacity {
+        jobs.push(WorkerJob {
+            done: AtomicU32::new(0),
+            transform: 0,
+            input_len: 0,
+            output_len: 0,
+            input: buffer(),
+            output: buffer(),
+        });
+    }
+    let mut cells: Vec<WorkerQueueCell> = (0..capacity)
+        .map(|i| WorkerQueueCell {
+            seq: AtomicU32::new(i),
+            job: AtomicU32::new(0),
+        })
+        .collect();
+
+    let mut pool = Box::new(WorkerPool {
+        queue: WorkerQueue {
+            head: AtomicU32::new(0),
+            _pad0: [0; 60],
+            tail: AtomicU32::new(0),
+            _pad1: [0; 60],
+            shutdown: AtomicU32::new(0),
+            capacity,
+            record_capacity,
+            cells: cells.as_mut_ptr(),
+            jobs: jobs.as_mut_ptr(),
+        },
+        threads: Vec::new(),
+        cells,
+        jobs,
+        buffers,
+    });
+
+    for _ in 0..threads {
+        let queue = QueuePtr(&pool.queue);
+        pool.threads.push(thread::spawn(move || {
+            let queue = queue;
+            run_worker(unsafe { &*queue.0 })
+        }));
+    }
+    Box::into_raw(pool) as *mut WorkerQueue
+}
+
+/// Stops the workers of a pool from [`worker_pool_start`] and frees it. Jobs
+/// that were not done yet are dropped.
+#[no_mangle]
+pub unsafe extern "C" fn worker_pool_stop(queue: *mut WorkerQueue) {
+    let pool = Box::from_raw(queue as *mut WorkerPool);
+    pool.queue.shutdown.store(1, Ordering::Release);
+    for t in pool.threads {
+        let _ = t.join();
+    }
+}
+
+/// Runs jobs until the pool is stopped. Each worker keeps its thread for its
+/// whole life, so its VRL runtime is only created once.
+fn run_worker(queue: &WorkerQueue) {
+    let mut idle = 0u32;
+    while queue.shutdown.load(Ordering::Acquire) == 0 {
+        match queue.dequeue() {
+            Some(job) => {
+                idle = 0;
+                unsafe { run_job(queue.jobs.add(job as usize), queue.record_capacity) };
+            }
+            // Spin while records keep coming, then back off so an idle
+            // pool doesn't use a core per thread.
+            None if idle < 64 => {
+                idle += 1;
+                std::hint::spin_loop();
+            }
+            None if idle < 1024 => {
+                idle += 1;
+                thread::yield_now();
+            }
+            None => thread::sleep(Duration::from_micros(50)),
+        }
+    }
+}
+
+/// Runs a job and marks it done. A transform that panics fails its job
+/// instead of killing the worker, as Go would wait for the job forever.
+unsafe fn run_job(job: *mut WorkerJob, record_capacity: u32) {
+    let input = std::slice::from_raw_parts((*job).input, (*job).input_len as usize);
+    let input = String::from_utf8_lossy(input);
+    let transform = (*job).transform;
+    let result = panic::catch_unwind(AssertUnwindSafe(|| match transform {
+        0 => (input.into_owned(), 0),
+        1 => (super::run_regex(&input), 0),
+        2 => match super::run_vrl(&input) {
+            Ok(output) => (output, 0),
+            Err(err) => (err, JOB_ERROR_FLAG),
+        },
+        _ => panic!("unknown transform {}", transform),
+    }));
+
+    match result {
+        Err(_) => (*job).output_len = JOB_PANICKED,
+        Ok((output, _)) if output.len() > record_capacity as usize => {
+            (*job).output_len = JOB_OVERFLOW
+        }
+        Ok((output, flags)) => {
+            std::ptr::copy_nonoverlapping(output.as_ptr(), (*job).output, output.len());
+            (*job).output_len = output.len() as u32 | flags;
+        }
+    }
+    (*job).done.store(1, Ordering::Release);
+}
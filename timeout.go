@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// CallTimeoutError is returned when a wasm call runs longer than
+// RunnerOptions.CallTimeout. The runner has already replaced the instance that ran it.
+type CallTimeoutError struct {
+	Runtime  string // "wazero" or "wasmtime"
+	Function string
+	Timeout  time.Duration
+}
+
+func (e *CallTimeoutError) Error() string {
+	return fmt.Sprintf("%s: %s did not return within %s", e.Runtime, e.Function, e.Timeout)
+}
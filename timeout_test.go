@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+)
+
+func TestCallTimeout(t *testing.T) {
+	options := RunnerOptions{CallTimeout: time.Nanosecond}
+	wazeroRunner := newWazeroRunner(context.Background(), compiledWasmBytes, WazeroOptions{RunnerOptions: options})
+	defer wazeroRunner.Close()
+	wasmtimeRunner := newWasmtimeRunner(compiledWasmBytes, WasmtimeOptions{RunnerOptions: options})
+	defer wasmtimeRunner.Close()
+
+	engines := map[string]struct {
+		run     VrlFunc
+		timeout *time.Duration
+	}{
+		"Rust (WASM Wazero)":   {wazeroRunner.runRegex, &wazeroRunner.options.CallTimeout},
+		"Rust (WASM Wasmtime)": {wasmtimeRunner.runRegex, &wasmtimeRunner.options.CallTimeout},
+	}
+
+	for name, e := range engines {
+		// wasmtime's timer may fire only after a short call has returned.
+		var err error
+		for i := 0; i < 100 && err == nil; i++ {
+			_, err = e.run(BenchmarkInput)
+		}
+		var timeoutErr *CallTimeoutError
+		if !errors.As(err, &timeoutErr) {
+			t.Fatalf("%s: got %v, want a *CallTimeoutError", name, err)
+		}
+		if timeoutErr.Function != "regex_wasm" {
+			t.Errorf("%s: timed out in %q, want %q", name, timeoutErr.Function, "regex_wasm")
+		}
+
+		// The replacement instance must still be configured.
+		*e.timeout = 0
+		got, err := e.run(BenchmarkInput)
+		if want := processStringGo(BenchmarkInput); err != nil || got != want {
+			t.Errorf("%s: got %q, %v after a timeout, want %q", name, got, err, want)
+		}
+	}
+}
+
+// spinWasm exports spin, a loop that never ends and calls nothing:
+//
+//	(module (func (export "spin") (loop (br 0))))
+var spinWasm = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	0x01, 0x04, 0x01, 0x60, 0x00, 0x00, // type () -> ()
+	0x03, 0x02, 0x01, 0x00, // func 0 has type 0
+	0x07, 0x08, 0x01, 0x04, 's', 'p', 'i', 'n', 0x00, 0x00, // export "spin"
+	0x0a, 0x09, 0x01, 0x07, 0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b, // loop br 0
+}
+
+func TestWazeroCallTimeoutLoop(t *testing.T) {
+	for _, interpreter := range []bool{false, true} {
+		options := WazeroOptions{Interpreter: interpreter, RunnerOptions: RunnerOptions{CallTimeout: 10 * time.Millisecond}}
+		ctx := context.Background()
+		r := wazero.NewRuntimeWithConfig(ctx, options.runtimeConfig())
+		mod, err := r.Instantiate(ctx, spinWasm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, options.CallTimeout)
+		_, err = mod.ExportedFunction("spin").Call(callCtx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: got %v, want the deadline to interrupt the loop", options, err)
+		}
+		r.Close(ctx)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// vrlProgram is the VRL source loaded with -vrl-program. When it is empty,
+// the engines run a VRL program generated from regexConfig instead.
+var vrlProgram string
+
+// VrlCompileError is returned when a VRL program fails to compile.
+type VrlCompileError struct {
+	// Formatted is the diagnostics rendered the way the vector CLI does.
+	Formatted   string          `json:"formatted"`
+	Diagnostics []VrlDiagnostic `json:"diagnostics"`
+}
+
+type VrlDiagnostic struct {
+	Severity string     `json:"severity"`
+	Code     int        `json:"code"`
+	Message  string     `json:"message"`
+	Labels   []VrlLabel `json:"labels"`
+}
+
+// VrlLabel points at the part of the source a diagnostic is about. Start and
+// End are byte offsets into the program source.
+type VrlLabel struct {
+	Message string `json:"message"`
+	Primary bool   `json:"primary"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+}
+
+func (e *VrlCompileError) Error() string {
+	return e.Formatted
+}
+
+// parseVrlCompileError decodes the diagnostics JSON produced by lib.rs, or
+// the invalid_input error it returns for a source that is not UTF-8.
+func parseVrlCompileError(data []byte) error {
+	var compileErr VrlCompileError
+	if err := json.Unmarshal(data, &compileErr); err != nil {
+		return errors.New(string(data))
+	}
+	if compileErr.Formatted == "" && len(compileErr.Diagnostics) == 0 {
+		return parseVrlRuntimeError(data)
+	}
+	return &compileErr
+}
+
+// VrlRuntimeError is returned when a VRL program fails on an event, for
+// example when a fallible function call errors or the program aborts.
+type VrlRuntimeError struct {
+	// Kind is "error" or "abort", or "invalid_input" when the input could not
+	// be turned into an event.
+	Kind     string `json:"kind"`
+	Code     int    `json:"code"`
+	Message  string `json:"message"`
+	Function string `json:"function,omitempty"`
+	// Start and End are byte offsets of the failing expression in the
+	// program source, when known.
+	Start *int `json:"start"`
+	End   *int `json:"end"`
+}
+
+func (e *VrlRuntimeError) Error() string {
+	if e.Function != "" {
+		return fmt.Sprintf("vrl %s in %s: %s", e.Kind, e.Function, e.Message)
+	}
+	return fmt.Sprintf("vrl %s: %s", e.Kind, e.Message)
+}
+
+// Type groups errors for recordErrors: the failing function when known,
+// otherwise the kind.
+func (e *VrlRuntimeError) Type() string {
+	if e.Kind == "error" && e.Function != "" {
+		return e.Function
+	}
+	return e.Kind
+}
+
+// parseVrlRuntimeError decodes the runtime error JSON produced by lib.rs.
+func parseVrlRuntimeError(data []byte) error {
+	var runtimeErr VrlRuntimeError
+	if err := json.Unmarshal(data, &runtimeErr); err != nil {
+		return errors.New(string(data))
+	}
+	return &runtimeErr
+}
+
+// VrlFunc is one of the engines' VRL entry points.
+type VrlFunc func(in string) (string, error)
+
+// mustRun adapts run, a VRL entry point or any other engine call that can
+// fail, to the benchmark scenarios, which have no way to report an error.
+func mustRun(run VrlFunc) StringInStringOut {
+	return func(s string) string {
+		out, err := run(s)
+		if err != nil {
+			log.Panicln(err)
+		}
+		return out
+	}
+}
+
+// errorCounts counts the errors of dropped records by type: VRL runtime
+// errors by their Type, wasm calls that timed out or trapped as "timeout" and
+// "trap", and inputs or outputs too big for the wasm buffer as "overflow".
+type errorCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var recordErrors = errorCounts{counts: map[string]int{}}
+
+func (c *errorCounts) Record(err error) {
+	errType := "unknown"
+	var runtimeErr *VrlRuntimeError
+	var timeoutErr *CallTimeoutError
+	var trapErr *GuestTrapError
+	var overflowErr *BufferOverflowError
+	var crashErr *SidecarCrashError
+	if errors.As(err, &runtimeErr) {
+		errType = runtimeErr.Type()
+	} else if errors.As(err, &timeoutErr) {
+		errType = "timeout"
+	} else if errors.As(err, &trapErr) {
+		errType = "trap"
+	} else if errors.As(err, &overflowErr) {
+		errType = "overflow"
+	} else if errors.As(err, &crashErr) {
+		errType = "crash"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[errType]++
+}
+
+// String lists the counts as "type=count", sorted by type, or returns an
+// empty string when nothing failed.
+func (c *errorCounts) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var parts []string
+	for errType, count := range c.counts {
+		parts = append(parts, fmt.Sprintf("%s=%d", errType, count))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// setVrlProgram compiles source with the Rust FFI library and makes it the
+// program every VRL engine runs. Wasm runners pick it up when they are
+// created.
+func setVrlProgram(source string) error {
+	if err := compileVrlRs(source); err != nil {
+		return err
+	}
+
+	vrlProgram = source
+	return nil
+}
+
+// newVrlEvent builds the JSON event the VRL engines run on from an input
+// line. With ndjson the line must already be a JSON object, otherwise it is
+// wrapped as the message field.
+func newVrlEvent(line string, ndjson bool) (string, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if ndjson {
+		if !strings.HasPrefix(strings.TrimSpace(line), "{") || !json.Valid([]byte(line)) {
+			return "", fmt.Errorf("invalid NDJSON event: %q", line)
+		}
+		return line, nil
+	}
+
+	event, err := json.Marshal(map[string]string{"message": line})
+	return string(event), err
+}
+
+// vrlEventRunner adapts a structured event runner to the string scenarios:
+// the input is sent as the message field and the resulting message returned.
+func vrlEventRunner(run StringInStringOut) StringInStringOut {
+	return func(s string) string {
+		event, err := json.Marshal(map[string]string{"message": s})
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		var out struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(run(string(event))), &out); err != nil {
+			log.Panicln(err)
+		}
+		return out.Message
+	}
+}
+
+// VrlTarget is an event together with the metadata and secrets a VRL program
+// can read with `%field` and `get_secret`.
+type VrlTarget struct {
+	Event    json.RawMessage   `json:"event"`
+	Metadata map[string]any    `json:"metadata"`
+	Secrets  map[string]string `json:"secrets,omitempty"`
+}
+
+// resolveVrlTarget runs target through run, one of the engines' VRL target
+// functions, and returns the event and metadata as the program left them.
+// Secrets are not sent back.
+func resolveVrlTarget(run VrlFunc, target VrlTarget) (VrlTarget, error) {
+	if target.Metadata == nil {
+		target.Metadata = map[string]any{}
+	}
+	in, err := json.Marshal(target)
+	if err != nil {
+		return VrlTarget{}, err
+	}
+
+	res, err := run(string(in))
+	if err != nil {
+		return VrlTarget{}, err
+	}
+
+	var out VrlTarget
+	if err := json.Unmarshal([]byte(res), &out); err != nil {
+		return VrlTarget{}, err
+	}
+	return out, nil
+}
+
+// loadJsonObject reads a JSON object from filename into v, for the
+// -vrl-metadata and -vrl-secrets flags.
+func loadJsonObject(filename string, v any) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Run `./build.sh` first!
+
+func TestVrlCompileError(t *testing.T) {
+	wazeroRunner := NewWazeroRunner(context.Background(), compiledWasmBytes)
+	defer wazeroRunner.Close()
+	wasmtimeRunner := NewWasmtimeRunner(compiledWasmBytes)
+
+	compilers := map[string]func(string) error{
+		"Rust (FFI)":           compileVrlRs,
+		"Rust (WASM Wazero)":   wazeroRunner.compileVrl,
+		"Rust (WASM Wasmtime)": wasmtimeRunner.compileVrl,
+	}
+
+	source := `. = upcase(.message`
+	for name, compile := range compilers {
+		err := compile(source)
+
+		var compileErr *VrlCompileError
+		if !errors.As(err, &compileErr) {
+			t.Fatalf("%s: got %v, want a *VrlCompileError", name, err)
+		}
+		if len(compileErr.Diagnostics) == 0 || len(compileErr.Diagnostics[0].Labels) == 0 {
+			t.Fatalf("%s: diagnostics without labels: %+v", name, compileErr)
+		}
+		if label := compileErr.Diagnostics[0].Labels[0]; label.End > len(source) {
+			t.Errorf("%s: label span %d..%d is outside the source", name, label.Start, label.End)
+		}
+	}
+}
+
+func TestVrlProgram(t *testing.T) {
+	if err := setVrlProgram(`. = upcase(string!(.))`); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		vrlProgram = ""
+		if err := setRegexConfig(regexConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	engines := newBenchmarkEngines()
+	defer engines.Close()
+
+	for _, scenario := range benchmarkScenarios(engines) {
+		if scenario.description != "VRL Replace" {
+			continue
+		}
+		if got, want := scenario.runner("abcd efg"), "ABCD EFG"; got != want {
+			t.Errorf("%s: got %q, want %q", scenario.environment, got, want)
+		}
+	}
+}
+
+func TestNewVrlEvent(t *testing.T) {
+	cases := []struct {
+		line   string
+		ndjson bool
+		want   string
+		err    bool
+	}{
+		{"plain line\n", false, `{"message":"plain line"}`, false},
+		{`say "hi" C:\dir` + "\r\n", false, `{"message":"say \"hi\" C:\\dir"}`, false},
+		{`{"message":"abcd","host":"a"}` + "\n", true, `{"message":"abcd","host":"a"}`, false},
+		{`["not","an","object"]`, true, "", true},
+		{`{"truncated":`, true, "", true},
+	}
+
+	for _, c := range cases {
+		got, err := newVrlEvent(c.line, c.ndjson)
+		if (err != nil) != c.err {
+			t.Errorf("newVrlEvent(%q, %v) error = %v", c.line, c.ndjson, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("newVrlEvent(%q, %v) = %s, want %s", c.line, c.ndjson, got, c.want)
+		}
+	}
+}
+
+func TestVrlTarget(t *testing.T) {
+	if err := setVrlProgram(`%route = .message
+.token = get_secret("token")`); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		vrlProgram = ""
+		if err := setRegexConfig(regexConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	wazeroRunner := NewWazeroRunner(context.Background(), compiledWasmBytes)
+	defer wazeroRunner.Close()
+	wasmtimeRunner := NewWasmtimeRunner(compiledWasmBytes)
+
+	engines := map[string]VrlFunc{
+		"Rust (FFI)":           processTargetVrl,
+		"Rust (WASM Wazero)":   wazeroRunner.runVrlTarget,
+		"Rust (WASM Wasmtime)": wasmtimeRunner.runVrlTarget,
+	}
+
+	target := VrlTarget{
+		Event:    json.RawMessage(`{"message":"billing"}`),
+		Metadata: map[string]any{"source": "uds"},
+		Secrets:  map[string]string{"token": "s3cret"},
+	}
+	for name, run := range engines {
+		got, err := resolveVrlTarget(run, target)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want := `{"message":"billing","token":"s3cret"}`; string(got.Event) != want {
+			t.Errorf("%s: event %s, want %s", name, got.Event, want)
+		}
+		if got.Metadata["route"] != "billing" || got.Metadata["source"] != "uds" {
+			t.Errorf("%s: metadata %v", name, got.Metadata)
+		}
+	}
+}
+
+func TestVrlRuntimeError(t *testing.T) {
+	if err := setVrlProgram(`.message = string!(.count)`); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		vrlProgram = ""
+		if err := setRegexConfig(regexConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	wazeroRunner := NewWazeroRunner(context.Background(), compiledWasmBytes)
+	defer wazeroRunner.Close()
+	wasmtimeRunner := NewWasmtimeRunner(compiledWasmBytes)
+
+	engines := map[string]VrlFunc{
+		"Rust (FFI)":           processEventVrl,
+		"Rust (WASM Wazero)":   wazeroRunner.runVrlEvent,
+		"Rust (WASM Wasmtime)": wasmtimeRunner.runVrlEvent,
+	}
+
+	for name, run := range engines {
+		_, err := run(`{"count":1}`)
+
+		var runtimeErr *VrlRuntimeError
+		if !errors.As(err, &runtimeErr) {
+			t.Fatalf("%s: got %v, want a *VrlRuntimeError", name, err)
+		}
+		if runtimeErr.Type() != "string" {
+			t.Errorf("%s: error type %q, want %q: %v", name, runtimeErr.Type(), "string", err)
+		}
+
+		// A failed event must not affect the next one.
+		if got, err := run(`{"count":"one"}`); err != nil || got != `{"count":"one","message":"one"}` {
+			t.Errorf("%s: got %s, %v after a runtime error", name, got, err)
+		}
+	}
+}
+
+func TestVrlInvalidInput(t *testing.T) {
+	// Lines from UDS and TCP clients are not always UTF-8.
+	_, err := processStringVrl("abcd \xff\xfe")
+
+	var runtimeErr *VrlRuntimeError
+	if !errors.As(err, &runtimeErr) || runtimeErr.Kind != "invalid_input" {
+		t.Fatalf("got %v, want an invalid_input *VrlRuntimeError", err)
+	}
+
+	if got, err := processStringVrl("abcd efghi"); err != nil || got != "xxxx efghi" {
+		t.Errorf("got %q, %v after invalid input", got, err)
+	}
+	if got := noopStringRs("abcd \xff"); got != "abcd \xff" {
+		t.Errorf("noop got %q", got)
+	}
+}
+
+func TestVrlInvalidSource(t *testing.T) {
+	compilers := map[string]func() error{
+		"compile":              func() error { return compileVrlRs(". = \"\xff\"") },
+		"compile_named source": func() error { return compileNamedVrlRs("bad", ". = \"\xff\"") },
+		"compile_named name":   func() error { return compileNamedVrlRs("\xff", ".") },
+	}
+	for name, compile := range compilers {
+		var runtimeErr *VrlRuntimeError
+		if err := compile(); !errors.As(err, &runtimeErr) || runtimeErr.Kind != "invalid_input" {
+			t.Errorf("%s: got %v, want an invalid_input *VrlRuntimeError", name, err)
+		}
+	}
+
+	err := configureRs(RegexConfig{Pattern: "\xff", Replacement: "x"})
+	if err == nil || !strings.Contains(err.Error(), "invalid_input") {
+		t.Errorf("configure: got %v, want an invalid_input error", err)
+	}
+
+	// The loaded program and pattern are unchanged.
+	if got, err := processStringVrl("abcd efghi"); err != nil || got != "xxxx efghi" {
+		t.Errorf("got %q, %v after an invalid source", got, err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/tetratelabs/wazero"
+)
+
+// WasiConfig is the WASI environment of the wasm guests, the same for both
+// runtimes. The guests' stdout and stderr always go to the Go logger.
+type WasiConfig struct {
+	// Env holds the guests' environment variables as KEY=VALUE.
+	Env []string
+	// Dir is preopened as the guests' "/", for lookup tables and the like.
+	// wazero only gives read access. wasmtime-go v1.0.0 can't restrict the
+	// rights of a preopened directory, so it must be read-only on disk to
+	// keep wasmtime guests from writing to it.
+	Dir string
+}
+
+// parseWasiEnv parses a comma separated list of KEY=VALUE pairs.
+func parseWasiEnv(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	env := strings.Split(list, ",")
+	for _, kv := range env {
+		if key, _, ok := strings.Cut(kv, "="); !ok || key == "" {
+			return nil, fmt.Errorf("got %q, want KEY=VALUE", kv)
+		}
+	}
+	return env, nil
+}
+
+// validate checks that Dir is a directory.
+func (cfg WasiConfig) validate() error {
+	if cfg.Dir == "" {
+		return nil
+	}
+	st, err := os.Stat(cfg.Dir)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", cfg.Dir)
+	}
+	return nil
+}
+
+// envKeysValues splits Env for wasmtime.
+func (cfg WasiConfig) envKeysValues() (keys, values []string) {
+	for _, kv := range cfg.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	return keys, values
+}
+
+// wazeroModuleConfig returns the module config of a wazero guest writing to
+// stdout and stderr.
+func (cfg WasiConfig) wazeroModuleConfig(stdout, stderr io.Writer) wazero.ModuleConfig {
+	config := wazero.NewModuleConfig().WithStdout(stdout).WithStderr(stderr)
+	for _, kv := range cfg.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		config = config.WithEnv(key, value)
+	}
+	if cfg.Dir != "" {
+		config = config.WithFS(os.DirFS(cfg.Dir))
+	}
+	return config
+}
+
+// wasmtimeConfig returns the WASI config of a wasmtime guest writing to
+// stdout and stderr. Every store needs its own.
+func (cfg WasiConfig) wasmtimeConfig(stdout, stderr *guestPipe) (*wasmtime.WasiConfig, error) {
+	config := wasmtime.NewWasiConfig()
+	config.SetEnv(cfg.envKeysValues())
+	if err := config.SetStdoutFile(stdout.path); err != nil {
+		return nil, err
+	}
+	if err := config.SetStderrFile(stderr.path); err != nil {
+		return nil, err
+	}
+	if cfg.Dir != "" {
+		if err := config.PreopenDir(cfg.Dir, "/"); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// guestLogger logs what a guest writes to stdout or stderr, one line at a
+// time, prefixed with the instance and stream.
+type guestLogger struct {
+	prefix string
+
+	mu      sync.Mutex
+	pending []byte
+}
+
+func newGuestLogger(instance, stream string) *guestLogger {
+	return &guestLogger{prefix: instance + " " + stream + ": "}
+}
+
+func (l *guestLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pending = append(l.pending, p...)
+	for {
+		i := bytes.IndexByte(l.pending, '\n')
+		if i < 0 {
+			break
+		}
+		log.Print(l.prefix, string(l.pending[:i]))
+		l.pending = l.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close logs the last line if it didn't end with a newline.
+func (l *guestLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.pending) > 0 {
+		log.Print(l.prefix, string(l.pending))
+		l.pending = nil
+	}
+	return nil
+}
+
+// guestPipe is a file for a runtime that can only write guest output to a
+// path, such as wasmtime-go's WasiConfig. What is written to path is copied to
+// w until the pipe is closed. Each instance needs its own, closed when the
+// instance is dropped.
+type guestPipe struct {
+	path string
+	// writer is kept open so the instance can open path.
+	writer *os.File
+	reader *os.File
+	// done is closed once the copy stopped and w was closed.
+	done chan struct{}
+}
+
+func newGuestPipe(w io.WriteCloser) (*guestPipe, error) {
+	r, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &guestPipe{path: fmt.Sprintf("/dev/fd/%d", writer.Fd()), writer: writer, reader: r, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		defer w.Close()
+		_, err := io.Copy(w, r)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// Close stopped the copy; what the guest wrote before that is
+			// still in the pipe.
+			err = p.drain(w)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+	return p, nil
+}
+
+// drain copies what is left in the pipe to w without waiting for more.
+func (p *guestPipe) drain(w io.Writer) error {
+	if err := p.reader.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	rc, err := p.reader.SyscallConn()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	var werr error
+	err = rc.Read(func(fd uintptr) bool {
+		for werr == nil {
+			n, _ := syscall.Read(int(fd), buf)
+			if n <= 0 {
+				break
+			}
+			_, werr = w.Write(buf[:n])
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// Close stops copying and closes both ends. wasmtime-go stores keep their own
+// copy of the write end until they are finalized, so the copy can't wait for
+// EOF; guests write synchronously, so everything they wrote is in the pipe by
+// now and is copied before Close returns.
+func (p *guestPipe) Close() error {
+	err := p.writer.Close()
+	if err := p.reader.SetReadDeadline(time.Now()); err != nil {
+		log.Print(err)
+	}
+	<-p.done
+	if cerr := p.reader.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
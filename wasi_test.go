@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog returns what the logger wrote while f ran.
+func captureLog(t *testing.T, f func()) string {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+
+	f()
+	return buf.String()
+}
+
+func TestGuestLogger(t *testing.T) {
+	got := captureLog(t, func() {
+		l := newGuestLogger("wazero 1", "stderr")
+		l.Write([]byte("panicked at "))
+		l.Write([]byte("'oops'\nsecond"))
+		l.Close()
+	})
+	if want := "wazero 1 stderr: panicked at 'oops'\nwazero 1 stderr: second\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// closeNotifier records whether guestPipe is done copying.
+type closeNotifier struct {
+	bytes.Buffer
+	closed chan struct{}
+}
+
+func (w *closeNotifier) Close() error {
+	close(w.closed)
+	return nil
+}
+
+func TestGuestPipe(t *testing.T) {
+	w := &closeNotifier{closed: make(chan struct{})}
+	p, err := newGuestPipe(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Like a wasmtime store, open the pipe by its path.
+	f, err := os.OpenFile(p.path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("hello from the guest\n")
+
+	// The store's copy of the write end stays open until it is finalized,
+	// so Close must not wait for it.
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.closed:
+	default:
+		t.Fatal("still copying after Close")
+	}
+	if got := w.String(); got != "hello from the guest\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestParseWasiEnv(t *testing.T) {
+	env, err := parseWasiEnv("LEVEL=debug,EMPTY=,URL=a=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, values := WasiConfig{Env: env}.envKeysValues()
+	if strings.Join(keys, " ") != "LEVEL EMPTY URL" || strings.Join(values, " ") != "debug  a=b" {
+		t.Errorf("got keys %q values %q", keys, values)
+	}
+
+	for _, invalid := range []string{"LEVEL", "=debug", "A=1,,B=2"} {
+		if _, err := parseWasiEnv(invalid); err == nil {
+			t.Errorf("%q: got no error", invalid)
+		}
+	}
+}
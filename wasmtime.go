@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/bytecodealliance/wasmtime-go"
 )
@@ -34,18 +36,45 @@ func printExternType(ty *wasmtime.ExternType) {
 	}
 }
 
+// noEpochDeadline keeps calls without a timeout from being interrupted when
+// epoch interruption is enabled.
+const noEpochDeadline = 1 << 62
+
+// unlimitedFuel is more fuel than a store can use up, see
+// WasmtimeOptions.ConsumeFuel.
+const unlimitedFuel = 1 << 62
+
 type WasmtimeRunner struct {
+	engine   *wasmtime.Engine
+	module   *wasmtime.Module
+	options  WasmtimeOptions
 	instance *wasmtime.Instance
 	store    *wasmtime.Store
 	bufPtr   int32
+	memory   *instanceMemory
+	// program is the VRL program set with compileVrl, for new instances.
+	program string
+	// rings are allocated for guests that export ring_drain_wasm.
+	rings ring
+	// stdout and stderr log the output of the current instance.
+	stdout, stderr *guestPipe
 }
 
 func NewWasmtimeRunner(wasmBytes []byte) *WasmtimeRunner {
-	engine := wasmtime.NewEngine()
-	module, err := wasmtime.NewModule(engine, compiledWasmBytes)
+	options := wasmtimeOptions
+	options.RunnerOptions = runnerOptions
+	return newWasmtimeRunner(wasmBytes, options)
+}
+
+func newWasmtimeRunner(wasmBytes []byte, options WasmtimeOptions) *WasmtimeRunner {
+	engine := wasmtime.NewEngineWithConfig(options.config())
+	module, err := newWasmtimeModule(engine, wasmBytes, options)
 	if err != nil {
 		log.Panicln(err)
 	}
+	if err := validateWasmtimeExports(module); err != nil {
+		log.Panicln(err)
+	}
 
 	if logImportExports {
 		log.Print("Listing imports requested by module")
@@ -60,19 +89,45 @@ func NewWasmtimeRunner(wasmBytes []byte) *WasmtimeRunner {
 		}
 	}
 
+	wr := &WasmtimeRunner{engine: engine, module: module, options: options, memory: newInstanceMemory("wasmtime", options.Memory), program: vrlProgram}
+	wr.instantiate()
+	return wr
+}
+
+// instantiate creates the store and instance, and configures them with the
+// current regex and VRL program.
+func (wr *WasmtimeRunner) instantiate() {
 	// Create a linker with WASI functions defined within it
-	linker := wasmtime.NewLinker(engine)
-	err = linker.DefineWasi()
+	linker := wasmtime.NewLinker(wr.engine)
+	err := linker.DefineWasi()
 	if err != nil {
 		log.Panicln(err)
 	}
+	if err := defineWasmtimeHost(linker, hostFunctions{instance: wr.memory.name}); err != nil {
+		log.Panicln(err)
+	}
 
-	// Configure WASI imports to write stdout into a file, and then create
-	// a `Store` using this wasi configuration.
-	wasiConfig := wasmtime.NewWasiConfig()
-	store := wasmtime.NewStore(engine)
-	store.SetWasi(wasiConfig)
-	instance, err := linker.Instantiate(store, module)
+	// Configure WASI imports to write stdout and stderr to the logger, and
+	// then create a `Store` using this wasi configuration.
+	if wr.stdout, err = newGuestPipe(newGuestLogger(wr.memory.name, "stdout")); err != nil {
+		log.Panicln(err)
+	}
+	if wr.stderr, err = newGuestPipe(newGuestLogger(wr.memory.name, "stderr")); err != nil {
+		log.Panicln(err)
+	}
+	config, err := wr.options.Wasi.wasmtimeConfig(wr.stdout, wr.stderr)
+	if err != nil {
+		log.Panicln(err)
+	}
+	store := wasmtime.NewStore(wr.engine)
+	store.SetWasi(config)
+	store.SetEpochDeadline(noEpochDeadline)
+	if wr.options.ConsumeFuel {
+		if err := store.AddFuel(unlimitedFuel); err != nil {
+			log.Panicln(err)
+		}
+	}
+	instance, err := linker.Instantiate(store, wr.module)
 	if err != nil {
 		log.Panicln(err)
 	}
@@ -85,90 +140,411 @@ func NewWasmtimeRunner(wasmBytes []byte) *WasmtimeRunner {
 		log.Panicln(err)
 	}
 
-	bufPtr := result.(int32)
+	wr.instance, wr.store, wr.bufPtr = instance, store, result.(int32)
+	wr.rings = ring{}
+	if wr.hasExport("ring_drain_wasm") {
+		result, err := allocate.Call(store, ringRegionSize)
+		if err != nil {
+			log.Panicln(err)
+		}
+		wr.rings = ring{ptr: uint32(result.(int32))}
+		wr.rings.init(wr.ringMemory())
+	}
+	if err := wr.configureRegex(regexConfig); err != nil {
+		log.Panicln(err)
+	}
+	if wr.program != "" {
+		if err := wr.compileVrl(wr.program); err != nil {
+			log.Panicln(err)
+		}
+	}
+	wr.memory.instantiated(wr.memorySize())
+}
 
-	return &WasmtimeRunner{instance, store, bufPtr}
+// recycle replaces the instance with a new one.
+func (wr *WasmtimeRunner) recycle() {
+	wr.closeOutput()
+	wr.instantiate()
+	wr.memory.recycled.Inc()
 }
 
-func (wr *WasmtimeRunner) runStringInStringOut(input string, funcy *wasmtime.Func) string {
-	if len(input) > bufSize {
-		log.Panicf("Input string length %d is bigger than the buffer %d.", len(input), bufSize)
+// recycleIfDue replaces the instance when it reached a memory limit.
+func (wr *WasmtimeRunner) recycleIfDue() {
+	if wr.memory.recycleDue {
+		wr.recycle()
 	}
-	memory := wr.instance.GetExport(wr.store, "memory").Memory()
-	memoryBuf := memory.UnsafeData(wr.store)
+}
 
-	inputSize := int32(len(input))
+// memorySize returns the size of the guest's memory in bytes.
+func (wr *WasmtimeRunner) memorySize() uint64 {
+	return uint64(wr.instance.GetExport(wr.store, "memory").Memory().DataSize(wr.store))
+}
 
-	copy(memoryBuf[wr.bufPtr:], input)
+// validateWasmtimeExports checks module against the guest ABI.
+func validateWasmtimeExports(module *wasmtime.Module) error {
+	kindNames := func(types []*wasmtime.ValType) []string {
+		names := make([]string, len(types))
+		for i, t := range types {
+			names[i] = t.Kind().String()
+		}
+		return names
+	}
+
+	functions := map[string]guestSignature{}
+	memory := false
+	for _, exp := range module.Exports() {
+		if ft := exp.Type().FuncType(); ft != nil {
+			functions[exp.Name()] = newGuestSignature(kindNames(ft.Params()), kindNames(ft.Results()))
+		}
+		if exp.Name() == "memory" && exp.Type().MemoryType() != nil {
+			memory = true
+		}
+	}
+	return validateGuestExports(functions, memory)
+}
+
+// export returns the function the guest exports as name, or nil.
+func (wr *WasmtimeRunner) export(name string) *wasmtime.Func {
+	if ext := wr.instance.GetExport(wr.store, name); ext != nil {
+		return ext.Func()
+	}
+	return nil
+}
+
+// hasExport reports whether the guest exports the function name.
+func (wr *WasmtimeRunner) hasExport(name string) bool {
+	return wr.export(name) != nil
+}
 
-	result, err := funcy.Call(wr.store, wr.bufPtr, inputSize)
+// Close frees the buffer and drops the instance and store. wasmtime-go has no
+// way to delete a store explicitly; its finalizer does once it is unreachable.
+func (wr *WasmtimeRunner) Close() {
+	deallocate := wr.instance.GetExport(wr.store, "deallocate").Func()
+	if _, err := deallocate.Call(wr.store, wr.bufPtr, bufSize); err != nil {
+		log.Panicln(err)
+	}
+	wr.instance = nil
+	wr.store = nil
+	wr.closeOutput()
+	wr.memory.unregister()
+}
+
+// closeOutput closes the stdout and stderr pipes of the instance, once it
+// won't run again.
+func (wr *WasmtimeRunner) closeOutput() {
+	if err := wr.stdout.Close(); err != nil {
+		log.Print(err)
+	}
+	if err := wr.stderr.Close(); err != nil {
+		log.Print(err)
+	}
+}
+
+// compileVrl compiles source inside the guest and runs it for every following
+// runVrl call.
+func (wr *WasmtimeRunner) compileVrl(source string) error {
+	memory := wr.instance.GetExport(wr.store, "memory").Memory()
+	compile := wr.export("compile_vrl_wasm")
+	if compile == nil {
+		return errMissingExport("wasmtime", "compile_vrl_wasm")
+	}
+	allocate := wr.instance.GetExport(wr.store, "allocate").Func()
+	deallocate := wr.instance.GetExport(wr.store, "deallocate").Func()
+
+	// Programs can be larger than the fixed buffer, so use Rust's allocator.
+	sourceSize := int32(len(source))
+	result, err := allocate.Call(wr.store, sourceSize)
 	if err != nil {
 		log.Panicln(err)
 	}
+	sourcePtr := result.(int32)
+	defer deallocate.Call(wr.store, sourcePtr, sourceSize)
 
-	resultSize := result.(int32)
-	// Refresh memoryBuf, after a `.Call` it is invalid
-	memoryBuf = memory.UnsafeData(wr.store)
+	// allocate may have grown memory, so get the data after calling it
+	copy(memory.UnsafeData(wr.store)[sourcePtr:], source)
 
-	start := wr.bufPtr
-	end := int64(wr.bufPtr + resultSize)
+	packedPtrSize, err := compile.Call(wr.store, sourcePtr, sourceSize)
+	if err != nil {
+		return err
+	}
+	if packedPtrSize.(int64) == 0 {
+		wr.program = source
+		return nil
+	}
 
-	return string(memoryBuf[start:end])
+	errPtr, errSize := unpackInt64(packedPtrSize.(int64))
+	defer deallocate.Call(wr.store, errPtr, errSize)
+
+	// Refresh memoryBuf, after a `.Call` it is invalid
+	memoryBuf := memory.UnsafeData(wr.store)
+	return parseVrlCompileError(memoryBuf[errPtr : errPtr+errSize])
 }
 
-func (wr *WasmtimeRunner) runVrl(input string) string {
-	vrl := wr.instance.GetExport(wr.store, "vrl_wasm").Func()
+// configureRegex sets the regex used by the guest's regex and VRL exports.
+// Guests without configure_wasm are left alone.
+func (wr *WasmtimeRunner) configureRegex(cfg RegexConfig) error {
+	configure := wr.export("configure_wasm")
+	if configure == nil {
+		return nil
+	}
+
+	input := cfg.Pattern + cfg.Replacement
+	if len(input) > bufSize {
+		return fmt.Errorf("pattern and replacement length %d is bigger than the buffer %d", len(input), bufSize)
+	}
+
+	memory := wr.instance.GetExport(wr.store, "memory").Memory()
+	copy(memory.UnsafeData(wr.store)[wr.bufPtr:], input)
+
+	result, err := configure.Call(wr.store, wr.bufPtr, int32(len(cfg.Pattern)),
+		int32(len(cfg.Replacement)), int32(cfg.count()), bufSize)
+	if err != nil {
+		return err
+	}
 
-	return wr.runStringInStringOut(input, vrl)
+	errSize := result.(int32)
+	if errSize == 0 {
+		return nil
+	}
+	// Refresh memoryBuf, after a `.Call` it is invalid
+	memoryBuf := memory.UnsafeData(wr.store)
+	return fmt.Errorf("wasmtime: %s", memoryBuf[wr.bufPtr:wr.bufPtr+errSize])
 }
 
-func (wr *WasmtimeRunner) runRegex(input string) string {
-	vrl := wr.instance.GetExport(wr.store, "regex_wasm").Func()
+// callBuffered writes input into the buffer and calls funcy on it, returning
+// its raw result. A call that exceeds the CallTimeout replaces the instance and
+// returns a *CallTimeoutError.
+func (wr *WasmtimeRunner) callBuffered(input string, export string) (interface{}, error) {
+	wr.recycleIfDue()
+	funcy := wr.export(export)
+	if funcy == nil {
+		return nil, errMissingExport("wasmtime", export)
+	}
 
-	return wr.runStringInStringOut(input, vrl)
+	if len(input) > bufSize {
+		return nil, &BufferOverflowError{Runtime: "wasmtime", Function: export, Size: len(input), Input: true}
+	}
+	memory := wr.instance.GetExport(wr.store, "memory").Memory()
+	memoryBuf := memory.UnsafeData(wr.store)
+
+	inputSize := int32(len(input))
+
+	copy(memoryBuf[wr.bufPtr:], input)
+
+	result, err := wr.call(funcy, export, wr.bufPtr, inputSize, int32(bufSize))
+	if err != nil {
+		return nil, err
+	}
+
+	wr.memory.called(wr.memorySize())
+	return result, nil
 }
 
-func (wr *WasmtimeRunner) runNoop(input string) string {
-	vrl := wr.instance.GetExport(wr.store, "noop_wasm").Func()
+// call calls funcy with params. A call that exceeds the CallTimeout or traps
+// replaces the instance and returns a *CallTimeoutError or *GuestTrapError.
+func (wr *WasmtimeRunner) call(funcy *wasmtime.Func, export string, params ...interface{}) (interface{}, error) {
+	timeout := wr.options.CallTimeout
+	if timeout > 0 {
+		wr.store.SetEpochDeadline(1)
+		timer := time.AfterFunc(timeout, wr.engine.IncrementEpoch)
+		defer func() {
+			timer.Stop()
+			// The timer may still have fired, so don't let it hit later calls.
+			// After a timeout the store was replaced, which needs no reset.
+			wr.store.SetEpochDeadline(noEpochDeadline)
+		}()
+	}
 
-	return wr.runStringInStringOut(input, vrl)
+	result, err := funcy.Call(wr.store, params...)
+	var trap *wasmtime.Trap
+	if errors.As(err, &trap) && trap.Code() != nil && *trap.Code() == wasmtime.Interrupt {
+		wr.recycle()
+		return nil, &CallTimeoutError{Runtime: "wasmtime", Function: export, Timeout: timeout}
+	}
+	if err != nil {
+		wr.recycle()
+		return nil, &GuestTrapError{Runtime: "wasmtime", Function: export, Err: err}
+	}
+	return result, nil
 }
 
-func (wr *WasmtimeRunner) runNoopDynamicAllocation(input string) string {
-	// Load up our exports from the wr.instance
+// callDynamic copies input into memory from the guest's allocator and calls
+// the export on it, which returns the ptr and length of an output it
+// allocated. Unlike callBuffered, records of any size fit. It returns the
+// output, and whether the guest set dynamicErrorFlag.
+func (wr *WasmtimeRunner) callDynamic(input string, export string) (string, bool, error) {
+	wr.recycleIfDue()
+	funcy := wr.export(export)
+	if funcy == nil {
+		return "", false, errMissingExport("wasmtime", export)
+	}
 	memory := wr.instance.GetExport(wr.store, "memory").Memory()
-	memoryBuf := memory.UnsafeData(wr.store)
-
-	noop := wr.instance.GetExport(wr.store, "noop_wasm_dynamic_allocation").Func()
 	allocate := wr.instance.GetExport(wr.store, "allocate").Func()
 	deallocate := wr.instance.GetExport(wr.store, "deallocate").Func()
 
 	inputSize := int32(len(input))
-	result, err := allocate.Call(wr.store, inputSize)
+	result, err := wr.call(allocate, "allocate", inputSize)
 	if err != nil {
-		log.Panicln(err)
+		return "", false, err
 	}
-
 	inputPtr := result.(int32)
-	defer deallocate.Call(wr.store, inputPtr, inputSize)
 
-	copy(memoryBuf[inputPtr:], input)
+	// allocate may have grown memory, so get the data after calling it
+	copy(memory.UnsafeData(wr.store)[inputPtr:], input)
 
-	packedPtrSize, err := noop.Call(wr.store, inputPtr, inputSize)
+	packedPtrSize, err := wr.call(funcy, export, inputPtr, inputSize)
 	if err != nil {
+		// The instance was replaced, along with everything it allocated.
+		return "", false, err
+	}
+	outputPtr, packedSize := unpackInt64(packedPtrSize.(int64))
+	outputSize := int32(uint32(packedSize) &^ dynamicErrorFlag)
+
+	// Refresh memoryBuf, after a `.Call` it is invalid
+	memoryBuf := memory.UnsafeData(wr.store)
+	output := string(memoryBuf[outputPtr : outputPtr+outputSize])
+
+	if _, err := deallocate.Call(wr.store, outputPtr, outputSize); err != nil {
+		log.Panicln(err)
+	}
+	if _, err := deallocate.Call(wr.store, inputPtr, inputSize); err != nil {
 		log.Panicln(err)
 	}
-	noopResultPtr, noopResultSize := unpackInt64(packedPtrSize.(int64))
-	defer deallocate.Call(wr.store, int64(noopResultPtr), int64(noopResultSize))
 
+	wr.memory.called(wr.memorySize())
+	return output, uint32(packedSize)&dynamicErrorFlag != 0, nil
+}
+
+func (wr *WasmtimeRunner) ring() ring {
+	return wr.rings
+}
+
+func (wr *WasmtimeRunner) ringMemory() []byte {
+	return wr.instance.GetExport(wr.store, "memory").Memory().UnsafeData(wr.store)
+}
+
+func (wr *WasmtimeRunner) drainRing(transform ringTransform) (uint32, error) {
+	result, err := wr.call(wr.export("ring_drain_wasm"), "ring_drain_wasm", int32(wr.rings.ptr), int32(transform))
+	if err != nil {
+		return 0, err
+	}
+	wr.memory.called(wr.memorySize())
+	return uint32(result.(int32)), nil
+}
+
+// runRing runs transform on records through the ring buffers in the guest's
+// memory and emits the results in order, see streamRing.
+func (wr *WasmtimeRunner) runRing(records []string, transform ringTransform, emit func(string, error)) error {
+	if !wr.hasExport("ring_drain_wasm") {
+		return errMissingExport("wasmtime", "ring_drain_wasm")
+	}
+	return streamRing(wr, records, transform, emit)
+}
+
+// readBuffer returns the first resultSize bytes of the buffer, which export
+// wrote. A bigger size than the buffer means the output didn't fit.
+func (wr *WasmtimeRunner) readBuffer(resultSize int32, export string) (string, error) {
+	if uint32(resultSize) > bufSize {
+		return "", &BufferOverflowError{Runtime: "wasmtime", Function: export, Size: int(uint32(resultSize))}
+	}
 	// Refresh memoryBuf, after a `.Call` it is invalid
-	memoryBuf = memory.UnsafeData(wr.store)
+	memory := wr.instance.GetExport(wr.store, "memory").Memory()
+	memoryBuf := memory.UnsafeData(wr.store)
+
+	start := wr.bufPtr
+	end := int64(wr.bufPtr + resultSize)
+
+	return string(memoryBuf[start:end]), nil
+}
+
+func (wr *WasmtimeRunner) runStringInStringOut(input string, export string) (string, error) {
+	result, err := wr.callBuffered(input, export)
+	if err != nil {
+		return "", err
+	}
+	return wr.readBuffer(result.(int32), export)
+}
+
+// runVrlChecked runs one of the VRL exports, which return the result length
+// packed with a flag that is set when the buffer holds a runtime error.
+func (wr *WasmtimeRunner) runVrlChecked(input string, export string) (string, error) {
+	result, err := wr.callBuffered(input, export)
+	if err != nil {
+		return "", err
+	}
+	isError, resultSize := unpackInt64(result.(int64))
+	res, err := wr.readBuffer(resultSize, export)
+	if err != nil {
+		return "", err
+	}
+	if isError != 0 {
+		return "", parseVrlRuntimeError([]byte(res))
+	}
+	return res, nil
+}
+
+func (wr *WasmtimeRunner) runVrl(input string) (string, error) {
+	return wr.runVrlChecked(input, "vrl_wasm")
+}
 
-	return string(memoryBuf[noopResultPtr : noopResultPtr+noopResultSize])
+// runVrlEvent runs the VRL program on a JSON event and returns the resulting
+// event as JSON.
+func (wr *WasmtimeRunner) runVrlEvent(event string) (string, error) {
+	return wr.runVrlChecked(event, "vrl_event_wasm")
+}
+
+// runVrlTarget runs the VRL program on a JSON target holding an event, its
+// metadata and secrets. See resolveVrlTarget.
+func (wr *WasmtimeRunner) runVrlTarget(target string) (string, error) {
+	return wr.runVrlChecked(target, "vrl_target_wasm")
+}
+
+func (wr *WasmtimeRunner) runRegex(input string) (string, error) {
+	return wr.runStringInStringOut(input, "regex_wasm")
+}
+
+func (wr *WasmtimeRunner) runNoop(input string) (string, error) {
+	return wr.runStringInStringOut(input, "noop_wasm")
+}
+
+// runEnrich appends the enrichment of the record's key, which the guest
+// looks up with the functions of hostModule.
+func (wr *WasmtimeRunner) runEnrich(input string) (string, error) {
+	return wr.runStringInStringOut(input, "enrich_wasm")
+}
+
+// runNoopDynamicAllocation is runNoop with the output allocated by the
+// guest, see callDynamic.
+func (wr *WasmtimeRunner) runNoopDynamicAllocation(input string) (string, error) {
+	output, _, err := wr.callDynamic(input, "noop_wasm_dynamic_allocation")
+	return output, err
+}
+
+// runRegexDynamicAllocation is runRegex with the output allocated by the
+// guest, see callDynamic.
+func (wr *WasmtimeRunner) runRegexDynamicAllocation(input string) (string, error) {
+	output, _, err := wr.callDynamic(input, "regex_wasm_dynamic_allocation")
+	return output, err
+}
+
+// runVrlDynamicAllocation is runVrl with the output allocated by the guest,
+// see callDynamic.
+func (wr *WasmtimeRunner) runVrlDynamicAllocation(input string) (string, error) {
+	output, isError, err := wr.callDynamic(input, "vrl_wasm_dynamic_allocation")
+	if err != nil {
+		return "", err
+	}
+	if isError {
+		return "", parseVrlRuntimeError([]byte(output))
+	}
+	return output, nil
 }
 
 func runWasmtime() {
 	runner := NewWasmtimeRunner(compiledWasmBytes)
-	res := runner.runNoop("hello wasmtime")
+	res, err := runner.runNoop("hello wasmtime")
+	if err != nil {
+		log.Panicln(err)
+	}
 	fmt.Println(res)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 
@@ -10,148 +11,467 @@ import (
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 )
 
-func instantiateWazero(ctx context.Context) (wazero.Runtime, api.Module) {
-	// Create a new WebAssembly Runtime.
-	r := wazero.NewRuntime(ctx)
-
-	wasi_snapshot_preview1.MustInstantiate(ctx, r)
-	// Instantiate a WebAssembly module that exports
-	// "allocate", "deallocate" and "noop_wasm"
-	mod, err := r.InstantiateModuleFromBinary(ctx, compiledWasmBytes)
-	if err != nil {
-		log.Panicln(err)
-	}
-
-	return r, mod
-}
-
 func unpackUInt64(val uint64) (uint32, uint32) {
 	return uint32(val >> 32), uint32(val)
 }
 
 type WazeroRunner struct {
 	ctx     context.Context
-	mod     api.Module
 	runtime wazero.Runtime
+	// compiled is instantiated again whenever the instance is recycled.
+	compiled wazero.CompiledModule
+	// cache is closed with the runtime, nil without a cache.
+	cache   wazero.CompilationCache
+	options WazeroOptions
+	mod     api.Module
 	bufPtr  uint32
+	memory  *instanceMemory
+	// program is the VRL program set with compileVrl, for new instances.
+	program string
+	// rings are allocated for guests that export ring_drain_wasm.
+	rings ring
+	// stdout and stderr log the guest's output.
+	stdout, stderr *guestLogger
 }
 
 func NewWazeroRunner(ctx context.Context, wasmBytes []byte) *WazeroRunner {
+	options := wazeroOptions
+	options.RunnerOptions = runnerOptions
+	return newWazeroRunner(ctx, wasmBytes, options)
+}
+
+func newWazeroRunner(ctx context.Context, wasmBytes []byte, options WazeroOptions) *WazeroRunner {
+	config := options.runtimeConfig()
+	cache := newWazeroCache(options)
+	if cache != nil {
+		config = config.WithCompilationCache(cache)
+	}
+
 	// Create a new WebAssembly Runtime.
-	r := wazero.NewRuntime(ctx)
+	r := wazero.NewRuntimeWithConfig(ctx, config)
 
+	memory := newInstanceMemory("wazero", options.Memory)
 	wasi_snapshot_preview1.MustInstantiate(ctx, r)
-	mod, err := r.InstantiateModuleFromBinary(ctx, wasmBytes)
+	if err := instantiateWazeroHost(ctx, r, hostFunctions{instance: memory.name}); err != nil {
+		log.Panicln(err)
+	}
+	compiled, err := r.CompileModule(ctx, wasmBytes)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if err := validateWazeroExports(compiled); err != nil {
+		log.Panicln(err)
+	}
+
+	wr := &WazeroRunner{ctx: ctx, runtime: r, compiled: compiled, cache: cache, options: options, memory: memory, program: vrlProgram}
+	wr.stdout = newGuestLogger(wr.memory.name, "stdout")
+	wr.stderr = newGuestLogger(wr.memory.name, "stderr")
+	wr.instantiate()
+	return wr
+}
+
+// instantiate creates the module and configures it with the current regex
+// and VRL program.
+func (wr *WazeroRunner) instantiate() {
+	mod, err := wr.runtime.InstantiateModule(wr.ctx, wr.compiled, wr.options.Wasi.wazeroModuleConfig(wr.stdout, wr.stderr))
 	if err != nil {
 		log.Panicln(err)
 	}
 
 	allocate := mod.ExportedFunction("allocate")
 
-	results, err := allocate.Call(ctx, bufSize)
+	results, err := allocate.Call(wr.ctx, bufSize)
 	if err != nil {
 		log.Panicln(err)
 	}
 
 	bufPtr := results[0]
 
-	return &WazeroRunner{
-		ctx: ctx, mod: mod, runtime: r, bufPtr: uint32(bufPtr),
+	wr.mod, wr.bufPtr = mod, uint32(bufPtr)
+	wr.rings = ring{}
+	if wr.hasExport("ring_drain_wasm") {
+		results, err := allocate.Call(wr.ctx, ringRegionSize)
+		if err != nil {
+			log.Panicln(err)
+		}
+		wr.rings = ring{ptr: uint32(results[0])}
+		wr.rings.init(wr.ringMemory())
+	}
+	if err := wr.configureRegex(regexConfig); err != nil {
+		log.Panicln(err)
+	}
+	if wr.program != "" {
+		if err := wr.compileVrl(wr.program); err != nil {
+			log.Panicln(err)
+		}
+	}
+	wr.memory.instantiated(uint64(mod.Memory().Size()))
+}
+
+// recycle replaces the instance with a new one.
+func (wr *WazeroRunner) recycle() {
+	wr.mod.Close(wr.ctx)
+	wr.instantiate()
+	wr.memory.recycled.Inc()
+}
+
+// recycleIfDue replaces the instance when it reached a memory limit.
+func (wr *WazeroRunner) recycleIfDue() {
+	if wr.memory.recycleDue {
+		wr.recycle()
 	}
 }
 
-func (wr *WazeroRunner) executeStringInStringOut(input string, funcy api.Function) string {
-	if len(input) > bufSize {
-		log.Panicf("Input string length %d is bigger than the buffer %d.", len(input), bufSize)
+// validateWazeroExports checks compiled against the guest ABI.
+func validateWazeroExports(compiled wazero.CompiledModule) error {
+	typeNames := func(types []api.ValueType) []string {
+		names := make([]string, len(types))
+		for i, t := range types {
+			names[i] = api.ValueTypeName(t)
+		}
+		return names
 	}
 
-	if !wr.mod.Memory().Write(wr.ctx, wr.bufPtr, []byte(input)) {
-		log.Panicf("Memory.Write(%d, %d) out of range of memory size %d",
-			wr.bufPtr, len(input), wr.mod.Memory().Size(wr.ctx))
+	functions := map[string]guestSignature{}
+	for name, def := range compiled.ExportedFunctions() {
+		functions[name] = newGuestSignature(typeNames(def.ParamTypes()), typeNames(def.ResultTypes()))
 	}
+	_, memory := compiled.ExportedMemories()["memory"]
+	return validateGuestExports(functions, memory)
+}
 
-	results, err := funcy.Call(wr.ctx, uint64(wr.bufPtr), uint64(len(input)))
+// hasExport reports whether the guest exports the function name.
+func (wr *WazeroRunner) hasExport(name string) bool {
+	return wr.mod.ExportedFunction(name) != nil
+}
+
+// compileVrl compiles source inside the guest and runs it for every following
+// runVrl call.
+func (wr *WazeroRunner) compileVrl(source string) error {
+	compile := wr.mod.ExportedFunction("compile_vrl_wasm")
+	if compile == nil {
+		return errMissingExport("wazero", "compile_vrl_wasm")
+	}
+	allocate := wr.mod.ExportedFunction("allocate")
+	deallocate := wr.mod.ExportedFunction("deallocate")
+
+	// Programs can be larger than the fixed buffer, so use Rust's allocator.
+	sourceSize := uint64(len(source))
+	results, err := allocate.Call(wr.ctx, sourceSize)
 	if err != nil {
 		log.Panicln(err)
 	}
+	sourcePtr := results[0]
+	defer deallocate.Call(wr.ctx, sourcePtr, sourceSize)
+
+	if !wr.mod.Memory().Write(uint32(sourcePtr), []byte(source)) {
+		log.Panicf("Memory.Write(%d, %d) out of range of memory size %d",
+			sourcePtr, sourceSize, wr.mod.Memory().Size())
+	}
 
-	resultSize := results[0]
+	packedPtrSize, err := compile.Call(wr.ctx, sourcePtr, sourceSize)
+	if err != nil {
+		return err
+	}
+	if packedPtrSize[0] == 0 {
+		wr.program = source
+		return nil
+	}
 
-	resultStringBytes, ok := wr.mod.Memory().Read(wr.ctx, wr.bufPtr, uint32(resultSize))
+	errPtr, errSize := unpackUInt64(packedPtrSize[0])
+	defer deallocate.Call(wr.ctx, uint64(errPtr), uint64(errSize))
+
+	errJson, ok := wr.mod.Memory().Read(errPtr, errSize)
 	if !ok {
 		log.Panicf("Memory.Read(%d, %d) out of range of memory size %d",
-			wr.bufPtr, resultSize, wr.mod.Memory().Size(wr.ctx))
+			errPtr, errSize, wr.mod.Memory().Size())
 	}
-	res := string(resultStringBytes)
-	return res
+	return parseVrlCompileError(errJson)
 }
 
-func (wr *WazeroRunner) runVrl(input string) string {
-	vrl := wr.mod.ExportedFunction("vrl_wasm")
+// configureRegex sets the regex used by the guest's regex and VRL exports.
+// Guests without configure_wasm are left alone.
+func (wr *WazeroRunner) configureRegex(cfg RegexConfig) error {
+	configure := wr.mod.ExportedFunction("configure_wasm")
+	if configure == nil {
+		return nil
+	}
 
-	return wr.executeStringInStringOut(input, vrl)
+	input := cfg.Pattern + cfg.Replacement
+	if len(input) > bufSize {
+		return fmt.Errorf("pattern and replacement length %d is bigger than the buffer %d", len(input), bufSize)
+	}
+
+	if !wr.mod.Memory().Write(wr.bufPtr, []byte(input)) {
+		log.Panicf("Memory.Write(%d, %d) out of range of memory size %d",
+			wr.bufPtr, len(input), wr.mod.Memory().Size())
+	}
+
+	results, err := configure.Call(wr.ctx, uint64(wr.bufPtr), uint64(len(cfg.Pattern)),
+		uint64(len(cfg.Replacement)), uint64(cfg.count()), bufSize)
+	if err != nil {
+		return err
+	}
+
+	errSize := uint32(results[0])
+	if errSize == 0 {
+		return nil
+	}
+	errMsg, ok := wr.mod.Memory().Read(wr.bufPtr, errSize)
+	if !ok {
+		log.Panicf("Memory.Read(%d, %d) out of range of memory size %d",
+			wr.bufPtr, errSize, wr.mod.Memory().Size())
+	}
+	return fmt.Errorf("wazero: %s", errMsg)
 }
 
-func (wr *WazeroRunner) runRegex(input string) string {
-	vrl := wr.mod.ExportedFunction("regex_wasm")
+// callBuffered writes input into the buffer and calls the export on it,
+// returning its raw result. A call that exceeds the CallTimeout replaces the
+// instance and returns a *CallTimeoutError.
+func (wr *WazeroRunner) callBuffered(input string, export string) (uint64, error) {
+	wr.recycleIfDue()
+	funcy := wr.mod.ExportedFunction(export)
+	if funcy == nil {
+		return 0, errMissingExport("wazero", export)
+	}
+	if len(input) > bufSize {
+		return 0, &BufferOverflowError{Runtime: "wazero", Function: export, Size: len(input), Input: true}
+	}
+
+	if !wr.mod.Memory().Write(wr.bufPtr, []byte(input)) {
+		log.Panicf("Memory.Write(%d, %d) out of range of memory size %d",
+			wr.bufPtr, len(input), wr.mod.Memory().Size())
+	}
+
+	results, err := wr.call(funcy, export, uint64(wr.bufPtr), uint64(len(input)), bufSize)
+	if err != nil {
+		return 0, err
+	}
 
-	return wr.executeStringInStringOut(input, vrl)
+	wr.memory.called(uint64(wr.mod.Memory().Size()))
+	return results[0], nil
 }
 
-func (wr *WazeroRunner) runNoop(input string) string {
-	noop := wr.mod.ExportedFunction("noop_wasm")
-	return wr.executeStringInStringOut(input, noop)
+// call calls funcy with params. A call that exceeds the CallTimeout or traps
+// replaces the instance and returns a *CallTimeoutError or *GuestTrapError.
+func (wr *WazeroRunner) call(funcy api.Function, export string, params ...uint64) ([]uint64, error) {
+	ctx := wr.ctx
+	timeout := wr.options.CallTimeout
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	results, err := funcy.Call(ctx, params...)
+	if errors.Is(err, context.DeadlineExceeded) {
+		wr.recycle()
+		return nil, &CallTimeoutError{Runtime: "wazero", Function: export, Timeout: timeout}
+	}
+	if err != nil {
+		wr.recycle()
+		return nil, &GuestTrapError{Runtime: "wazero", Function: export, Err: err}
+	}
+	return results, nil
 }
 
-func (wr *WazeroRunner) runNoopDynamicAllocation(input string) string {
-	noop := wr.mod.ExportedFunction("noop_wasm_dynamic_allocation")
+// callDynamic copies input into memory from the guest's allocator and calls
+// the export on it, which returns the ptr and length of an output it
+// allocated. Unlike callBuffered, records of any size fit. It returns the
+// output, and whether the guest set dynamicErrorFlag.
+func (wr *WazeroRunner) callDynamic(input string, export string) (string, bool, error) {
+	wr.recycleIfDue()
+	funcy := wr.mod.ExportedFunction(export)
+	if funcy == nil {
+		return "", false, errMissingExport("wazero", export)
+	}
 	allocate := wr.mod.ExportedFunction("allocate")
 	deallocate := wr.mod.ExportedFunction("deallocate")
 
-	inputSize := uint64(len(input))
-
 	// Instead of an arbitrary memory offset, use Rust's allocator. Notice
 	// there is nothing string-specific in this allocation function. The same
 	// function could be used to pass binary serialized data to Wasm.
-	results, err := allocate.Call(wr.ctx, inputSize)
+	inputSize := uint64(len(input))
+	results, err := wr.call(allocate, "allocate", inputSize)
 	if err != nil {
-		log.Panicln(err)
+		// Growing memory past MemoryLimits.MaxPages traps.
+		return "", false, err
 	}
-
 	inputPtr := results[0]
-	// This pointer was allocated by Rust, but owned by Go, So, we have to
-	// deallocate it when finished
-	defer deallocate.Call(wr.ctx, inputPtr, inputSize)
 
-	// The pointer is a linear memory offset, which is where we write the input string.
-	if !wr.mod.Memory().Write(wr.ctx, uint32(inputPtr), []byte(input)) {
+	// The pointer is a linear memory offset, which is where we write the
+	// input string. Write looks the memory up again, so it is safe after
+	// allocate grew it.
+	if !wr.mod.Memory().Write(uint32(inputPtr), []byte(input)) {
 		log.Panicf("Memory.Write(%d, %d) out of range of memory size %d",
-			inputPtr, inputSize, wr.mod.Memory().Size(wr.ctx))
+			inputPtr, inputSize, wr.mod.Memory().Size())
 	}
 
-	// Invoke 'noop' passing in the pointer+size of the input string
 	// Result is a packed ptr+size of a rust-allocated string
-	packedPtrSize, err := noop.Call(wr.ctx, inputPtr, inputSize)
+	results, err = wr.call(funcy, export, inputPtr, inputSize)
 	if err != nil {
+		// The instance was replaced, along with everything it allocated.
+		return "", false, err
+	}
+	outputPtr, packedSize := unpackUInt64(results[0])
+	outputSize := packedSize &^ dynamicErrorFlag
+
+	outputBytes, ok := wr.mod.Memory().Read(outputPtr, outputSize)
+	if !ok {
+		log.Panicf("Memory.Read(%d, %d) out of range of memory size %d",
+			outputPtr, outputSize, wr.mod.Memory().Size())
+	}
+	// Read returns a view of the memory, copy it before deallocating.
+	output := string(outputBytes)
+
+	// These pointers were allocated by Rust, but owned by Go, So, we have to
+	// deallocate them when finished
+	if _, err := deallocate.Call(wr.ctx, uint64(outputPtr), uint64(outputSize)); err != nil {
 		log.Panicln(err)
 	}
-	noopResultPtr, noopResultSize := unpackUInt64(packedPtrSize[0])
-	// This pointer was allocated by Rust, but owned by Go, So, we have to
-	// deallocate it when finished
-	defer deallocate.Call(wr.ctx, uint64(noopResultPtr), uint64(noopResultSize))
+	if _, err := deallocate.Call(wr.ctx, inputPtr, inputSize); err != nil {
+		log.Panicln(err)
+	}
+
+	wr.memory.called(uint64(wr.mod.Memory().Size()))
+	return output, packedSize&dynamicErrorFlag != 0, nil
+}
+
+func (wr *WazeroRunner) ring() ring {
+	return wr.rings
+}
+
+// ringMemory returns a view of the guest's memory.
+func (wr *WazeroRunner) ringMemory() []byte {
+	memory, _ := wr.mod.Memory().Read(0, wr.mod.Memory().Size())
+	return memory
+}
+
+func (wr *WazeroRunner) drainRing(transform ringTransform) (uint32, error) {
+	drain := wr.mod.ExportedFunction("ring_drain_wasm")
+	results, err := wr.call(drain, "ring_drain_wasm", uint64(wr.rings.ptr), uint64(transform))
+	if err != nil {
+		return 0, err
+	}
+	wr.memory.called(uint64(wr.mod.Memory().Size()))
+	return uint32(results[0]), nil
+}
 
-	// The pointer is a linear memory offset, which is where we write the input string.
-	resultStringBytes, ok := wr.mod.Memory().Read(wr.ctx, noopResultPtr, noopResultSize)
+// runRing runs transform on records through the ring buffers in the guest's
+// memory and emits the results in order, see streamRing.
+func (wr *WazeroRunner) runRing(records []string, transform ringTransform, emit func(string, error)) error {
+	if !wr.hasExport("ring_drain_wasm") {
+		return errMissingExport("wazero", "ring_drain_wasm")
+	}
+	return streamRing(wr, records, transform, emit)
+}
+
+// readBuffer returns the first resultSize bytes of the buffer, which export
+// wrote. A bigger size than the buffer means the output didn't fit.
+func (wr *WazeroRunner) readBuffer(resultSize uint32, export string) (string, error) {
+	if resultSize > bufSize {
+		return "", &BufferOverflowError{Runtime: "wazero", Function: export, Size: int(resultSize)}
+	}
+
+	resultStringBytes, ok := wr.mod.Memory().Read(wr.bufPtr, resultSize)
 	if !ok {
 		log.Panicf("Memory.Read(%d, %d) out of range of memory size %d",
-			noopResultPtr, noopResultSize, wr.mod.Memory().Size(wr.ctx))
+			wr.bufPtr, resultSize, wr.mod.Memory().Size())
 	}
-	res := string(resultStringBytes)
-	return res
+	return string(resultStringBytes), nil
+}
+
+func (wr *WazeroRunner) executeStringInStringOut(input string, export string) (string, error) {
+	resultSize, err := wr.callBuffered(input, export)
+	if err != nil {
+		return "", err
+	}
+	return wr.readBuffer(uint32(resultSize), export)
+}
+
+// executeVrl runs one of the VRL exports, which return the result length
+// packed with a flag that is set when the buffer holds a runtime error.
+func (wr *WazeroRunner) executeVrl(input string, export string) (string, error) {
+	packed, err := wr.callBuffered(input, export)
+	if err != nil {
+		return "", err
+	}
+	isError, resultSize := unpackUInt64(packed)
+	res, err := wr.readBuffer(resultSize, export)
+	if err != nil {
+		return "", err
+	}
+	if isError != 0 {
+		return "", parseVrlRuntimeError([]byte(res))
+	}
+	return res, nil
+}
+
+func (wr *WazeroRunner) runVrl(input string) (string, error) {
+	return wr.executeVrl(input, "vrl_wasm")
+}
+
+// runVrlEvent runs the VRL program on a JSON event and returns the resulting
+// event as JSON.
+func (wr *WazeroRunner) runVrlEvent(event string) (string, error) {
+	return wr.executeVrl(event, "vrl_event_wasm")
+}
+
+// runVrlTarget runs the VRL program on a JSON target holding an event, its
+// metadata and secrets. See resolveVrlTarget.
+func (wr *WazeroRunner) runVrlTarget(target string) (string, error) {
+	return wr.executeVrl(target, "vrl_target_wasm")
+}
+
+func (wr *WazeroRunner) runRegex(input string) (string, error) {
+	return wr.executeStringInStringOut(input, "regex_wasm")
+}
+
+func (wr *WazeroRunner) runNoop(input string) (string, error) {
+	return wr.executeStringInStringOut(input, "noop_wasm")
+}
+
+// runEnrich appends the enrichment of the record's key, which the guest
+// looks up with the functions of hostModule.
+func (wr *WazeroRunner) runEnrich(input string) (string, error) {
+	return wr.executeStringInStringOut(input, "enrich_wasm")
+}
+
+// runNoopDynamicAllocation is runNoop with the output allocated by the
+// guest, see callDynamic.
+func (wr *WazeroRunner) runNoopDynamicAllocation(input string) (string, error) {
+	output, _, err := wr.callDynamic(input, "noop_wasm_dynamic_allocation")
+	return output, err
+}
+
+// runRegexDynamicAllocation is runRegex with the output allocated by the
+// guest, see callDynamic.
+func (wr *WazeroRunner) runRegexDynamicAllocation(input string) (string, error) {
+	output, _, err := wr.callDynamic(input, "regex_wasm_dynamic_allocation")
+	return output, err
+}
+
+// runVrlDynamicAllocation is runVrl with the output allocated by the guest,
+// see callDynamic.
+func (wr *WazeroRunner) runVrlDynamicAllocation(input string) (string, error) {
+	output, isError, err := wr.callDynamic(input, "vrl_wasm_dynamic_allocation")
+	if err != nil {
+		return "", err
+	}
+	if isError {
+		return "", parseVrlRuntimeError([]byte(output))
+	}
+	return output, nil
 }
 
 func (wr *WazeroRunner) Close() {
 	wr.runtime.Close(wr.ctx)
+	if wr.cache != nil {
+		wr.cache.Close(wr.ctx)
+	}
+	wr.memory.unregister()
+	wr.stdout.Close()
+	wr.stderr.Close()
 }
 
 func runWazero() {
@@ -161,6 +481,9 @@ func runWazero() {
 	runner := NewWazeroRunner(ctx, compiledWasmBytes)
 	defer runner.Close() // This closes everything this Runtime created.
 
-	res := runner.runNoop("hello wazero")
+	res, err := runner.runNoop("hello wazero")
+	if err != nil {
+		log.Panicln(err)
+	}
 	fmt.Println(res)
 }
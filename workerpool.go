@@ -0,0 +1,214 @@
+package main
+
+//#include <sched.h>
+//#include "helloRust.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"unsafe"
+)
+
+// RustWorkerPool runs records on Rust threads that live as long as the pool,
+// instead of calling into Rust on the goroutine's thread like the other FFI
+// functions. Go copies a record into the buffer of a free job and pushes the
+// job onto a lock-free queue the workers poll, then polls the job until it is
+// done. See src/workers.rs.
+//
+// Every worker keeps its own VRL runtime, where cgo calls may land on any
+// thread. The pool is safe for concurrent use.
+type RustWorkerPool struct {
+	queue *C.WorkerQueue
+	cells []C.WorkerQueueCell
+	jobs  []C.WorkerJob
+	// free holds the indexes of the jobs no caller uses.
+	free chan uint32
+}
+
+const (
+	// rustWorkerJobs is how many records can be in flight, a power of two.
+	rustWorkerJobs = 256
+	// rustWorkerRecordCapacity is the size of each job's input and output.
+	rustWorkerRecordCapacity = 64 << 10
+
+	// rustWorkerOverflow is the output length of a job whose output didn't
+	// fit.
+	rustWorkerOverflow = 0xFFFFFFFF
+	// rustWorkerPanicked is the output length of a job whose transform
+	// panicked. The worker caught the panic and goes on.
+	rustWorkerPanicked = 0xFFFFFFFE
+)
+
+var (
+	errWorkerRecordTooBig = fmt.Errorf("record does not fit in the worker pool's buffer of %d bytes", rustWorkerRecordCapacity)
+	errWorkerOutputTooBig = fmt.Errorf("output does not fit in the worker pool's buffer of %d bytes", rustWorkerRecordCapacity)
+	errWorkerPanicked     = errors.New("the worker pool's transform panicked")
+)
+
+// NewRustWorkerPool starts threads Rust workers.
+func NewRustWorkerPool(threads int) *RustWorkerPool {
+	if threads < 1 {
+		log.Panicf("A worker pool needs at least one thread, got %d", threads)
+	}
+
+	queue := C.worker_pool_start(C.uint(threads), rustWorkerJobs, rustWorkerRecordCapacity)
+	p := &RustWorkerPool{
+		queue: queue,
+		cells: unsafe.Slice(queue.cells, rustWorkerJobs),
+		jobs:  unsafe.Slice(queue.jobs, rustWorkerJobs),
+		free:  make(chan uint32, rustWorkerJobs),
+	}
+	for i := uint32(0); i < rustWorkerJobs; i++ {
+		p.free <- i
+	}
+	return p
+}
+
+// Close stops the workers. No call may be running.
+func (p *RustWorkerPool) Close() {
+	C.worker_pool_stop(p.queue)
+	p.queue = nil
+}
+
+// submit writes record to job and queues it.
+func (p *RustWorkerPool) submit(job uint32, record string, transform ringTransform) error {
+	if len(record) > rustWorkerRecordCapacity {
+		return errWorkerRecordTooBig
+	}
+
+	j := &p.jobs[job]
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(j.input)), rustWorkerRecordCapacity), record)
+	j.transform = C.uint32_t(transform)
+	j.input_len = C.uint32_t(len(record))
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&j.done)), 0)
+	p.enqueue(job)
+	return nil
+}
+
+// enqueue pushes job onto the queue, the producer side of the workers'
+// dequeue. There are as many cells as jobs, so a free cell always turns up.
+func (p *RustWorkerPool) enqueue(job uint32) {
+	tail := (*uint32)(unsafe.Pointer(&p.queue.tail))
+	for {
+		pos := atomic.LoadUint32(tail)
+		cell := &p.cells[pos&(rustWorkerJobs-1)]
+		seq := (*uint32)(unsafe.Pointer(&cell.seq))
+		switch dif := int32(atomic.LoadUint32(seq) - pos); {
+		case dif == 0:
+			if atomic.CompareAndSwapUint32(tail, pos, pos+1) {
+				atomic.StoreUint32((*uint32)(unsafe.Pointer(&cell.job)), job)
+				atomic.StoreUint32(seq, pos+1)
+				return
+			}
+		case dif < 0:
+			// A worker took the job of this cell but didn't release it yet.
+			C.sched_yield()
+		}
+	}
+}
+
+// wait polls job until it is done, returns its output and frees it.
+func (p *RustWorkerPool) wait(job uint32) (string, error) {
+	j := &p.jobs[job]
+	done := (*uint32)(unsafe.Pointer(&j.done))
+	for spins := 0; atomic.LoadUint32(done) == 0; spins++ {
+		// Yield the thread rather than the goroutine, so the workers get
+		// the CPU when they share it with us.
+		if spins >= 64 {
+			C.sched_yield()
+		}
+	}
+
+	length := uint32(j.output_len)
+	var output string
+	var err error
+	switch {
+	case length == rustWorkerOverflow:
+		err = errWorkerOutputTooBig
+	case length == rustWorkerPanicked:
+		err = errWorkerPanicked
+	case length&dynamicErrorFlag != 0:
+		err = parseVrlRuntimeError(C.GoBytes(unsafe.Pointer(j.output), C.int(length&^dynamicErrorFlag)))
+	default:
+		output = C.GoStringN((*C.char)(unsafe.Pointer(j.output)), C.int(length))
+	}
+	p.free <- job
+	return output, err
+}
+
+// run transforms one record, transform numbers the transforms like
+// ring_drain_wasm.
+func (p *RustWorkerPool) run(record string, transform ringTransform) (string, error) {
+	job := <-p.free
+	if err := p.submit(job, record, transform); err != nil {
+		p.free <- job
+		return "", err
+	}
+	return p.wait(job)
+}
+
+func (p *RustWorkerPool) runNoop(record string) (string, error) {
+	return p.run(record, ringNoop)
+}
+
+func (p *RustWorkerPool) runRegex(record string) (string, error) {
+	return p.run(record, ringRegex)
+}
+
+func (p *RustWorkerPool) runVrl(record string) (string, error) {
+	return p.run(record, ringVrl)
+}
+
+// pendingJob is a record of runBatch in flight, or the error it failed with
+// before it was submitted.
+type pendingJob struct {
+	job uint32
+	err error
+}
+
+// runBatch transforms records on as many workers as there are free jobs, and
+// emits the results in order, like streamRing.
+func (p *RustWorkerPool) runBatch(records []string, transform ringTransform, emit func(string, error)) {
+	var pending []pendingJob
+	for len(records) > 0 || len(pending) > 0 {
+		for len(records) > 0 {
+			var job uint32
+			if len(pending) == 0 {
+				// Other callers hold every job, wait for one of them.
+				job = <-p.free
+			} else {
+				var ok bool
+				if job, ok = p.tryAcquire(); !ok {
+					break
+				}
+			}
+			if err := p.submit(job, records[0], transform); err != nil {
+				p.free <- job
+				pending = append(pending, pendingJob{err: err})
+			} else {
+				pending = append(pending, pendingJob{job: job})
+			}
+			records = records[1:]
+		}
+
+		next := pending[0]
+		pending = pending[1:]
+		if next.err != nil {
+			emit("", next.err)
+		} else {
+			emit(p.wait(next.job))
+		}
+	}
+}
+
+// tryAcquire takes a free job without waiting.
+func (p *RustWorkerPool) tryAcquire() (uint32, bool) {
+	select {
+	case job := <-p.free:
+		return job, true
+	default:
+		return 0, false
+	}
+}